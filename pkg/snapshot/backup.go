@@ -0,0 +1,167 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/util/collections"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// resticVolumesAnnotation lists the pod volumes Velero backs up with
+	// restic instead of snapshots
+	resticVolumesAnnotation = "backup.velero.io/backup-volumes"
+	// resticVolumesExcludesAnnotation lists the pod volumes Velero doesn't
+	// back up with restic when restic is the default
+	resticVolumesExcludesAnnotation = "backup.velero.io/backup-volumes-excludes"
+
+	// backupCallTimeout is the timeout of calls reading Velero backups
+	backupCallTimeout = 30 * time.Second
+)
+
+var (
+	// veleroClient reads Velero resources in the cluster Velero runs in
+	veleroClient     *rest.RESTClient
+	veleroClientLock sync.Mutex
+)
+
+// getVeleroBackup returns the Velero Backup with the given name
+func getVeleroBackup(name string) (*velerov1.Backup, error) {
+	client, err := getVeleroClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Velero client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), backupCallTimeout)
+	defer cancel()
+	data, err := client.Get().Namespace(veleroNamespace()).Resource("backups").Name(name).DoRaw(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backup %v: %v", name, err)
+	}
+	backup := &velerov1.Backup{}
+	if err := json.Unmarshal(data, backup); err != nil {
+		return nil, fmt.Errorf("invalid backup %v: %v", name, err)
+	}
+	return backup, nil
+}
+
+// getVeleroClient returns the client of the Velero API, configured like the
+// client of the cluster Velero runs in
+func getVeleroClient() (*rest.RESTClient, error) {
+	veleroClientLock.Lock()
+	defer veleroClientLock.Unlock()
+	if veleroClient != nil {
+		return veleroClient, nil
+	}
+
+	var config *rest.Config
+	var err error
+	if kubeconfig := os.Getenv("KUBECONFIG"); kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	config.APIPath = "/apis"
+	config.GroupVersion = &velerov1.SchemeGroupVersion
+	config.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
+
+	client, err := rest.RESTClientFor(config)
+	if err != nil {
+		return nil, err
+	}
+	veleroClient = client
+	return veleroClient, nil
+}
+
+// backupIncludesPVC returns true if the volume of the PVC is snapshotted as
+// part of the backup. The namespaces, excluded resources and label selectors
+// of the backup are applied to the PVC and the pods using it, as Velero
+// does, and volumes backed up with restic are left out.
+func backupIncludesPVC(backup *velerov1.Backup, pvc *v1.PersistentVolumeClaim, pods []v1.Pod) bool {
+	if backup.Spec.SnapshotVolumes != nil && !*backup.Spec.SnapshotVolumes {
+		return false
+	}
+	namespaces := collections.NewIncludesExcludes().
+		Includes(backup.Spec.IncludedNamespaces...).
+		Excludes(backup.Spec.ExcludedNamespaces...)
+	if !namespaces.ShouldInclude(pvc.Namespace) {
+		return false
+	}
+	for _, resource := range backup.Spec.ExcludedResources {
+		switch strings.ToLower(resource) {
+		case "persistentvolumeclaims", "pvc", "persistentvolumes", "pv":
+			return false
+		}
+	}
+
+	// PVCs not selected themselves are backed up with the pods using them
+	selected := backupSelects(backup, pvc.Labels)
+	for _, pod := range pods {
+		selected = selected || backupSelects(backup, pod.Labels)
+		if backedUpWithRestic(backup, &pod, pvc.Name) {
+			return false
+		}
+	}
+	return selected
+}
+
+// backupSelects returns true if the label selectors of the backup select
+// an object with the given labels
+func backupSelects(backup *velerov1.Backup, objectLabels map[string]string) bool {
+	selectors := backup.Spec.OrLabelSelectors
+	if backup.Spec.LabelSelector != nil {
+		selectors = append(selectors, backup.Spec.LabelSelector)
+	}
+	if len(selectors) == 0 {
+		return true
+	}
+	for _, s := range selectors {
+		selector, err := metav1.LabelSelectorAsSelector(s)
+		if err == nil && selector.Matches(labels.Set(objectLabels)) {
+			return true
+		}
+	}
+	return false
+}
+
+// backedUpWithRestic returns true if the pod volume of the PVC is backed up
+// with restic instead of being snapshotted
+func backedUpWithRestic(backup *velerov1.Backup, pod *v1.Pod, claimName string) bool {
+	defaultRestic := backup.Spec.DefaultVolumesToRestic != nil && *backup.Spec.DefaultVolumesToRestic
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil || volume.PersistentVolumeClaim.ClaimName != claimName {
+			continue
+		}
+		if defaultRestic {
+			return !containsString(annotationList(pod, resticVolumesExcludesAnnotation), volume.Name)
+		}
+		return containsString(annotationList(pod, resticVolumesAnnotation), volume.Name)
+	}
+	return false
+}
+
+// annotationList returns the comma separated values of the pod annotation
+func annotationList(pod *v1.Pod, annotation string) []string {
+	var values []string
+	for _, value := range strings.Split(pod.Annotations[annotation], ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -2,10 +2,14 @@ package snapshot
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/libopenstorage/openstorage/api"
 	"github.com/libopenstorage/openstorage/volume"
+	"github.com/portworx/sched-ops/k8s/core"
 	"github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/util/uuid"
 )
@@ -13,139 +17,635 @@ import (
 const (
 	configCred = "credId"
 	incrementalCountLabel            = "portworx.io/cloudsnap-incremental-count"
+
+	// cloudBackupTaskPrefix is prepended to the deterministic task name used
+	// for cloud backups so that a retried CreateSnapshot can find the task
+	// started by a previous attempt
+	cloudBackupTaskPrefix = "velero"
+	// maxCloudBackupAttempts is the number of times the cloud backup of a
+	// volume is restarted after failing within the same Velero backup
+	maxCloudBackupAttempts = 10
+
+	// Labels added to cloud backups and restored volumes to identify the
+	// PVC that the volume belonged to
+	pvcNameLabel      = "pvc"
+	pvcNamespaceLabel = "namespace"
 )
 
+// restoreLabelKeys are the cloud backup labels that are copied to the
+// volume restored from it
+var restoreLabelKeys = []string{
+	veleroBackupTag,
+	veleroPVTag,
+	pvcNameLabel,
+	pvcNamespaceLabel,
+	csiDriverLabel,
+}
+
 type cloudSnapshotPlugin struct {
 	Plugin
 	pxClient *portworxClient
 	log    logrus.FieldLogger
 	credID string
+	overrides *restoreOverrides
+	timeout time.Duration
+	group *groupConfig
+	quiesce *quiesceConfig
+	fstrim *fstrimConfig
 }
 
 func (c *cloudSnapshotPlugin) Init(config map[string]string) error {
 	c.credID = config[configCred]
 
+	timeout, err := parseCloudsnapTimeout(config)
+	if err != nil {
+		c.log.Errorf("%v", err)
+		return err
+	}
+	c.timeout = timeout
+
+	if c.group, err = parseGroupConfig(config); err != nil {
+		c.log.Errorf("%v", err)
+		return err
+	}
+
+	if c.quiesce, err = parseQuiesceConfig(config); err != nil {
+		c.log.Errorf("%v", err)
+		return err
+	}
+
+	if c.fstrim, err = parseFstrimConfig(config); err != nil {
+		c.log.Errorf("%v", err)
+		return err
+	}
+
+	if err := c.initCredential(config); err != nil {
+		c.log.Errorf("%v", err)
+		return err
+	}
+
 	c.log.Infof("Init'ing portworx cloud snapshot with credID %v", c.credID)
 	return nil
 }
 
 func (c *cloudSnapshotPlugin) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (string, error) {
-	volDriver, err := c.pxClient.getVolumeDriver()
+	id, err := parseCloudSnapshotID(snapshotID)
+	if err != nil {
+		return "", err
+	}
+	if id.isLegacy() {
+		volDriver, err := c.pxClient.getVolumeDriver()
+		if err != nil {
+			return "", err
+		}
+		if err := c.lookupCloudBackup(volDriver, id); err != nil {
+			return "", err
+		}
+	}
+
+	volDriver, err := c.pxClient.getVolumeDriverForLabels(id.Labels, c.log)
+	if err != nil {
+		return "", err
+	}
+	overrides := c.overrides.forVolume(volumeType, volumeAZ, iops, c.log)
+	return c.restoreCloudBackup(volDriver, id, overrides)
+}
+
+// restoreCloudBackup restores the cloud backup to a new volume with the given
+// overrides and returns the ID of the volume
+func (c *cloudSnapshotPlugin) restoreCloudBackup(
+	volDriver volume.VolumeDriver,
+	id *cloudSnapshotID,
+	overrides *restoreOverrides,
+) (string, error) {
+	credID := c.credentialForSnapshot(id)
+
+	// Create a new name for restore PV
+	restorePVName := "pvc-" + string(uuid.NewUUID())
+
+	response, err := volDriver.CloudBackupRestore(&api.CloudBackupRestoreRequest{
+		ID:                id.CloudBackupID,
+		CredentialUUID:    credID,
+		RestoreVolumeName: restorePVName,
+		Spec:              overrides.cloudRestoreSpec(),
+	})
 	if err != nil {
+		c.log.Infof("Error starting cloudsnap restore from snapshot %v (source volume %v) to %v", id.CloudBackupID, id.SrcVolumeName, restorePVName)
 		return "", err
 	}
 
-	// Enumerating can be expensive but we need to do it to get the original
-	// volume name. Velero already has it so it can pass it down to us.
-	// CloudBackupRestore can also be updated to restore to the original volume
-	// name.
+	c.log.Infof("Started cloud snapshot restore %v to volume %v", id.CloudBackupID, restorePVName)
+	err = c.waitForCloudBackup(volDriver, response.Name, api.CloudRestoreOp)
+	if err != nil {
+		c.log.Errorf("Error restoring %v to volume %v: %v", id.CloudBackupID, restorePVName, err)
+		return "", err
+	}
+
+	c.log.Infof("Finished cloud snapshot restore %v for %v to volume %v", response.Name, id.CloudBackupID, restorePVName)
+
+	if labels := id.Labels; len(labels) > 0 {
+		err := volDriver.Set(restorePVName, &api.VolumeLocator{VolumeLabels: labels}, nil)
+		if err != nil {
+			c.log.Warnf("Failed to set labels %v on restored volume %v: %v", labels, restorePVName, err)
+		}
+	}
+	overrides.ownership.applyOwnership(volDriver, restorePVName, id.Ownership, c.log)
+	return restorePVName, nil
+}
+
+// lookupCloudBackup fills in the details of a legacy snapshot ID from the
+// cloud backup enumeration
+func (c *cloudSnapshotPlugin) lookupCloudBackup(volDriver volume.VolumeDriver, id *cloudSnapshotID) error {
+	// Enumerating can be expensive but legacy snapshot IDs don't carry the
+	// original volume name. Snapshot IDs returned by newer versions of the
+	// plugin include it and skip this.
 	enumRequest := &api.CloudBackupEnumerateRequest{
 		CloudBackupGenericRequest: api.CloudBackupGenericRequest{
 			CredentialUUID: c.credID,
-			CloudBackupID:  snapshotID,
+			CloudBackupID:  id.CloudBackupID,
 		},
 	}
 
 	enumResponse, err := volDriver.CloudBackupEnumerate(enumRequest)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	srcVolumeName := ""
 	for _, backup := range enumResponse.Backups {
-		if backup.ID == snapshotID {
-			srcVolumeName = backup.SrcVolumeName
+		if backup.ID == id.CloudBackupID {
+			id.SrcVolumeName = backup.SrcVolumeName
+			id.Labels = restoreVolumeLabels(backup.Metadata)
 			break
 		}
 	}
 
-	if srcVolumeName == "" {
-		msg := fmt.Sprintf("could not find backup associated with ID: %v", snapshotID)
+	if id.SrcVolumeName == "" {
+		msg := fmt.Sprintf("could not find backup associated with ID: %v", id.CloudBackupID)
 		c.log.Infof(msg)
-		return "", fmt.Errorf("%v", msg)
+		return fmt.Errorf("%v", msg)
 	}
+	return nil
+}
 
-	// Create a new name for restore PV
-	restorePVName := "pvc-" + string(uuid.NewUUID())
+// credentialForSnapshot returns the credential to use to access the cloud
+// backup of the given snapshot. The configured credential takes precedence
+// since credential UUIDs differ between clusters.
+func (c *cloudSnapshotPlugin) credentialForSnapshot(id *cloudSnapshotID) string {
+	if c.credID != "" {
+		return c.credID
+	}
+	return id.CredentialUUID
+}
 
-	response, err := volDriver.CloudBackupRestore(&api.CloudBackupRestoreRequest{
-		ID:                snapshotID,
-		CredentialUUID:    c.credID,
-		RestoreVolumeName: restorePVName,
+func (c *cloudSnapshotPlugin) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
+	return volumeInfo(c.pxClient, volumeID, "portworx-cloudsnapshot", c.log)
+}
+
+func (c *cloudSnapshotPlugin) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (string, error) {
+	volDriver, err := c.pxClient.getVolumeDriverForPV(tags[veleroPVTag], c.log)
+	if err != nil {
+		return "", err
+	}
+
+	vols, err := volDriver.Inspect([]string{volumeID})
+	if err != nil {
+		return "", err
+	}
+	if len(vols) == 0 {
+		return "", fmt.Errorf("Volume %v not found", volumeID)
+	}
+
+	request := &api.CloudBackupCreateRequest{
+		VolumeID:       volumeID,
+		CredentialUUID: c.credID,
+		Labels:         c.cloudBackupLabels(tags),
+	}
+	if err := applyIncrementalCount(request, tags); err != nil {
+		return "", err
+	}
+	backupName := strings.TrimSpace(tags[veleroBackupTag])
+	request.Name = cloudBackupTaskName(backupName, volumeID)
+
+	group, err := c.group.groupForPV(c.pxClient.kubeOps, tags[veleroPVTag], backupName)
+	if err != nil {
+		return "", fmt.Errorf("failed to get group of volume %v: %v", volumeID, err)
+	}
+
+	var taskName string
+	inGroup := group != nil && group.contains(volumeID) && backupName != ""
+	if inGroup {
+		c.trimVolume(volDriver, vols[0])
+		taskName, err = c.startGroupCloudBackup(volDriver, request, backupName, group)
+	} else {
+		// A retried backup resumes the task started before, which was
+		// already trimmed
+		taskName, err = c.findCloudBackupTask(volDriver, request)
+		if err == nil && taskName == "" {
+			c.trimVolume(volDriver, vols[0])
+			taskName, err = c.createCloudBackup(volDriver, request, backupName)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = c.waitForCloudBackup(volDriver, taskName, api.CloudBackupOp)
+	if err != nil {
+		c.log.Errorf("Error backing up volume %v: %v", volumeID, err)
+		return "", err
+	}
+	statusResponse, err := volDriver.CloudBackupStatus(&api.CloudBackupStatusRequest{
+		ID: taskName,
 	})
 	if err != nil {
-		c.log.Infof("Error starting cloudsnap restore from snapshot %v (source volume %v) to %v", snapshotID, srcVolumeName, restorePVName)
 		return "", err
 	}
+	cloudBackupID := statusResponse.Statuses[taskName].ID
+	c.log.Infof("Finished cloud snapshot backup %v for %v to %v", taskName, volumeID, cloudBackupID)
+	if inGroup {
+		if err := claimGroupSnapshot(backupName, group, volumeID); err != nil {
+			c.log.Warnf("Failed to record cloud snapshot of %v in group %v: %v", volumeID, group.key, err)
+		}
+	}
 
-	c.log.Infof("Started cloud snapshot restore %v to volume %v", snapshotID, restorePVName)
-	err = volume.CloudBackupWaitForCompletion(volDriver, response.Name,
-		api.CloudRestoreOp)
+	id := newCloudSnapshotID(cloudBackupID, vols[0].Locator.Name, c.credID, restoreVolumeLabels(request.Labels))
+	id.Ownership = vols[0].GetSpec().GetOwnership()
+	return id.encode()
+}
+
+// startCloudBackup starts the cloud backup described by request, unless a
+// previous attempt can be resumed, and returns the name of the task
+// performing it
+func (c *cloudSnapshotPlugin) startCloudBackup(volDriver volume.VolumeDriver, request *api.CloudBackupCreateRequest, backupName string) (string, error) {
+	taskName, err := c.findCloudBackupTask(volDriver, request)
+	if err != nil || taskName != "" {
+		return taskName, err
+	}
+	return c.createCloudBackup(volDriver, request, backupName)
+}
+
+// findCloudBackupTask returns the name of the task of a previous attempt at
+// the cloud backup described by request that is in progress or done, so that
+// it is resumed instead of starting a second upload of the same volume. If
+// there is none, an empty name is returned and the name of request is set to
+// the one of the next attempt, since the names of failed tasks can't be
+// reused.
+func (c *cloudSnapshotPlugin) findCloudBackupTask(volDriver volume.VolumeDriver, request *api.CloudBackupCreateRequest) (string, error) {
+	if request.Name == "" {
+		return "", nil
+	}
+
+	baseName := request.Name
+	for attempt := 0; attempt < maxCloudBackupAttempts; attempt++ {
+		name := cloudBackupAttemptName(baseName, attempt)
+		status, ok := c.getCloudBackupStatus(volDriver, name)
+		if !ok {
+			request.Name = name
+			return "", nil
+		}
+		if cloudBackupResumable(status.Status) {
+			c.log.Infof("Found existing cloud snapshot backup %v for %v in state %v, resuming",
+				name, request.VolumeID, status.Status)
+			return name, nil
+		}
+		c.log.Infof("Previous cloud snapshot backup %v for %v is in state %v, restarting",
+			name, request.VolumeID, status.Status)
+	}
+	return "", fmt.Errorf("cloud snapshot backup %v for %v failed %v times, not restarting it",
+		baseName, request.VolumeID, maxCloudBackupAttempts)
+}
+
+// createCloudBackup creates the cloud backup described by request and returns
+// the name of the task performing it
+func (c *cloudSnapshotPlugin) createCloudBackup(volDriver volume.VolumeDriver, request *api.CloudBackupCreateRequest, backupName string) (string, error) {
+	// The local snapshot uploaded by the backup is taken when it is created
+	unquiesce, err := c.quiesce.quiesceVolumes(volDriver, []string{request.VolumeID}, backupName, c.log)
 	if err != nil {
-		c.log.Errorf("Error restoring %v to volume %v: %v", snapshotID, restorePVName, err)
+		return "", err
+	}
+	createResp, err := volDriver.CloudBackupCreate(request)
+	unquiesce()
+	if err != nil {
+		// A concurrent attempt may have started the task between the status
+		// check and the create
+		if request.Name != "" {
+			if status, ok := c.getCloudBackupStatus(volDriver, request.Name); ok && cloudBackupResumable(status.Status) {
+				c.log.Infof("Cloud snapshot backup %v for %v already exists, resuming", request.Name, request.VolumeID)
+				return request.Name, nil
+			}
+		}
 		return "", err
 	}
 
-	c.log.Infof("Finished cloud snapshot restore %v for %v to volume %v", response.Name, snapshotID, restorePVName)
-	return restorePVName, nil
+	c.log.Infof("Started cloud snapshot backup %v for %v", createResp.Name, request.VolumeID)
+	return createResp.Name, nil
 }
 
-func (c *cloudSnapshotPlugin) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
-	return "portworx-cloudsnapshot", nil, nil
+// cloudBackupResumable returns true if a cloud backup task in the given state
+// is in progress or done
+func cloudBackupResumable(status api.CloudBackupStatusType) bool {
+	switch status {
+	case api.CloudBackupStatusNotStarted, api.CloudBackupStatusQueued,
+		api.CloudBackupStatusActive, api.CloudBackupStatusPaused, api.CloudBackupStatusDone:
+		return true
+	}
+	return false
 }
 
-func (c *cloudSnapshotPlugin) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (string, error) {
-	volDriver, err := c.pxClient.getVolumeDriver()
+// startGroupCloudBackup starts a group cloud backup of the volumes in the
+// group, unless one was already started for the group as part of the same
+// Velero backup, and returns the name of the task backing up the volume in
+// request. If the task of the volume failed, a new group cloud backup is
+// started for the members whose task failed, since the others are in progress
+// or done and were or will be returned to Velero.
+func (c *cloudSnapshotPlugin) startGroupCloudBackup(
+	volDriver volume.VolumeDriver,
+	request *api.CloudBackupCreateRequest,
+	backupName string,
+	group *volumeGroup,
+) (string, error) {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+
+	gs, err := getGroupSnapshot(backupName, group)
 	if err != nil {
 		return "", err
 	}
+	members := group
+	if gs == nil {
+		gs = &groupSnapshot{Snapshots: make(map[string]string)}
+	} else {
+		if gs.Snapshots == nil {
+			// Entries saved by older versions only have the group ID
+			if gs.Snapshots, err = c.groupCloudBackupTasks(volDriver, gs.GroupID); err != nil {
+				return "", err
+			}
+		}
+		if taskName, ok := gs.Snapshots[request.VolumeID]; ok {
+			status, found := c.getCloudBackupStatus(volDriver, taskName)
+			if !found || cloudBackupResumable(status.Status) {
+				c.log.Infof("Joining group cloud snapshot backup %v for %v", gs.GroupID, request.VolumeID)
+				return taskName, nil
+			}
+			c.log.Infof("Cloud snapshot backup %v for %v in group %v is in state %v, restarting",
+				taskName, request.VolumeID, gs.GroupID, status.Status)
+		}
 
-	request := &api.CloudBackupCreateRequest{
-		VolumeID:       volumeID,
-		CredentialUUID: c.credID,
+		var active []string
+		for volumeID, taskName := range gs.Snapshots {
+			if status, found := c.getCloudBackupStatus(volDriver, taskName); !found || cloudBackupResumable(status.Status) {
+				active = append(active, volumeID)
+			}
+		}
+		members = group.without(active).without(gs.Claimed)
 	}
-	if incrementalCount, ok := tags[incrementalCountLabel]; ok && len(incrementalCount) > 0 {
-		incrementalCount, err := strconv.ParseUint(incrementalCount, 10, 32)
+
+	if len(members.volumeIDs) < 2 || !members.contains(request.VolumeID) {
+		taskName, err := c.startCloudBackup(volDriver, request, backupName)
 		if err != nil {
-			return "", fmt.Errorf("invalid cloudsnap-incremental-count specified: %v", err)
+			return "", err
 		}
-		if incrementalCount <= 0 {
-			request.Full = true
-		} else {
-			request.FullBackupFrequency = uint32(incrementalCount)
-			request.Full = false
+		gs.Snapshots[request.VolumeID] = taskName
+		gs.Created = time.Now()
+		if err := saveGroupSnapshot(backupName, group, gs); err != nil {
+			return "", fmt.Errorf("failed to save cloud snapshot %v of group %v: %v", taskName, group.key, err)
 		}
+		return taskName, nil
 	}
-	createResp, err := volDriver.CloudBackupCreate(request)
+
+	full, err := c.groupFullBackup(volDriver, request, members.volumeIDs)
+	if err != nil {
+		return "", err
+	}
+	unquiesce, err := c.quiesce.quiesceVolumes(volDriver, members.volumeIDs, backupName, c.log)
 	if err != nil {
 		return "", err
 	}
+	createResp, err := volDriver.CloudBackupGroupCreate(&api.CloudBackupGroupCreateRequest{
+		VolumeIDs:      members.volumeIDs,
+		CredentialUUID: request.CredentialUUID,
+		Full:           full,
+		Labels:         groupCloudBackupLabels(request.Labels, group),
+	})
+	unquiesce()
+	if err != nil {
+		return "", fmt.Errorf("failed to start group cloud snapshot of %v: %v", members.volumeIDs, err)
+	}
+	c.log.Infof("Started group cloud snapshot backup %v for %v", createResp.GroupCloudBackupID, members.volumeIDs)
 
-	c.log.Infof("Started cloud snapshot backup %v for %v", createResp.Name, volumeID)
-	err = volume.CloudBackupWaitForCompletion(volDriver, createResp.Name, api.CloudBackupOp)
+	tasks, err := c.groupCloudBackupTasks(volDriver, createResp.GroupCloudBackupID)
 	if err != nil {
-		c.log.Errorf("Error backing up volume %v: %v", volumeID, err)
 		return "", err
 	}
+	for volumeID, taskName := range tasks {
+		gs.Snapshots[volumeID] = taskName
+	}
+	gs.GroupID = createResp.GroupCloudBackupID
+	gs.Created = time.Now()
+	if err := saveGroupSnapshot(backupName, group, gs); err != nil {
+		return "", fmt.Errorf("failed to save group cloud snapshot %v: %v", gs.GroupID, err)
+	}
+
+	taskName, ok := tasks[request.VolumeID]
+	if !ok {
+		return "", fmt.Errorf("volume %v not found in group cloud snapshot %v", request.VolumeID, gs.GroupID)
+	}
+	return taskName, nil
+}
+
+// groupCloudBackupLabels returns the labels of the cloud backup of a volume
+// shared by all volumes of the group, leaving out those identifying the
+// volume
+func groupCloudBackupLabels(labels map[string]string, group *volumeGroup) map[string]string {
+	shared := make(map[string]string)
+	for k, v := range labels {
+		switch k {
+		case veleroPVTag, pvcNameLabel, csiDriverLabel, ownershipLabel, "pvName":
+			continue
+		case pvcNamespaceLabel:
+			if group.namespace == "" {
+				continue
+			}
+		}
+		shared[k] = v
+	}
+	return shared
+}
+
+// groupCloudBackupTasks returns the names of the tasks of the group cloud
+// backup, by the ID of the volume they back up
+func (c *cloudSnapshotPlugin) groupCloudBackupTasks(volDriver volume.VolumeDriver, groupID string) (map[string]string, error) {
 	statusResponse, err := volDriver.CloudBackupStatus(&api.CloudBackupStatusRequest{
-		ID: createResp.Name,
+		ID: groupID,
 	})
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("failed to get status of group cloud snapshot %v: %v", groupID, err)
+	}
+	tasks := make(map[string]string)
+	for taskName, status := range statusResponse.Statuses {
+		tasks[status.SrcVolumeID] = taskName
+	}
+	return tasks, nil
+}
+
+// groupFullBackup returns true if the group cloud backup of the volumes must
+// be a full backup. Group backups don't take a full backup frequency, so a
+// full backup is taken once any of the volumes has had as many incremental
+// backups in a row as the frequency of request.
+func (c *cloudSnapshotPlugin) groupFullBackup(volDriver volume.VolumeDriver, request *api.CloudBackupCreateRequest, volumeIDs []string) (bool, error) {
+	if request.Full || request.FullBackupFrequency == 0 {
+		return request.Full, nil
+	}
+	for _, volumeID := range volumeIDs {
+		enumResponse, err := volDriver.CloudBackupEnumerate(&api.CloudBackupEnumerateRequest{
+			CloudBackupGenericRequest: api.CloudBackupGenericRequest{
+				SrcVolumeID:    volumeID,
+				CredentialUUID: request.CredentialUUID,
+				StatusFilter:   api.CloudBackupStatusDone,
+			},
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to enumerate cloud snapshots of %v: %v", volumeID, err)
+		}
+		if incrementalBackups(enumResponse.Backups) >= request.FullBackupFrequency {
+			c.log.Infof("Volume %v has %v incremental cloud snapshots, taking a full group backup",
+				volumeID, request.FullBackupFrequency)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// incrementalBackups returns the number of incremental backups taken since
+// the last full backup, incremental backup IDs ending with -incr
+func incrementalBackups(backups []api.CloudBackupInfo) uint32 {
+	sorted := append([]api.CloudBackupInfo(nil), backups...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Timestamp.After(sorted[j].Timestamp) })
+
+	var count uint32
+	for _, backup := range sorted {
+		if !strings.HasSuffix(backup.ID, "-incr") {
+			break
+		}
+		count++
 	}
-	c.log.Infof("Finished cloud snapshot backup %v for %v to %v", createResp.Name, volumeID, statusResponse.Statuses[createResp.Name].ID)
-	return statusResponse.Statuses[createResp.Name].ID, nil
+	return count
+}
+
+// getCloudBackupStatus returns the status of the cloud backup task with the
+// given name and whether it was found
+func (c *cloudSnapshotPlugin) getCloudBackupStatus(volDriver volume.VolumeDriver, taskName string) (api.CloudBackupStatus, bool) {
+	statusResponse, err := volDriver.CloudBackupStatus(&api.CloudBackupStatusRequest{
+		ID: taskName,
+	})
+	if err != nil {
+		c.log.Debugf("Failed to get status of cloud snapshot task %v: %v", taskName, err)
+		return api.CloudBackupStatus{}, false
+	}
+	status, ok := statusResponse.Statuses[taskName]
+	return status, ok
+}
+
+// cloudBackupLabels returns the labels to add to a cloud backup so that it
+// can be traced back to the Velero backup and the PVC it was taken for
+func (c *cloudSnapshotPlugin) cloudBackupLabels(tags map[string]string) map[string]string {
+	labels := make(map[string]string)
+	for k, v := range tags {
+		labels[k] = v
+	}
+	for k, v := range pvLabels(c.pxClient.kubeOps, tags[veleroPVTag], c.log) {
+		labels[k] = v
+	}
+	return labels
+}
+
+// pvLabels returns the labels identifying the PVC bound to the PV and the CSI
+// driver that provisioned it
+func pvLabels(kubeOps core.Ops, pvName string, log logrus.FieldLogger) map[string]string {
+	labels := make(map[string]string)
+	if pvName == "" {
+		return labels
+	}
+	pv, err := kubeOps.GetPersistentVolume(pvName)
+	if err != nil {
+		log.Warnf("Failed to get PV %v, PVC labels will not be recorded: %v", pvName, err)
+		return labels
+	}
+	if pv.Spec.ClaimRef != nil {
+		labels[pvcNameLabel] = pv.Spec.ClaimRef.Name
+		labels[pvcNamespaceLabel] = pv.Spec.ClaimRef.Namespace
+	}
+	if pv.Spec.CSI != nil {
+		labels[csiDriverLabel] = pv.Spec.CSI.Driver
+	}
+	return labels
+}
+
+// restoreVolumeLabels returns the labels to set on a volume restored from a
+// cloud backup with the given metadata
+func restoreVolumeLabels(metadata map[string]string) map[string]string {
+	labels := make(map[string]string)
+	for _, key := range restoreLabelKeys {
+		if value, ok := metadata[key]; ok && value != "" {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+// applyIncrementalCount sets the full backup frequency of the request from
+// the incremental count tag
+func applyIncrementalCount(request *api.CloudBackupCreateRequest, tags map[string]string) error {
+	if incrementalCount, ok := tags[incrementalCountLabel]; ok && len(incrementalCount) > 0 {
+		incrementalCount, err := strconv.ParseUint(incrementalCount, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid cloudsnap-incremental-count specified: %v", err)
+		}
+		if incrementalCount <= 0 {
+			request.Full = true
+		} else {
+			request.FullBackupFrequency = uint32(incrementalCount)
+			request.Full = false
+		}
+	}
+	return nil
+}
+
+// cloudBackupTaskName returns a deterministic name for the cloud backup task
+// of volumeID taken as part of the given Velero backup. An empty name is
+// returned if the backup name is not known, in which case Portworx generates
+// one.
+func cloudBackupTaskName(backupName, volumeID string) string {
+	backupName = strings.TrimSpace(backupName)
+	if backupName == "" {
+		return ""
+	}
+	return cloudBackupTaskPrefix + "-" + backupName + "-" + volumeID
+}
+
+// cloudBackupAttemptName returns the name of the task of the given attempt at
+// a cloud backup, the first attempt using the base name
+func cloudBackupAttemptName(baseName string, attempt int) string {
+	if attempt == 0 {
+		return baseName
+	}
+	return baseName + "-" + strconv.Itoa(attempt)
 }
 
 func (c *cloudSnapshotPlugin) DeleteSnapshot(snapshotID string) error {
-	volDriver, err := c.pxClient.getVolumeDriver()
+	id, err := parseCloudSnapshotID(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	volDriver, err := c.pxClient.getVolumeDriverForLabels(id.Labels, c.log)
 	if err != nil {
 		return err
 	}
 
 	return volDriver.CloudBackupDelete(&api.CloudBackupDeleteRequest{
-		ID:             snapshotID,
-		CredentialUUID: c.credID,
+		ID:             id.CloudBackupID,
+		CredentialUUID: c.credentialForSnapshot(id),
 		Force:          false,
 	})
 }
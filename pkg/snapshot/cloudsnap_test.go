@@ -0,0 +1,120 @@
+package snapshot
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+func TestCloudBackupTaskName(t *testing.T) {
+	tests := []struct {
+		backupName string
+		attempt    int
+		want       string
+	}{
+		{backupName: "backup-1", want: "velero-backup-1-vol-1"},
+		{backupName: " backup-1 ", attempt: 2, want: "velero-backup-1-vol-1-2"},
+		{backupName: "", want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.want, func(t *testing.T) {
+			name := cloudBackupTaskName(test.backupName, "vol-1")
+			if name != "" {
+				name = cloudBackupAttemptName(name, test.attempt)
+			}
+			if name != test.want {
+				t.Errorf("task name is %q, want %q", name, test.want)
+			}
+		})
+	}
+}
+
+func TestCloudCreateSnapshotRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		// previous are the states of the tasks of previous attempts
+		previous    []api.CloudBackupStatusType
+		wantTask    string
+		wantCreates int
+		wantErr     bool
+	}{
+		{
+			name:        "first attempt",
+			wantTask:    "velero-backup-1-vol-1",
+			wantCreates: 1,
+		},
+		{
+			name:     "reuse the upload of the previous attempt",
+			previous: []api.CloudBackupStatusType{api.CloudBackupStatusDone},
+			wantTask: "velero-backup-1-vol-1",
+		},
+		{
+			name:     "reuse the upload restarted by a previous attempt",
+			previous: []api.CloudBackupStatusType{api.CloudBackupStatusFailed, api.CloudBackupStatusDone},
+			wantTask: "velero-backup-1-vol-1-1",
+		},
+		{
+			name:        "restart the failed upload",
+			previous:    []api.CloudBackupStatusType{api.CloudBackupStatusFailed, api.CloudBackupStatusStopped},
+			wantTask:    "velero-backup-1-vol-1-2",
+			wantCreates: 1,
+		},
+		{
+			name:    "give up after too many attempts",
+			wantErr: true,
+		},
+	}
+
+	fastCloudsnapPolls(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			volDriver := newFakeVolumeDriver(testVolume("vol-1", "pvc-1", nil))
+			previous := test.previous
+			if test.wantErr {
+				for i := 0; i < maxCloudBackupAttempts; i++ {
+					previous = append(previous, api.CloudBackupStatusFailed)
+				}
+			}
+			for attempt, status := range previous {
+				volDriver.backups[cloudBackupAttemptName("velero-backup-1-vol-1", attempt)] = &fakeCloudBackup{
+					volumeID: "vol-1",
+					backupID: fmt.Sprintf("bucket/vol-1-backup-%d", attempt),
+					status:   status,
+				}
+			}
+			c := &cloudSnapshotPlugin{log: testLogger(), pxClient: testClient(volDriver, nil), credID: "cred-1"}
+
+			snapshotID, err := c.CreateSnapshot("vol-1", "", map[string]string{veleroBackupTag: "backup-1"})
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("backup returned snapshot %v, want an error", snapshotID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("backup failed: %v", err)
+			}
+
+			if creates := volDriver.callCount("CloudBackupCreate"); creates != test.wantCreates {
+				t.Errorf("%v cloud backups were started, want %v", creates, test.wantCreates)
+			}
+			id, err := parseCloudSnapshotID(snapshotID)
+			if err != nil {
+				t.Fatalf("invalid snapshot ID %v: %v", snapshotID, err)
+			}
+			task, ok := volDriver.backups[test.wantTask]
+			if !ok {
+				t.Fatalf("cloud backup task %v not found", test.wantTask)
+			}
+			if id.CloudBackupID != task.backupID {
+				t.Errorf("snapshot is cloud backup %v, want %v of task %v", id.CloudBackupID, task.backupID, test.wantTask)
+			}
+			if id.SrcVolumeName != "pvc-1" || id.CredentialUUID != "cred-1" {
+				t.Errorf("snapshot is of volume %v with credential %v, want pvc-1 and cred-1",
+					id.SrcVolumeName, id.CredentialUUID)
+			}
+		})
+	}
+}
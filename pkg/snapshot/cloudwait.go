@@ -0,0 +1,135 @@
+package snapshot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
+	"golang.org/x/net/context"
+)
+
+const (
+	// configCloudsnapTimeout is the maximum time to wait for a cloud backup
+	// or restore to finish, as a duration string. No limit if not set.
+	configCloudsnapTimeout = "cloudsnapTimeout"
+
+	// cloudsnapProgressInterval is the interval at which the progress of
+	// cloud backups and restores is logged
+	cloudsnapProgressInterval = time.Minute
+	// maxCloudsnapStatusErrors is the number of consecutive failures to get
+	// the status of a cloud backup or restore after which waiting for it
+	// fails. Each status call is already retried within its retry budget.
+	maxCloudsnapStatusErrors = 10
+)
+
+// cloudsnapPollInterval is the interval at which the status of cloud backups
+// and restores is checked
+var cloudsnapPollInterval = 10 * time.Second
+
+// parseCloudsnapTimeout parses the cloudsnap timeout from the plugin config
+func parseCloudsnapTimeout(config map[string]string) (time.Duration, error) {
+	value := config[configCloudsnapTimeout]
+	if value == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("invalid %v %q, must be a positive duration like 6h", configCloudsnapTimeout, value)
+	}
+	return timeout, nil
+}
+
+// waitForCloudBackup waits for the cloud backup or restore task with the
+// given name to finish, logging its progress. If the task doesn't finish
+// within the configured timeout it is stopped and an error is returned. An
+// error is also returned once its status can't be read
+// maxCloudsnapStatusErrors times in a row.
+func (c *cloudSnapshotPlugin) waitForCloudBackup(volDriver volume.VolumeDriver, taskName string, opType api.CloudBackupOpType) error {
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(cloudsnapPollInterval)
+	defer ticker.Stop()
+
+	var lastStatus api.CloudBackupStatus
+	var lastProgress time.Time
+	statusErrors := 0
+	for {
+		statusResponse, err := volDriver.CloudBackupStatus(&api.CloudBackupStatusRequest{
+			ID: taskName,
+		})
+		if err != nil {
+			if statusErrors++; statusErrors >= maxCloudsnapStatusErrors {
+				return fmt.Errorf("failed to get status of cloud snapshot %v %v %v times: %v",
+					opType, taskName, statusErrors, err)
+			}
+			c.log.Warnf("Failed to get status of cloud snapshot %v %v, will retry: %v", opType, taskName, err)
+		} else {
+			statusErrors = 0
+			status, ok := statusResponse.Statuses[taskName]
+			if !ok {
+				return fmt.Errorf("failed to get cloudsnap status for %v", taskName)
+			}
+			lastStatus = status
+
+			switch status.Status {
+			case api.CloudBackupStatusDone:
+				return nil
+			case api.CloudBackupStatusNotStarted, api.CloudBackupStatusQueued,
+				api.CloudBackupStatusActive, api.CloudBackupStatusPaused:
+				if time.Since(lastProgress) >= cloudsnapProgressInterval {
+					c.logCloudBackupProgress(taskName, opType, status)
+					lastProgress = time.Now()
+				}
+			default:
+				return fmt.Errorf("CloudBackup operation %v for %v in state %v%v",
+					opType, taskName, status.Status, failureCauses(status))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			c.stopCloudBackup(volDriver, taskName, opType)
+			return fmt.Errorf("CloudBackup operation %v for %v timed out after %v in state %v%v",
+				opType, taskName, c.timeout, lastStatus.Status, failureCauses(lastStatus))
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *cloudSnapshotPlugin) logCloudBackupProgress(taskName string, opType api.CloudBackupOpType, status api.CloudBackupStatus) {
+	percent := uint64(0)
+	if status.BytesTotal > 0 {
+		percent = status.BytesDone * 100 / status.BytesTotal
+	}
+	c.log.Infof("Cloud snapshot %v %v for volume %v is %v on node %v: %v/%v bytes (%v%%), ETA %v",
+		opType, taskName, status.SrcVolumeID, status.Status, status.NodeID,
+		status.BytesDone, status.BytesTotal, percent, time.Duration(status.EtaSeconds)*time.Second)
+}
+
+// stopCloudBackup requests the cloud backup or restore task to be stopped
+func (c *cloudSnapshotPlugin) stopCloudBackup(volDriver volume.VolumeDriver, taskName string, opType api.CloudBackupOpType) {
+	c.log.Warnf("Stopping cloud snapshot %v %v", opType, taskName)
+	err := volDriver.CloudBackupStateChange(&api.CloudBackupStateChangeRequest{
+		Name:           taskName,
+		RequestedState: api.CloudBackupRequestedStateStop,
+	})
+	if err != nil {
+		c.log.Errorf("Failed to stop cloud snapshot %v %v: %v", opType, taskName, err)
+	}
+}
+
+// failureCauses returns the failure causes reported in the status, formatted
+// to be appended to an error message
+func failureCauses(status api.CloudBackupStatus) string {
+	if len(status.Info) == 0 {
+		return ""
+	}
+	return ": " + strings.Join(status.Info, "; ")
+}
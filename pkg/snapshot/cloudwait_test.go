@@ -0,0 +1,105 @@
+package snapshot
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+// fastCloudsnapPolls polls cloud backups every millisecond for the duration
+// of the test
+func fastCloudsnapPolls(t *testing.T) {
+	interval := cloudsnapPollInterval
+	cloudsnapPollInterval = time.Millisecond
+	t.Cleanup(func() { cloudsnapPollInterval = interval })
+}
+
+func TestParseCloudsnapTimeout(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "6h", want: 6 * time.Hour},
+		{value: "0s", want: 0},
+		{value: "-1h", wantErr: true},
+		{value: "soon", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			timeout, err := parseCloudsnapTimeout(map[string]string{configCloudsnapTimeout: test.value})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parse of %q returned error %v, want error %v", test.value, err, test.wantErr)
+			}
+			if timeout != test.want {
+				t.Errorf("timeout is %v, want %v", timeout, test.want)
+			}
+		})
+	}
+}
+
+func TestWaitForCloudBackup(t *testing.T) {
+	fastCloudsnapPolls(t)
+
+	tests := []struct {
+		name       string
+		status     api.CloudBackupStatusType
+		statusErr  error
+		timeout    time.Duration
+		wantErr    string
+		wantStatus api.CloudBackupStatusType
+	}{
+		{
+			name:       "done",
+			status:     api.CloudBackupStatusDone,
+			wantStatus: api.CloudBackupStatusDone,
+		},
+		{
+			name:       "failed",
+			status:     api.CloudBackupStatusFailed,
+			wantErr:    "in state Failed",
+			wantStatus: api.CloudBackupStatusFailed,
+		},
+		{
+			name:       "timed out",
+			status:     api.CloudBackupStatusActive,
+			timeout:    20 * time.Millisecond,
+			wantErr:    "timed out",
+			wantStatus: api.CloudBackupStatusStopped,
+		},
+		{
+			name:       "status unavailable",
+			status:     api.CloudBackupStatusActive,
+			statusErr:  errors.New("connection refused"),
+			wantErr:    "10 times",
+			wantStatus: api.CloudBackupStatusActive,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			volDriver := newFakeVolumeDriver(testVolume("vol-1", "pvc-1", nil))
+			volDriver.backupStatus = test.status
+			if _, err := volDriver.CloudBackupCreate(&api.CloudBackupCreateRequest{VolumeID: "vol-1", Name: "task-1"}); err != nil {
+				t.Fatalf("failed to create cloud backup: %v", err)
+			}
+			volDriver.errors["CloudBackupStatus"] = test.statusErr
+			c := &cloudSnapshotPlugin{log: testLogger(), timeout: test.timeout}
+
+			err := c.waitForCloudBackup(volDriver, "task-1", api.CloudBackupOp)
+			if test.wantErr == "" && err != nil {
+				t.Errorf("wait failed: %v", err)
+			} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("wait returned error %v, want one with %q", err, test.wantErr)
+			}
+			if status := volDriver.backups["task-1"].status; status != test.wantStatus {
+				t.Errorf("cloud backup is %v, want %v", status, test.wantStatus)
+			}
+		})
+	}
+}
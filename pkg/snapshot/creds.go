@@ -0,0 +1,73 @@
+package snapshot
+
+import (
+	"fmt"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
+)
+
+const (
+	// configCredName is the name of the cloud credential to use, as an
+	// alternative to its UUID which differs between clusters
+	configCredName = "credName"
+)
+
+// initCredential resolves the configured cloud credential and checks that
+// it can be used to access the objectstore
+func (c *cloudSnapshotPlugin) initCredential(config map[string]string) error {
+	credName := config[configCredName]
+	if config[configCredSecret] != "" {
+		var err error
+		if credName, err = c.initCredSecret(config); err != nil {
+			return err
+		}
+	}
+
+	if c.credID != "" && credName != "" {
+		return fmt.Errorf("only one of %v and %v can be specified", configCred, configCredName)
+	}
+	if c.credID == "" && credName == "" {
+		// Portworx uses the default credential if there is only one
+		return nil
+	}
+
+	volDriver, err := c.pxClient.getVolumeDriver()
+	if err != nil {
+		return err
+	}
+
+	if credName != "" {
+		credID, err := resolveCredentialName(volDriver, credName)
+		if err != nil {
+			return err
+		}
+		c.log.Infof("Resolved cloud credential %v to %v", credName, credID)
+		c.credID = credID
+	}
+
+	if err := volDriver.CredsValidate(c.credID); err != nil {
+		return fmt.Errorf("failed to validate cloud credential %v: %v", c.credID, err)
+	}
+	return nil
+}
+
+// resolveCredentialName returns the UUID of the cloud credential with the
+// given name
+func resolveCredentialName(volDriver volume.VolumeDriver, name string) (string, error) {
+	creds, err := volDriver.CredsEnumerate()
+	if err != nil {
+		return "", fmt.Errorf("failed to enumerate cloud credentials: %v", err)
+	}
+
+	for credID, cred := range creds {
+		params, ok := cred.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if credName, ok := params[api.OptCredName].(string); ok && credName == name {
+			return credID, nil
+		}
+	}
+	return "", fmt.Errorf("cloud credential %v not found", name)
+}
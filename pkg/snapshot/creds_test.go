@@ -0,0 +1,76 @@
+package snapshot
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+func TestInitCredential(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      map[string]string
+		validateErr error
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:   "default credential",
+			config: map[string]string{},
+		},
+		{
+			name:   "credential UUID",
+			config: map[string]string{configCred: "cred-2"},
+			want:   "cred-2",
+		},
+		{
+			name:   "credential name",
+			config: map[string]string{configCredName: "s3-prod"},
+			want:   "cred-2",
+		},
+		{
+			name:    "unknown credential name",
+			config:  map[string]string{configCredName: "s3-test"},
+			wantErr: true,
+		},
+		{
+			name:    "credential UUID and name",
+			config:  map[string]string{configCred: "cred-1", configCredName: "s3-prod"},
+			wantErr: true,
+		},
+		{
+			name:        "invalid credential",
+			config:      map[string]string{configCredName: "s3-prod"},
+			validateErr: errors.New("access denied"),
+			wantErr:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			volDriver := newFakeVolumeDriver()
+			volDriver.creds["cred-1"] = map[string]string{api.OptCredName: "s3-dev"}
+			volDriver.creds["cred-2"] = map[string]string{api.OptCredName: "s3-prod"}
+			volDriver.errors["CredsValidate"] = test.validateErr
+			c := &cloudSnapshotPlugin{log: testLogger(), pxClient: testClient(volDriver, nil), credID: test.config[configCred]}
+
+			err := c.initCredential(test.config)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("init with %v succeeded, want an error", test.config)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("init with %v failed: %v", test.config, err)
+			}
+			if c.credID != test.want {
+				t.Errorf("credential is %q, want %q", c.credID, test.want)
+			}
+			if test.want == "" && volDriver.callCount("CredsValidate") > 0 {
+				t.Errorf("the default credential was validated")
+			}
+		})
+	}
+}
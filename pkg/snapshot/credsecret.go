@@ -0,0 +1,238 @@
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/libopenstorage/openstorage/api"
+	k8s_secrets "github.com/libopenstorage/secrets/k8s"
+	"github.com/portworx/sched-ops/k8s/core"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// configCredSecret is the name of a Kubernetes Secret holding the
+	// parameters of the cloud credential to use. The keys of the Secret are
+	// Portworx credential parameters like CredType, CredAccessKey and
+	// CredSecretKey.
+	configCredSecret = "credSecret"
+	// configCredSecretNamespace is the namespace of the credential Secret,
+	// defaults to the namespace Velero is running in
+	configCredSecretNamespace = "credSecretNamespace"
+
+	// credTrackerConfigMap is the name of the ConfigMap, in the Velero
+	// namespace, with the hash of the parameters last applied to each
+	// Portworx credential, so that restarted plugins only update the
+	// credential when the Secret changed
+	credTrackerConfigMap = "px-velero-plugin-creds"
+)
+
+var (
+	// credSecretWatches holds the Secrets, by namespace/name, being watched
+	credSecretWatches = make(map[string]bool)
+	credSecretLock    sync.Mutex
+)
+
+// credSecretSyncer keeps a Portworx cloud credential in sync with the
+// contents of a Kubernetes Secret
+type credSecretSyncer struct {
+	pxClient   *portworxClient
+	kubeOps    core.Ops
+	log        logrus.FieldLogger
+	credName   string
+	secretName string
+	namespace  string
+}
+
+// initCredSecret creates or updates the Portworx credential from the
+// configured Secret and returns the name of the credential
+func (c *cloudSnapshotPlugin) initCredSecret(config map[string]string) (string, error) {
+	secretName := config[configCredSecret]
+	if c.credID != "" {
+		return "", fmt.Errorf("only one of %v and %v can be specified", configCred, configCredSecret)
+	}
+
+	namespace := config[configCredSecretNamespace]
+	if namespace == "" {
+		namespace = veleroNamespace()
+	}
+
+	// Name the credential after the secret unless a name is given
+	credName := config[configCredName]
+	if credName == "" {
+		credName = secretName
+	}
+
+	syncer := &credSecretSyncer{
+		pxClient:   c.pxClient,
+		kubeOps:    c.pxClient.kubeOps,
+		log:        c.log,
+		credName:   credName,
+		secretName: secretName,
+		namespace:  namespace,
+	}
+
+	data, err := c.pxClient.secrets.GetSecret(secretName, map[string]string{
+		k8s_secrets.SecretNamespace: namespace,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get cloud credential secret %v/%v: %v", namespace, secretName, err)
+	}
+	params := make(map[string]string)
+	for k, v := range data {
+		params[k] = fmt.Sprintf("%v", v)
+	}
+	if err := syncer.sync(params); err != nil {
+		return "", err
+	}
+
+	syncer.watch()
+	return credName, nil
+}
+
+// sync creates the credential with the parameters of the Secret if it doesn't
+// exist, or updates it if the parameters changed since they were last
+// applied, as recorded in the credential tracker
+func (s *credSecretSyncer) sync(params map[string]string) error {
+	if len(params) == 0 {
+		return fmt.Errorf("cloud credential secret %v/%v is empty", s.namespace, s.secretName)
+	}
+	params[api.OptCredName] = s.credName
+	hash := hashCredParams(params)
+
+	credSecretLock.Lock()
+	defer credSecretLock.Unlock()
+
+	volDriver, err := s.pxClient.getVolumeDriver()
+	if err != nil {
+		return err
+	}
+
+	_, err = resolveCredentialName(volDriver, s.credName)
+	if err != nil {
+		credID, err := volDriver.CredsCreate(params)
+		if err != nil {
+			return fmt.Errorf("failed to create cloud credential %v from secret %v/%v: %v",
+				s.credName, s.namespace, s.secretName, err)
+		}
+		s.log.Infof("Created cloud credential %v (%v) from secret %v/%v", s.credName, credID, s.namespace, s.secretName)
+	} else if s.appliedHash() != hash {
+		if err := volDriver.CredsUpdate(s.credName, params); err != nil {
+			return fmt.Errorf("failed to update cloud credential %v from secret %v/%v: %v",
+				s.credName, s.namespace, s.secretName, err)
+		}
+		s.log.Infof("Updated cloud credential %v from secret %v/%v", s.credName, s.namespace, s.secretName)
+	} else {
+		return nil
+	}
+
+	s.recordHash(hash)
+	return nil
+}
+
+// trackerKey returns the key of the credential in the credential tracker.
+// Credentials of different Portworx clusters may have the same name.
+func (s *credSecretSyncer) trackerKey() string {
+	sum := sha256.Sum256([]byte(s.pxClient.pxEndpoint))
+	return s.credName + "." + hex.EncodeToString(sum[:8])
+}
+
+// appliedHash returns the hash of the parameters last applied to the
+// credential, or an empty string if it isn't known
+func (s *credSecretSyncer) appliedHash() string {
+	cm, err := core.Instance().GetConfigMap(credTrackerConfigMap, veleroNamespace())
+	if err != nil {
+		if !k8s_errors.IsNotFound(err) {
+			s.log.Warnf("Failed to get cloud credential tracker, updating credential %v: %v", s.credName, err)
+		}
+		return ""
+	}
+	return cm.Data[s.trackerKey()]
+}
+
+// recordHash records the hash of the applied parameters in the credential
+// tracker. Failures are only logged since the credential is then updated
+// again on the next sync.
+func (s *credSecretSyncer) recordHash(hash string) {
+	namespace := veleroNamespace()
+	cm, err := core.Instance().GetConfigMap(credTrackerConfigMap, namespace)
+	if k8s_errors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      credTrackerConfigMap,
+				Namespace: namespace,
+			},
+			Data: map[string]string{s.trackerKey(): hash},
+		}
+		_, err = core.Instance().CreateConfigMap(cm)
+	} else if err == nil {
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[s.trackerKey()] = hash
+		_, err = core.Instance().UpdateConfigMap(cm)
+	}
+	if err != nil {
+		s.log.Warnf("Failed to record the parameters applied to cloud credential %v: %v", s.credName, err)
+	}
+}
+
+// watch starts watching the Secret for changes, once per process
+func (s *credSecretSyncer) watch() {
+	key := s.namespace + "/" + s.secretName
+	credSecretLock.Lock()
+	defer credSecretLock.Unlock()
+	if credSecretWatches[key] {
+		return
+	}
+
+	secret := &v1.Secret{}
+	secret.Name = s.secretName
+	secret.Namespace = s.namespace
+	if err := s.kubeOps.WatchSecret(secret, s.handleSecretUpdate); err != nil {
+		s.log.Warnf("Failed to watch cloud credential secret %v, changes will be applied on the next Init: %v", key, err)
+		return
+	}
+	credSecretWatches[key] = true
+}
+
+func (s *credSecretSyncer) handleSecretUpdate(object runtime.Object) error {
+	secret, ok := object.(*v1.Secret)
+	if !ok || secret.DeletionTimestamp != nil {
+		return nil
+	}
+	params := make(map[string]string)
+	for k, v := range secret.Data {
+		params[k] = string(v)
+	}
+	if err := s.sync(params); err != nil {
+		s.log.Errorf("Failed to sync cloud credential %v: %v", s.credName, err)
+		return err
+	}
+	return nil
+}
+
+// hashCredParams returns a hash of the credential parameters, used to
+// detect changes without keeping the keys themselves around
+func hashCredParams(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k + "=" + params[k] + "\n")
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
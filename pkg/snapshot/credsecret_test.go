@@ -0,0 +1,78 @@
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func credSecret(accessKey string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "s3-creds", Namespace: "velero"},
+		Data: map[string][]byte{
+			api.OptCredType:      []byte("s3"),
+			api.OptCredAccessKey: []byte(accessKey),
+		},
+	}
+}
+
+func TestInitCredSecret(t *testing.T) {
+	setEnv(t, veleroNamespaceEnv, "velero")
+	kubeOps := newFakeKubeOps()
+	kubeOps.secrets["velero/s3-creds"] = credSecret("key-1")
+	useKubeOps(t, kubeOps)
+	t.Cleanup(func() {
+		credSecretLock.Lock()
+		delete(credSecretWatches, "velero/s3-creds")
+		credSecretLock.Unlock()
+	})
+
+	volDriver := newFakeVolumeDriver()
+	// newPlugin returns a plugin with the credential Secret configured, as
+	// after a restart
+	newPlugin := func() *cloudSnapshotPlugin {
+		pxClient := testClient(volDriver, kubeOps)
+		pxClient.secrets = newKubeSecrets(kubeOps)
+		pxClient.pxEndpoint = "http://portworx-service.kube-system:9001"
+		c := &cloudSnapshotPlugin{log: testLogger(), pxClient: pxClient}
+		if err := c.initCredential(map[string]string{configCredSecret: "s3-creds"}); err != nil {
+			t.Fatalf("init failed: %v", err)
+		}
+		return c
+	}
+
+	c := newPlugin()
+	cred, ok := volDriver.creds[c.credID]
+	if !ok {
+		t.Fatalf("credential %v not created", c.credID)
+	}
+	if cred[api.OptCredName] != "s3-creds" || cred[api.OptCredAccessKey] != "key-1" {
+		t.Errorf("credential is %v, want s3-creds with key-1", cred)
+	}
+	if kubeOps.callCount("UpdateSecret") > 0 {
+		t.Errorf("credential secret was updated by the plugin")
+	}
+
+	// The credential isn't updated again when the Secret didn't change
+	newPlugin()
+	if updates := volDriver.callCount("CredsUpdate"); updates != 0 {
+		t.Errorf("credential was updated %v times, want 0", updates)
+	}
+
+	// Changes to the Secret are applied
+	if err := kubeOps.updateSecret(credSecret("key-2")); err != nil {
+		t.Fatalf("failed to sync the updated secret: %v", err)
+	}
+	if volDriver.creds[c.credID][api.OptCredAccessKey] != "key-2" {
+		t.Errorf("credential is %v, want key-2", volDriver.creds[c.credID])
+	}
+	newPlugin()
+	if updates := volDriver.callCount("CredsUpdate"); updates != 1 {
+		t.Errorf("credential was updated %v times, want 1", updates)
+	}
+	if creates := volDriver.callCount("CredsCreate"); creates != 1 {
+		t.Errorf("credential was created %v times, want 1", creates)
+	}
+}
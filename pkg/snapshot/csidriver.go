@@ -0,0 +1,70 @@
+package snapshot
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/libopenstorage/openstorage/volume"
+)
+
+const (
+	// configCSIDrivers is the comma separated list of the names of the CSI
+	// drivers backed by Portworx, in addition to pxd.portworx.com which is
+	// always included. The first one is used for PVs converted to CSI.
+	configCSIDrivers = "csiDrivers"
+
+	// csiDriverLabel is set on snapshots, cloud backups and restored
+	// volumes with the name of the CSI driver that provisioned the PV
+	csiDriverLabel = "portworx.io/csi-driver"
+)
+
+// parseCSIDrivers parses the Portworx CSI driver names from the plugin config.
+// The default driver is added after the configured ones so that existing PVs
+// provisioned by it are still handled.
+func parseCSIDrivers(config map[string]string) ([]string, error) {
+	value := config[configCSIDrivers]
+	if value == "" {
+		return []string{pxdDriverName}, nil
+	}
+
+	var drivers []string
+	for _, driver := range strings.Split(value, ",") {
+		driver = strings.TrimSpace(driver)
+		if driver == "" {
+			return nil, fmt.Errorf("invalid %v %q, must be a comma separated list of CSI driver names",
+				configCSIDrivers, value)
+		}
+		drivers = append(drivers, driver)
+	}
+	if !isPortworxCSIDriver(drivers, pxdDriverName) {
+		drivers = append(drivers, pxdDriverName)
+	}
+	return drivers, nil
+}
+
+// isPortworxCSIDriver returns true if the CSI driver is one of the given
+// Portworx CSI drivers, or the default driver if none are given
+func isPortworxCSIDriver(drivers []string, driver string) bool {
+	if len(drivers) == 0 {
+		return driver == pxdDriverName
+	}
+	for _, d := range drivers {
+		if d == driver {
+			return true
+		}
+	}
+	return false
+}
+
+// recordedCSIDriver returns the CSI driver recorded on the volume when it was
+// backed up, or an empty string if none was
+func recordedCSIDriver(volDriver volume.VolumeDriver, volumeID string) (string, error) {
+	vols, err := volDriver.Inspect([]string{volumeID})
+	if err != nil {
+		return "", err
+	}
+	if len(vols) == 0 {
+		return "", fmt.Errorf("Volume %v not found", volumeID)
+	}
+	return vols[0].GetLocator().GetVolumeLabels()[csiDriverLabel], nil
+}
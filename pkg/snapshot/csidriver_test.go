@@ -0,0 +1,63 @@
+package snapshot
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCSIDrivers(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "default", value: "", want: []string{pxdDriverName}},
+		{name: "default driver only", value: pxdDriverName, want: []string{pxdDriverName}},
+		{
+			name:  "default driver is added",
+			value: "pxd.example.com",
+			want:  []string{"pxd.example.com", pxdDriverName},
+		},
+		{
+			name:  "configured order is kept",
+			value: " pxd.example.com, " + pxdDriverName + ",pxd2.example.com",
+			want:  []string{"pxd.example.com", pxdDriverName, "pxd2.example.com"},
+		},
+		{name: "empty name", value: "pxd.example.com,,", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			drivers, err := parseCSIDrivers(map[string]string{configCSIDrivers: test.value})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parse of %q returned error %v, want error %v", test.value, err, test.wantErr)
+			}
+			if !reflect.DeepEqual(drivers, test.want) {
+				t.Errorf("drivers are %v, want %v", drivers, test.want)
+			}
+		})
+	}
+}
+
+func TestIsPortworxCSIDriver(t *testing.T) {
+	tests := []struct {
+		name    string
+		drivers []string
+		driver  string
+		want    bool
+	}{
+		{name: "default without config", driver: pxdDriverName, want: true},
+		{name: "other without config", driver: "ebs.csi.aws.com", want: false},
+		{name: "configured", drivers: []string{"pxd.example.com", pxdDriverName}, driver: "pxd.example.com", want: true},
+		{name: "not configured", drivers: []string{"pxd.example.com"}, driver: "ebs.csi.aws.com", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isPortworxCSIDriver(test.drivers, test.driver); got != test.want {
+				t.Errorf("isPortworxCSIDriver(%v, %v) is %v, want %v", test.drivers, test.driver, got, test.want)
+			}
+		})
+	}
+}
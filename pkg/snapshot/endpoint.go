@@ -0,0 +1,311 @@
+package snapshot
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/portworx/sched-ops/k8s/core"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// Config parameters of the Portworx endpoints, listed in endpointKeys.
+	// They are read from the config of the VolumeSnapshotLocation. Only when
+	// the config has none of them, the parameters read from the environment
+	// by earlier versions of the plugin, listed in legacyEnvKeys, are read
+	// from the environment variables of the same name instead.
+	//
+	// pxMgmtEndpointKey and pxSdkEndpointKey are the management REST API and
+	// SDK endpoints. Endpoints that aren't set are discovered from the
+	// Portworx service.
+	pxMgmtEndpointKey = "PX_MGMT_ENDPOINT"
+	pxSdkEndpointKey  = "PX_SDK_ENDPOINT"
+	// pxEndpointKey is the host of both endpoints, with the ports set by
+	// pxAPIPortKey and pxSDKPortKey
+	pxEndpointKey = "PX_ENDPOINT"
+	// pxServiceNameKey is the name of the Portworx service in the Portworx
+	// namespace
+	pxServiceNameKey = "PX_SERVICE_NAME"
+	// pxAPIPortKey and pxSDKPortKey override the ports of the Portworx
+	// service
+	pxAPIPortKey = "PX_API_PORT"
+	pxSDKPortKey = "PX_SDK_PORT"
+
+	// Config parameters of the TLS connection to Portworx. Secrets are read
+	// from the Portworx namespace.
+	pxEnableTLSKey = "PX_ENABLE_TLS"
+	// pxCACertSecretKey is the Secret with the CA bundle of Portworx, in
+	// the pxCACertSecretKeyKey key
+	pxCACertSecretKey    = "PX_CA_CERT_SECRET"
+	pxCACertSecretKeyKey = "PX_CA_CERT_SECRET_KEY"
+	// pxClientCertSecretKey is the TLS Secret with the client certificate
+	// used for mutual TLS
+	pxClientCertSecretKey = "PX_CLIENT_CERT_SECRET"
+
+	defaultCACertSecretKey = "ca.crt"
+
+	// Names of the ports of the Portworx service
+	pxRestPortName        = "px-api"
+	pxRestPortNameSecured = "px-api-tls"
+	pxSdkPortName         = "px-sdk"
+)
+
+// endpointKeys are the config parameters of the connection to Portworx
+var endpointKeys = []string{
+	pxMgmtEndpointKey,
+	pxSdkEndpointKey,
+	pxEndpointKey,
+	pxServiceNameKey,
+	pxAPIPortKey,
+	pxSDKPortKey,
+	pxEnableTLSKey,
+	pxCACertSecretKey,
+	pxCACertSecretKeyKey,
+	pxClientCertSecretKey,
+}
+
+// legacyEnvKeys are the config parameters that can also be set with
+// environment variables, which apply to every plugin instance.
+// PX_MGMT_ENDPOINT, PX_SDK_ENDPOINT and PX_CLIENT_CERT_SECRET are config only.
+var legacyEnvKeys = map[string]bool{
+	pxEndpointKey:        true,
+	pxServiceNameKey:     true,
+	pxAPIPortKey:         true,
+	pxSDKPortKey:         true,
+	pxEnableTLSKey:       true,
+	pxCACertSecretKey:    true,
+	pxCACertSecretKeyKey: true,
+}
+
+// endpointConfig is the configuration of the connection to Portworx
+type endpointConfig struct {
+	namespace    string
+	serviceName  string
+	mgmtEndpoint string
+	sdkEndpoint  string
+	host         string
+	restPort     int
+	sdkPort      int
+
+	tls              bool
+	caCertSecret     string
+	caCertSecretKey  string
+	clientCertSecret string
+}
+
+// parseEndpointConfig parses the connection configuration from the plugin
+// config, or from the environment if the config has no endpoint parameters
+func parseEndpointConfig(config map[string]string, namespace string, log logrus.FieldLogger) (*endpointConfig, error) {
+	values := endpointValues(config, log)
+	e := &endpointConfig{
+		namespace:        namespace,
+		serviceName:      values[pxServiceNameKey],
+		mgmtEndpoint:     values[pxMgmtEndpointKey],
+		sdkEndpoint:      values[pxSdkEndpointKey],
+		host:             values[pxEndpointKey],
+		caCertSecret:     values[pxCACertSecretKey],
+		caCertSecretKey:  values[pxCACertSecretKeyKey],
+		clientCertSecret: values[pxClientCertSecretKey],
+	}
+	if e.serviceName == "" {
+		e.serviceName = serviceName
+	}
+	if e.caCertSecretKey == "" {
+		e.caCertSecretKey = defaultCACertSecretKey
+	}
+
+	var err error
+	if e.restPort, err = parsePort(values, pxAPIPortKey); err != nil {
+		return nil, err
+	}
+	if e.sdkPort, err = parsePort(values, pxSDKPortKey); err != nil {
+		return nil, err
+	}
+	if e.host != "" && (e.restPort == 0 || e.sdkPort == 0) {
+		return nil, fmt.Errorf("%v and %v must be set with %v", pxAPIPortKey, pxSDKPortKey, pxEndpointKey)
+	}
+
+	if value := values[pxEnableTLSKey]; value != "" {
+		if e.tls, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid %v %q, must be true or false", pxEnableTLSKey, value)
+		}
+	}
+	return e, nil
+}
+
+// endpointValues returns the endpoint parameters set in the config. If none
+// is set, the legacyEnvKeys set in the environment are returned instead, so
+// the config and the environment are never mixed.
+func endpointValues(config map[string]string, log logrus.FieldLogger) map[string]string {
+	values := make(map[string]string)
+	for _, key := range endpointKeys {
+		if value := strings.TrimSpace(config[key]); value != "" {
+			values[key] = value
+		}
+	}
+	if len(values) > 0 {
+		return values
+	}
+
+	var envKeys []string
+	for _, key := range endpointKeys {
+		if !legacyEnvKeys[key] {
+			continue
+		}
+		if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+			values[key] = value
+			envKeys = append(envKeys, key)
+		}
+	}
+	if len(envKeys) > 0 {
+		log.Warnf("Volume snapshot location has no Portworx endpoint config, using the environment variables %v",
+			strings.Join(envKeys, ", "))
+	}
+	return values
+}
+
+func parsePort(values map[string]string, key string) (int, error) {
+	value := values[key]
+	if value == "" {
+		return 0, nil
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid %v %q, must be a port number", key, value)
+	}
+	return port, nil
+}
+
+// endpoints returns the management REST API and SDK endpoints of Portworx
+func (e *endpointConfig) endpoints(kubeOps core.Ops) (string, string, error) {
+	mgmtEndpoint, sdkEndpoint := e.mgmtEndpoint, e.sdkEndpoint
+	if e.host != "" {
+		if mgmtEndpoint == "" {
+			mgmtEndpoint = net.JoinHostPort(e.host, strconv.Itoa(e.restPort))
+		}
+		if sdkEndpoint == "" {
+			sdkEndpoint = net.JoinHostPort(e.host, strconv.Itoa(e.sdkPort))
+		}
+	}
+
+	if mgmtEndpoint == "" || sdkEndpoint == "" {
+		serviceMgmtEndpoint, serviceSdkEndpoint, err := e.serviceEndpoints(kubeOps)
+		if err != nil {
+			return "", "", err
+		}
+		if mgmtEndpoint == "" {
+			mgmtEndpoint = serviceMgmtEndpoint
+		}
+		if sdkEndpoint == "" {
+			sdkEndpoint = serviceSdkEndpoint
+		}
+	}
+
+	if !strings.Contains(mgmtEndpoint, "://") {
+		scheme := "http"
+		if e.tls {
+			scheme = "https"
+		}
+		mgmtEndpoint = scheme + "://" + mgmtEndpoint
+	}
+	return mgmtEndpoint, sdkEndpoint, nil
+}
+
+// serviceEndpoints returns the endpoints of the Portworx service. The secured
+// REST port is used when TLS is enabled and the service has it, since the
+// legacy REST port is never secured.
+func (e *endpointConfig) serviceEndpoints(kubeOps core.Ops) (string, string, error) {
+	svc, err := kubeOps.GetService(e.serviceName, e.namespace)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get Portworx service %v/%v: %v", e.namespace, e.serviceName, err)
+	}
+
+	restPort, sdkPort := e.restPort, e.sdkPort
+	scheme := "http"
+	if e.tls && restPort != 0 {
+		scheme = "https"
+	}
+	var legacyRestPort int
+	for _, port := range svc.Spec.Ports {
+		switch {
+		case port.Name == pxSdkPortName && sdkPort == 0:
+			sdkPort = int(port.Port)
+		case port.Name == pxRestPortNameSecured && restPort == 0 && e.tls:
+			restPort = int(port.Port)
+			scheme = "https"
+		case port.Name == pxRestPortName:
+			legacyRestPort = int(port.Port)
+		}
+	}
+	if restPort == 0 {
+		restPort = legacyRestPort
+	}
+	if restPort == 0 || sdkPort == 0 {
+		return "", "", fmt.Errorf("Portworx service %v/%v does not have the %v and %v or %v ports",
+			e.namespace, e.serviceName, pxSdkPortName, pxRestPortName, pxRestPortNameSecured)
+	}
+
+	host := svc.Name + "." + svc.Namespace
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(restPort)),
+		net.JoinHostPort(host, strconv.Itoa(sdkPort)), nil
+}
+
+// tlsConfig returns the TLS configuration of the connections to Portworx, or
+// nil if TLS is disabled. The CA bundle is added to the system CAs and the
+// client certificate is presented for mutual TLS.
+func (e *endpointConfig) tlsConfig(kubeOps core.Ops) (*tls.Config, error) {
+	if !e.tls {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if e.caCertSecret != "" {
+		secret, err := kubeOps.GetSecret(e.caCertSecret, e.namespace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get CA cert secret %v/%v: %v", e.namespace, e.caCertSecret, err)
+		}
+		caCert := secret.Data[e.caCertSecretKey]
+		if len(caCert) == 0 {
+			return nil, fmt.Errorf("CA cert secret %v/%v has no %v key", e.namespace, e.caCertSecret, e.caCertSecretKey)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("CA cert secret %v/%v has no valid certificates", e.namespace, e.caCertSecret)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if e.clientCertSecret != "" {
+		secret, err := kubeOps.GetSecret(e.clientCertSecret, e.namespace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get client cert secret %v/%v: %v", e.namespace, e.clientCertSecret, err)
+		}
+		cert, err := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+		if err != nil {
+			return nil, fmt.Errorf("invalid client cert secret %v/%v: %v", e.namespace, e.clientCertSecret, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// dialOptions returns the options to connect to the Portworx SDK with the
+// TLS configuration
+func dialOptions(tlsConfig *tls.Config) []grpc.DialOption {
+	if tlsConfig == nil {
+		return []grpc.DialOption{grpc.WithInsecure()}
+	}
+	return []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))}
+}
@@ -0,0 +1,148 @@
+package snapshot
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// setEnv sets the environment variable for the duration of the test
+func setEnv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatalf("failed to set %v: %v", key, err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestParseEndpointConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]string
+		env     map[string]string
+		want    *endpointConfig
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			config: map[string]string{},
+			want: &endpointConfig{
+				namespace:       "portworx",
+				serviceName:     serviceName,
+				caCertSecretKey: defaultCACertSecretKey,
+			},
+		},
+		{
+			name: "config",
+			config: map[string]string{
+				pxServiceNameKey:      "px-api",
+				pxMgmtEndpointKey:     "https://px.example.com:9001",
+				pxSdkEndpointKey:      " px.example.com:9020 ",
+				pxEnableTLSKey:        "true",
+				pxCACertSecretKey:     "px-ca",
+				pxCACertSecretKeyKey:  "bundle.pem",
+				pxClientCertSecretKey: "px-client",
+			},
+			want: &endpointConfig{
+				namespace:        "portworx",
+				serviceName:      "px-api",
+				mgmtEndpoint:     "https://px.example.com:9001",
+				sdkEndpoint:      "px.example.com:9020",
+				tls:              true,
+				caCertSecret:     "px-ca",
+				caCertSecretKey:  "bundle.pem",
+				clientCertSecret: "px-client",
+			},
+		},
+		{
+			name:   "host and ports",
+			config: map[string]string{pxEndpointKey: "10.0.0.1", pxAPIPortKey: "9001", pxSDKPortKey: "9020"},
+			want: &endpointConfig{
+				namespace:       "portworx",
+				serviceName:     serviceName,
+				host:            "10.0.0.1",
+				restPort:        9001,
+				sdkPort:         9020,
+				caCertSecretKey: defaultCACertSecretKey,
+			},
+		},
+		{
+			name:   "legacy environment",
+			config: map[string]string{configGroupMode: groupModePod},
+			env:    map[string]string{pxEndpointKey: "10.0.0.1", pxAPIPortKey: "9001", pxSDKPortKey: "9020", pxEnableTLSKey: "true"},
+			want: &endpointConfig{
+				namespace:       "portworx",
+				serviceName:     serviceName,
+				host:            "10.0.0.1",
+				restPort:        9001,
+				sdkPort:         9020,
+				tls:             true,
+				caCertSecretKey: defaultCACertSecretKey,
+			},
+		},
+		{
+			name:   "config ignores the environment",
+			config: map[string]string{pxServiceNameKey: "px-api"},
+			env:    map[string]string{pxEndpointKey: "10.0.0.1", pxAPIPortKey: "9001", pxSDKPortKey: "9020", pxEnableTLSKey: "true"},
+			want: &endpointConfig{
+				namespace:       "portworx",
+				serviceName:     "px-api",
+				caCertSecretKey: defaultCACertSecretKey,
+			},
+		},
+		{
+			name:    "config is not mixed with the environment",
+			config:  map[string]string{pxEndpointKey: "10.0.0.1"},
+			env:     map[string]string{pxAPIPortKey: "9001", pxSDKPortKey: "9020"},
+			wantErr: true,
+		},
+		{
+			name:   "config only keys ignore the environment",
+			config: map[string]string{},
+			env: map[string]string{
+				pxMgmtEndpointKey:     "http://10.0.0.1:9001",
+				pxSdkEndpointKey:      "10.0.0.1:9020",
+				pxClientCertSecretKey: "px-client",
+			},
+			want: &endpointConfig{
+				namespace:       "portworx",
+				serviceName:     serviceName,
+				caCertSecretKey: defaultCACertSecretKey,
+			},
+		},
+		{name: "host without ports", config: map[string]string{pxEndpointKey: "10.0.0.1"}, wantErr: true},
+		{name: "invalid port", config: map[string]string{pxAPIPortKey: "70000"}, wantErr: true},
+		{name: "invalid TLS", config: map[string]string{pxEnableTLSKey: "yes please"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key := range legacyEnvKeys {
+				setEnv(t, key, "")
+			}
+			for key, value := range test.env {
+				setEnv(t, key, value)
+			}
+
+			e, err := parseEndpointConfig(test.config, "portworx", testLogger())
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parse of %v succeeded, want an error", test.config)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse of %v failed: %v", test.config, err)
+			}
+			if !reflect.DeepEqual(e, test.want) {
+				t.Errorf("endpoint config is %+v, want %+v", e, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,524 @@
+package snapshot
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
+	"github.com/portworx/sched-ops/k8s/core"
+	"golang.org/x/net/context"
+)
+
+// fakeVolumeDriver keeps volumes, snapshots and cloud backups in memory.
+// Calls the plugin doesn't make go to the nil embedded driver and panic.
+type fakeVolumeDriver struct {
+	volume.VolumeDriver
+
+	lock    sync.Mutex
+	volumes map[string]*api.Volume
+	nextID  int
+	// errors are returned by the calls with the given name
+	errors map[string]error
+	// calls counts the calls by name
+	calls map[string]int
+	// backups are the cloud backups by task ID
+	backups map[string]*fakeCloudBackup
+	// backupStatus is the status cloud backups are created with
+	backupStatus api.CloudBackupStatusType
+	// creds are the parameters of the cloud credentials by UUID
+	creds map[string]map[string]string
+	// quiesced are the quiesce IDs of the quiesced volumes
+	quiesced map[string]string
+	// quiescedSnapshots counts the snapshots taken of quiesced volumes
+	quiescedSnapshots int
+	// trimStates are returned by the filesystem trim status calls in turn,
+	// the last one repeating
+	trimStates []api.FilesystemTrim_FilesystemTrimStatus
+	// fsckHealth is the health reported by filesystem checks
+	fsckHealth api.FilesystemHealthStatus
+	// ownershipUpdates are the ownerships set on volumes, in order
+	ownershipUpdates []*api.Ownership
+}
+
+type fakeCloudBackup struct {
+	volumeID string
+	backupID string
+	// groupID is the ID of the group cloud backup the task is part of
+	groupID string
+	status  api.CloudBackupStatusType
+	labels  map[string]string
+	full    bool
+}
+
+func newFakeVolumeDriver(vols ...*api.Volume) *fakeVolumeDriver {
+	d := &fakeVolumeDriver{
+		volumes:      make(map[string]*api.Volume),
+		errors:       make(map[string]error),
+		calls:        make(map[string]int),
+		backups:      make(map[string]*fakeCloudBackup),
+		backupStatus: api.CloudBackupStatusDone,
+		creds:        make(map[string]map[string]string),
+		quiesced:     make(map[string]string),
+	}
+	for _, v := range vols {
+		d.volumes[v.Id] = cloneVolume(v)
+	}
+	return d
+}
+
+// testVolume returns a volume with the given name and labels
+func testVolume(id, name string, labels map[string]string) *api.Volume {
+	return &api.Volume{
+		Id:      id,
+		Locator: &api.VolumeLocator{Name: name, VolumeLabels: labels},
+		Spec:    &api.VolumeSpec{HaLevel: 1},
+		Source:  &api.Source{},
+	}
+}
+
+// testClient returns a client making calls with the volume driver through
+// REST, with the SDK considered unavailable
+func testClient(volDriver volume.VolumeDriver, kubeOps core.Ops) *portworxClient {
+	return &portworxClient{
+		restDriver: volDriver,
+		sdkConn:    &portworxGrpcConnection{sdkCheckedAt: time.Now()},
+		tenants:    &tenantConfig{},
+		kubeOps:    kubeOps,
+	}
+}
+
+func cloneVolume(v *api.Volume) *api.Volume {
+	return &api.Volume{
+		Id:       v.Id,
+		Readonly: v.Readonly,
+		Source:   &api.Source{Parent: v.GetSource().GetParent()},
+		Spec:     v.Spec,
+		Locator: &api.VolumeLocator{
+			Name:         v.GetLocator().GetName(),
+			VolumeLabels: copyLabels(v.GetLocator().GetVolumeLabels()),
+		},
+	}
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
+
+func hasLabels(labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// call counts the call and returns the error configured for it
+func (d *fakeVolumeDriver) call(name string) error {
+	d.calls[name]++
+	return d.errors[name]
+}
+
+// callCount returns the number of calls with the given name
+func (d *fakeVolumeDriver) callCount(name string) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.calls[name]
+}
+
+// volume returns a copy of the volume, or nil if it doesn't exist
+func (d *fakeVolumeDriver) volume(volumeID string) *api.Volume {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if v, ok := d.volumes[volumeID]; ok {
+		return cloneVolume(v)
+	}
+	return nil
+}
+
+// snapshotsOf returns the IDs of the snapshots of the volume
+func (d *fakeVolumeDriver) snapshotsOf(volumeID string) []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var ids []string
+	for id, v := range d.volumes {
+		if v.GetSource().GetParent() == volumeID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (d *fakeVolumeDriver) Inspect(volumeIDs []string) ([]*api.Volume, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("Inspect"); err != nil {
+		return nil, err
+	}
+	var vols []*api.Volume
+	for _, id := range volumeIDs {
+		if v, ok := d.volumes[id]; ok {
+			vols = append(vols, cloneVolume(v))
+		}
+	}
+	return vols, nil
+}
+
+func (d *fakeVolumeDriver) Enumerate(locator *api.VolumeLocator, labels map[string]string) ([]*api.Volume, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("Enumerate"); err != nil {
+		return nil, err
+	}
+	var ids []string
+	for id, v := range d.volumes {
+		if hasLabels(v.Locator.VolumeLabels, locator.GetVolumeLabels()) && hasLabels(v.Locator.VolumeLabels, labels) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	var vols []*api.Volume
+	for _, id := range ids {
+		vols = append(vols, cloneVolume(d.volumes[id]))
+	}
+	return vols, nil
+}
+
+func (d *fakeVolumeDriver) Snapshot(volumeID string, readonly bool, locator *api.VolumeLocator, noRetry bool) (string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("Snapshot"); err != nil {
+		return "", err
+	}
+	return d.snapshot(volumeID, readonly, locator)
+}
+
+func (d *fakeVolumeDriver) snapshot(volumeID string, readonly bool, locator *api.VolumeLocator) (string, error) {
+	parent, ok := d.volumes[volumeID]
+	if !ok {
+		return "", fmt.Errorf("volume %v not found", volumeID)
+	}
+	if _, ok := d.quiesced[volumeID]; ok {
+		d.quiescedSnapshots++
+	}
+	d.nextID++
+	id := fmt.Sprintf("snap-%d", d.nextID)
+	d.volumes[id] = &api.Volume{
+		Id:       id,
+		Readonly: readonly,
+		Source:   &api.Source{Parent: volumeID},
+		Spec:     parent.Spec,
+		Locator: &api.VolumeLocator{
+			Name:         locator.GetName(),
+			VolumeLabels: copyLabels(locator.GetVolumeLabels()),
+		},
+	}
+	return id, nil
+}
+
+func (d *fakeVolumeDriver) SnapshotGroup(groupID string, labels map[string]string, volumeIDs []string, deleteOnFailure bool) (*api.GroupSnapCreateResponse, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("SnapshotGroup"); err != nil {
+		return nil, err
+	}
+	response := &api.GroupSnapCreateResponse{Snapshots: make(map[string]*api.SnapCreateResponse)}
+	for _, volumeID := range volumeIDs {
+		id, err := d.snapshot(volumeID, true, &api.VolumeLocator{VolumeLabels: labels})
+		if err != nil {
+			return nil, err
+		}
+		response.Snapshots[volumeID] = &api.SnapCreateResponse{
+			VolumeCreateResponse: &api.VolumeCreateResponse{Id: id},
+		}
+	}
+	return response, nil
+}
+
+// Set merges the labels into the labels of the volume and replaces its spec
+func (d *fakeVolumeDriver) Set(volumeID string, locator *api.VolumeLocator, spec *api.VolumeSpec) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("Set"); err != nil {
+		return err
+	}
+	v, ok := d.volumes[volumeID]
+	if !ok {
+		return fmt.Errorf("volume %v not found", volumeID)
+	}
+	for k, value := range locator.GetVolumeLabels() {
+		v.Locator.VolumeLabels[k] = value
+	}
+	if ownership := locator.GetOwnership(); ownership != nil {
+		d.ownershipUpdates = append(d.ownershipUpdates, ownership)
+	}
+	if spec != nil {
+		v.Spec = spec
+	}
+	return nil
+}
+
+func (d *fakeVolumeDriver) Quiesce(volumeID string, timeoutSeconds uint64, quiesceID string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("Quiesce"); err != nil {
+		return err
+	}
+	if _, ok := d.volumes[volumeID]; !ok {
+		return fmt.Errorf("volume %v not found", volumeID)
+	}
+	d.quiesced[volumeID] = quiesceID
+	return nil
+}
+
+func (d *fakeVolumeDriver) Unquiesce(volumeID string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("Unquiesce"); err != nil {
+		return err
+	}
+	delete(d.quiesced, volumeID)
+	return nil
+}
+
+func (d *fakeVolumeDriver) FilesystemTrimStart(request *api.SdkFilesystemTrimStartRequest) (*api.SdkFilesystemTrimStartResponse, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("FilesystemTrimStart"); err != nil {
+		return nil, err
+	}
+	return &api.SdkFilesystemTrimStartResponse{}, nil
+}
+
+func (d *fakeVolumeDriver) FilesystemTrimStatus(request *api.SdkFilesystemTrimStatusRequest) (*api.SdkFilesystemTrimStatusResponse, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("FilesystemTrimStatus"); err != nil {
+		return nil, err
+	}
+	status := api.FilesystemTrim_FS_TRIM_COMPLETED
+	if len(d.trimStates) > 0 {
+		status = d.trimStates[0]
+	}
+	if len(d.trimStates) > 1 {
+		d.trimStates = d.trimStates[1:]
+	}
+	return &api.SdkFilesystemTrimStatusResponse{Status: status}, nil
+}
+
+func (d *fakeVolumeDriver) FilesystemTrimStop(request *api.SdkFilesystemTrimStopRequest) (*api.SdkFilesystemTrimStopResponse, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("FilesystemTrimStop"); err != nil {
+		return nil, err
+	}
+	return &api.SdkFilesystemTrimStopResponse{}, nil
+}
+
+func (d *fakeVolumeDriver) FilesystemCheckStart(request *api.SdkFilesystemCheckStartRequest) (*api.SdkFilesystemCheckStartResponse, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("FilesystemCheckStart"); err != nil {
+		return nil, err
+	}
+	return &api.SdkFilesystemCheckStartResponse{}, nil
+}
+
+func (d *fakeVolumeDriver) FilesystemCheckStatus(request *api.SdkFilesystemCheckStatusRequest) (*api.SdkFilesystemCheckStatusResponse, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("FilesystemCheckStatus"); err != nil {
+		return nil, err
+	}
+	return &api.SdkFilesystemCheckStatusResponse{
+		Status:       api.FilesystemCheck_FS_CHECK_COMPLETED,
+		HealthStatus: d.fsckHealth,
+	}, nil
+}
+
+func (d *fakeVolumeDriver) Delete(ctx context.Context, volumeID string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("Delete"); err != nil {
+		return err
+	}
+	if _, ok := d.volumes[volumeID]; !ok {
+		return fmt.Errorf("volume %v not found", volumeID)
+	}
+	delete(d.volumes, volumeID)
+	return nil
+}
+
+func (d *fakeVolumeDriver) CloudBackupCreate(input *api.CloudBackupCreateRequest) (*api.CloudBackupCreateResponse, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("CloudBackupCreate"); err != nil {
+		return nil, err
+	}
+	if _, ok := d.backups[input.Name]; ok {
+		return nil, fmt.Errorf("cloud backup task %v already exists", input.Name)
+	}
+	d.backups[input.Name] = &fakeCloudBackup{
+		volumeID: input.VolumeID,
+		backupID: fmt.Sprintf("bucket/%v-backup-%d", input.VolumeID, len(d.backups)+1),
+		status:   d.backupStatus,
+		labels:   copyLabels(input.Labels),
+		full:     input.Full,
+	}
+	return &api.CloudBackupCreateResponse{Name: input.Name}, nil
+}
+
+func (d *fakeVolumeDriver) CloudBackupGroupCreate(input *api.CloudBackupGroupCreateRequest) (*api.CloudBackupGroupCreateResponse, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("CloudBackupGroupCreate"); err != nil {
+		return nil, err
+	}
+	response := &api.CloudBackupGroupCreateResponse{GroupCloudBackupID: fmt.Sprintf("group-%d", len(d.backups)+1)}
+	for _, volumeID := range input.VolumeIDs {
+		name := fmt.Sprintf("%v-%v", response.GroupCloudBackupID, volumeID)
+		d.backups[name] = &fakeCloudBackup{
+			volumeID: volumeID,
+			backupID: fmt.Sprintf("bucket/%v-backup-%d", volumeID, len(d.backups)+1),
+			groupID:  response.GroupCloudBackupID,
+			status:   d.backupStatus,
+			labels:   copyLabels(input.Labels),
+			full:     input.Full,
+		}
+		response.Names = append(response.Names, name)
+	}
+	return response, nil
+}
+
+func (d *fakeVolumeDriver) CloudBackupStatus(input *api.CloudBackupStatusRequest) (*api.CloudBackupStatusResponse, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("CloudBackupStatus"); err != nil {
+		return nil, err
+	}
+	response := &api.CloudBackupStatusResponse{Statuses: make(map[string]api.CloudBackupStatus)}
+	for name, backup := range d.backups {
+		if (input.ID != "" && name != input.ID && backup.groupID != input.ID) || (input.SrcVolumeID != "" && backup.volumeID != input.SrcVolumeID) {
+			continue
+		}
+		response.Statuses[name] = api.CloudBackupStatus{
+			ID:          backup.backupID,
+			OpType:      api.CloudBackupOp,
+			Status:      backup.status,
+			SrcVolumeID: backup.volumeID,
+		}
+	}
+	return response, nil
+}
+
+func (d *fakeVolumeDriver) CloudBackupStateChange(input *api.CloudBackupStateChangeRequest) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("CloudBackupStateChange"); err != nil {
+		return err
+	}
+	backup, ok := d.backups[input.Name]
+	if !ok {
+		return fmt.Errorf("cloud backup task %v not found", input.Name)
+	}
+	if input.RequestedState == api.CloudBackupRequestedStateStop {
+		backup.status = api.CloudBackupStatusStopped
+	}
+	return nil
+}
+
+func (d *fakeVolumeDriver) CloudBackupEnumerate(input *api.CloudBackupEnumerateRequest) (*api.CloudBackupEnumerateResponse, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("CloudBackupEnumerate"); err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range d.backups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	response := &api.CloudBackupEnumerateResponse{}
+	for _, name := range names {
+		backup := d.backups[name]
+		if input.SrcVolumeID != "" && backup.volumeID != input.SrcVolumeID {
+			continue
+		}
+		if input.StatusFilter != "" && backup.status != input.StatusFilter {
+			continue
+		}
+		if !hasLabels(backup.labels, input.MetadataFilter) {
+			continue
+		}
+		response.Backups = append(response.Backups, api.CloudBackupInfo{
+			ID:          backup.backupID,
+			SrcVolumeID: backup.volumeID,
+			Status:      string(backup.status),
+			Metadata:    copyLabels(backup.labels),
+		})
+	}
+	return response, nil
+}
+
+func (d *fakeVolumeDriver) CredsCreate(params map[string]string) (string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("CredsCreate"); err != nil {
+		return "", err
+	}
+	credID := fmt.Sprintf("cred-%d", len(d.creds)+1)
+	d.creds[credID] = copyLabels(params)
+	return credID, nil
+}
+
+func (d *fakeVolumeDriver) CredsUpdate(name string, params map[string]string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("CredsUpdate"); err != nil {
+		return err
+	}
+	for credID, cred := range d.creds {
+		if credID == name || cred[api.OptCredName] == name {
+			d.creds[credID] = copyLabels(params)
+			return nil
+		}
+	}
+	return fmt.Errorf("cloud credential %v not found", name)
+}
+
+func (d *fakeVolumeDriver) CredsEnumerate() (map[string]interface{}, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("CredsEnumerate"); err != nil {
+		return nil, err
+	}
+	creds := make(map[string]interface{})
+	for credID, cred := range d.creds {
+		params := make(map[string]interface{})
+		for k, v := range cred {
+			params[k] = v
+		}
+		creds[credID] = params
+	}
+	return creds, nil
+}
+
+func (d *fakeVolumeDriver) CredsValidate(credUUID string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.call("CredsValidate"); err != nil {
+		return err
+	}
+	if _, ok := d.creds[credUUID]; !ok {
+		return fmt.Errorf("cloud credential %v not found", credUUID)
+	}
+	return nil
+}
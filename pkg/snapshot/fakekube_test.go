@@ -0,0 +1,206 @@
+package snapshot
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/portworx/sched-ops/k8s/core"
+	"k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+// fakeKubeOps keeps Kubernetes objects in memory. Calls the plugin doesn't
+// make go to the nil embedded client and panic.
+type fakeKubeOps struct {
+	core.Ops
+
+	lock       sync.Mutex
+	pvs        map[string]*v1.PersistentVolume
+	pvcs       map[string]*v1.PersistentVolumeClaim
+	pods       []v1.Pod
+	secrets    map[string]*v1.Secret
+	configMaps map[string]*v1.ConfigMap
+	// watches are the functions called on changes to Secrets
+	watches map[string]core.WatchFunc
+	// versionErr is returned by version calls, which check that the
+	// cluster can be reached
+	versionErr error
+	// calls counts the calls by name
+	calls map[string]int
+}
+
+func newFakeKubeOps() *fakeKubeOps {
+	return &fakeKubeOps{
+		pvs:        make(map[string]*v1.PersistentVolume),
+		pvcs:       make(map[string]*v1.PersistentVolumeClaim),
+		secrets:    make(map[string]*v1.Secret),
+		configMaps: make(map[string]*v1.ConfigMap),
+		watches:    make(map[string]core.WatchFunc),
+		calls:      make(map[string]int),
+	}
+}
+
+// useKubeOps makes the fake the client of the cluster Velero runs in for the
+// duration of the test
+func useKubeOps(t *testing.T, kubeOps core.Ops) {
+	old := core.Instance()
+	core.SetInstance(kubeOps)
+	t.Cleanup(func() { core.SetInstance(old) })
+}
+
+func notFound(resource, name string) error {
+	return k8s_errors.NewNotFound(schema.GroupResource{Resource: resource}, name)
+}
+
+// callCount returns the number of calls with the given name
+func (k *fakeKubeOps) callCount(name string) int {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.calls[name]
+}
+
+func (k *fakeKubeOps) GetVersion() (*version.Info, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.calls["GetVersion"]++
+	if k.versionErr != nil {
+		return nil, k.versionErr
+	}
+	return &version.Info{Major: "1", Minor: "21"}, nil
+}
+
+func (k *fakeKubeOps) GetPersistentVolume(pvName string) (*v1.PersistentVolume, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.calls["GetPersistentVolume"]++
+	pv, ok := k.pvs[pvName]
+	if !ok {
+		return nil, notFound("persistentvolumes", pvName)
+	}
+	return pv.DeepCopy(), nil
+}
+
+func (k *fakeKubeOps) GetPersistentVolumeClaim(pvcName, namespace string) (*v1.PersistentVolumeClaim, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.calls["GetPersistentVolumeClaim"]++
+	pvc, ok := k.pvcs[namespace+"/"+pvcName]
+	if !ok {
+		return nil, notFound("persistentvolumeclaims", pvcName)
+	}
+	return pvc.DeepCopy(), nil
+}
+
+func (k *fakeKubeOps) GetPersistentVolumeClaims(namespace string, labelSelector map[string]string) (*v1.PersistentVolumeClaimList, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.calls["GetPersistentVolumeClaims"]++
+	list := &v1.PersistentVolumeClaimList{}
+	for _, pvc := range k.pvcs {
+		if namespace != "" && pvc.Namespace != namespace {
+			continue
+		}
+		if labels.SelectorFromSet(labelSelector).Matches(labels.Set(pvc.Labels)) {
+			list.Items = append(list.Items, *pvc.DeepCopy())
+		}
+	}
+	return list, nil
+}
+
+func (k *fakeKubeOps) GetPodsUsingPVC(pvcName, pvcNamespace string) ([]v1.Pod, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.calls["GetPodsUsingPVC"]++
+	var pods []v1.Pod
+	for _, pod := range k.pods {
+		if pod.Namespace != pvcNamespace {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pvcName {
+				pods = append(pods, *pod.DeepCopy())
+				break
+			}
+		}
+	}
+	return pods, nil
+}
+
+func (k *fakeKubeOps) GetSecret(name, namespace string) (*v1.Secret, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.calls["GetSecret"]++
+	secret, ok := k.secrets[namespace+"/"+name]
+	if !ok {
+		return nil, notFound("secrets", name)
+	}
+	return secret.DeepCopy(), nil
+}
+
+func (k *fakeKubeOps) UpdateSecret(secret *v1.Secret) (*v1.Secret, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.calls["UpdateSecret"]++
+	k.secrets[secret.Namespace+"/"+secret.Name] = secret.DeepCopy()
+	return secret, nil
+}
+
+func (k *fakeKubeOps) WatchSecret(secret *v1.Secret, fn core.WatchFunc) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.calls["WatchSecret"]++
+	k.watches[secret.Namespace+"/"+secret.Name] = fn
+	return nil
+}
+
+// updateSecret replaces the Secret and calls the function watching it, if
+// any
+func (k *fakeKubeOps) updateSecret(secret *v1.Secret) error {
+	k.lock.Lock()
+	key := secret.Namespace + "/" + secret.Name
+	k.secrets[key] = secret.DeepCopy()
+	fn := k.watches[key]
+	k.lock.Unlock()
+	if fn == nil {
+		return nil
+	}
+	return fn(secret.DeepCopy())
+}
+
+func (k *fakeKubeOps) GetConfigMap(name, namespace string) (*v1.ConfigMap, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.calls["GetConfigMap"]++
+	cm, ok := k.configMaps[namespace+"/"+name]
+	if !ok {
+		return nil, notFound("configmaps", name)
+	}
+	return cm.DeepCopy(), nil
+}
+
+func (k *fakeKubeOps) CreateConfigMap(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.calls["CreateConfigMap"]++
+	key := cm.Namespace + "/" + cm.Name
+	if _, ok := k.configMaps[key]; ok {
+		return nil, k8s_errors.NewAlreadyExists(schema.GroupResource{Resource: "configmaps"}, cm.Name)
+	}
+	k.configMaps[key] = cm.DeepCopy()
+	return cm, nil
+}
+
+func (k *fakeKubeOps) UpdateConfigMap(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.calls["UpdateConfigMap"]++
+	key := cm.Namespace + "/" + cm.Name
+	if _, ok := k.configMaps[key]; !ok {
+		return nil, notFound("configmaps", cm.Name)
+	}
+	k.configMaps[key] = cm.DeepCopy()
+	return cm, nil
+}
@@ -0,0 +1,84 @@
+package snapshot
+
+import (
+	"net"
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeIdentityServer answers SDK version calls, which check that the SDK is
+// available
+type fakeIdentityServer struct {
+	api.UnimplementedOpenStorageIdentityServer
+}
+
+func (s *fakeIdentityServer) Version(ctx context.Context, req *api.SdkIdentityVersionRequest) (*api.SdkIdentityVersionResponse, error) {
+	return &api.SdkIdentityVersionResponse{}, nil
+}
+
+// fakeNodeServer answers SDK node inspections with the nodes it holds
+type fakeNodeServer struct {
+	api.UnimplementedOpenStorageNodeServer
+	nodes map[string]*api.StorageNode
+}
+
+func (s *fakeNodeServer) Inspect(ctx context.Context, req *api.SdkNodeInspectRequest) (*api.SdkNodeInspectResponse, error) {
+	node, ok := s.nodes[req.GetNodeId()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "node %v not found", req.GetNodeId())
+	}
+	return &api.SdkNodeInspectResponse{Node: node}, nil
+}
+
+// fakeClusterServer answers SDK cluster inspections with the cluster it
+// holds, or an error if it holds none
+type fakeClusterServer struct {
+	api.UnimplementedOpenStorageClusterServer
+	cluster *api.StorageCluster
+}
+
+func (s *fakeClusterServer) InspectCurrent(ctx context.Context, req *api.SdkClusterInspectCurrentRequest) (*api.SdkClusterInspectCurrentResponse, error) {
+	if s.cluster == nil {
+		return nil, status.Errorf(codes.Unavailable, "cluster is not available")
+	}
+	return &api.SdkClusterInspectCurrentResponse{Cluster: s.cluster}, nil
+}
+
+// startFakeSDK serves the SDK with the given cluster and nodes on a local
+// port for the duration of the test and returns its endpoint
+func startFakeSDK(t *testing.T, cluster *api.StorageCluster, nodes map[string]*api.StorageNode) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := grpc.NewServer()
+	api.RegisterOpenStorageIdentityServer(server, &fakeIdentityServer{})
+	api.RegisterOpenStorageClusterServer(server, &fakeClusterServer{cluster: cluster})
+	api.RegisterOpenStorageNodeServer(server, &fakeNodeServer{nodes: nodes})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+// sdkTestClient returns a client connecting to the SDK at the endpoint,
+// closing its connection at the end of the test
+func sdkTestClient(t *testing.T, endpoint string) *portworxClient {
+	pxClient := &portworxClient{
+		sdkConn: &portworxGrpcConnection{
+			endpoint:    endpoint,
+			dialOptions: []grpc.DialOption{grpc.WithInsecure()},
+		},
+		tenants: &tenantConfig{},
+	}
+	t.Cleanup(func() {
+		if pxClient.sdkConn.conn != nil {
+			pxClient.sdkConn.conn.Close()
+		}
+	})
+	return pxClient
+}
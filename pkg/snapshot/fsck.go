@@ -0,0 +1,209 @@
+package snapshot
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+const (
+	// configFsckPolicy enables checking the filesystem of restored volumes
+	// and sets what happens when the check doesn't find it healthy
+	configFsckPolicy = "restoreFsckPolicy"
+	// configFsckTimeout is the maximum time to wait for the check, as a
+	// duration string
+	configFsckTimeout = "restoreFsckTimeout"
+	// configFsckKeepFailed keeps the restored volume for inspection when the
+	// restore fails with the fail policy, instead of deleting it
+	configFsckKeepFailed = "restoreFsckKeepFailed"
+
+	// fsckPolicyIgnore logs the result of the check
+	fsckPolicyIgnore = "ignore"
+	// fsckPolicyWarn logs the result of the check and labels the volume if
+	// it isn't healthy
+	fsckPolicyWarn = "warn"
+	// fsckPolicyFail fails the restore if the volume isn't healthy. The
+	// volume is deleted, unless configFsckKeepFailed is set, in which case
+	// it is labelled for inspection and must be deleted once it isn't
+	// needed anymore.
+	fsckPolicyFail = "fail"
+
+	// fsckHealthLabel is set on restored volumes whose filesystem isn't
+	// healthy, with the health status reported by the check
+	fsckHealthLabel = "portworx.io/fsck-health"
+
+	fsckModeCheckHealth = "check_health"
+	defaultFsckTimeout  = 10 * time.Minute
+)
+
+// fsckPollInterval is the interval at which the status of filesystem checks
+// is checked
+var fsckPollInterval = 5 * time.Second
+
+// fsckConfig describes if and how restored volumes are checked
+type fsckConfig struct {
+	policy     string
+	timeout    time.Duration
+	keepFailed bool
+}
+
+// parseFsckConfig parses the filesystem check config from the plugin config
+func parseFsckConfig(config map[string]string) (*fsckConfig, error) {
+	f := &fsckConfig{
+		policy:  config[configFsckPolicy],
+		timeout: defaultFsckTimeout,
+	}
+	switch f.policy {
+	case "", fsckPolicyIgnore, fsckPolicyWarn, fsckPolicyFail:
+	default:
+		return nil, fmt.Errorf("invalid %v %q, must be one of %v, %v or %v",
+			configFsckPolicy, f.policy, fsckPolicyIgnore, fsckPolicyWarn, fsckPolicyFail)
+	}
+
+	if value := config[configFsckTimeout]; value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid %v %q, must be a positive duration like 10m", configFsckTimeout, value)
+		}
+		f.timeout = timeout
+	}
+
+	if value := config[configFsckKeepFailed]; value != "" {
+		keep, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q, must be true or false", configFsckKeepFailed, value)
+		}
+		f.keepFailed = keep
+	}
+	return f, nil
+}
+
+// checkRestoredVolume checks the filesystem of a restored volume and applies
+// the configured policy to the result. An error is only returned with the
+// fail policy, after deleting the volume unless it is kept for inspection.
+func (f *fsckConfig) checkRestoredVolume(pxClient *portworxClient, volumeID string, log logrus.FieldLogger) error {
+	if f == nil || f.policy == "" {
+		return nil
+	}
+
+	volDriver, err := pxClient.getVolumeDriverForVolume(volumeID, log)
+	if err != nil {
+		err = fmt.Errorf("failed to check filesystem of restored volume %v: %v", volumeID, err)
+		if f.policy != fsckPolicyFail {
+			log.Warnf("%v", err)
+			return nil
+		}
+		log.Errorf("%v", err)
+		if !f.keepFailed {
+			// The tenant owning the volume is unknown, delete it as the
+			// plugin
+			if volDriver, derr := pxClient.getVolumeDriver(); derr != nil {
+				log.Warnf("Failed to delete restored volume %v: %v", volumeID, derr)
+			} else {
+				deleteFailedVolume(volDriver, volumeID, log)
+			}
+		}
+		return err
+	}
+
+	health, err := runFilesystemCheck(volDriver, volumeID, f.timeout, log)
+	if err != nil {
+		err = fmt.Errorf("failed to check filesystem of restored volume %v: %v", volumeID, err)
+	} else if health != api.FilesystemHealthStatus_FS_HEALTH_STATUS_HEALTHY {
+		err = fmt.Errorf("filesystem of restored volume %v is not healthy: %v", volumeID, health)
+	} else {
+		log.Infof("Filesystem of restored volume %v is healthy", volumeID)
+		return nil
+	}
+
+	switch f.policy {
+	case fsckPolicyIgnore:
+		log.Infof("%v", err)
+		return nil
+	case fsckPolicyWarn:
+		log.Warnf("%v", err)
+	case fsckPolicyFail:
+		if !f.keepFailed {
+			log.Errorf("%v", err)
+			deleteFailedVolume(volDriver, volumeID, log)
+			return err
+		}
+		log.Errorf("%v, keeping the volume for inspection", err)
+	}
+
+	verr := volDriver.Set(volumeID, &api.VolumeLocator{
+		VolumeLabels: map[string]string{fsckHealthLabel: health.String()},
+	}, nil)
+	if verr != nil {
+		log.Warnf("Failed to label restored volume %v with its filesystem health: %v", volumeID, verr)
+	}
+
+	if f.policy == fsckPolicyFail {
+		return err
+	}
+	return nil
+}
+
+// deleteFailedVolume deletes a restored volume whose restore failed
+func deleteFailedVolume(volDriver volume.VolumeDriver, volumeID string, log logrus.FieldLogger) {
+	if err := volDriver.Delete(context.Background(), volumeID); err != nil {
+		log.Warnf("Failed to delete restored volume %v: %v", volumeID, err)
+		return
+	}
+	log.Infof("Deleted restored volume %v", volumeID)
+}
+
+// runFilesystemCheck runs a filesystem check in check mode on the volume and
+// returns the health it reports
+func runFilesystemCheck(
+	volDriver volume.VolumeDriver,
+	volumeID string,
+	timeout time.Duration,
+	log logrus.FieldLogger,
+) (api.FilesystemHealthStatus, error) {
+	unknown := api.FilesystemHealthStatus_FS_HEALTH_STATUS_UNKNOWN
+
+	_, err := volDriver.FilesystemCheckStart(&api.SdkFilesystemCheckStartRequest{
+		VolumeId: volumeID,
+		Mode:     fsckModeCheckHealth,
+	})
+	if err != nil {
+		return unknown, fmt.Errorf("failed to start: %v", err)
+	}
+	log.Infof("Started filesystem check of restored volume %v", volumeID)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(fsckPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-deadline.C:
+			if _, err := volDriver.FilesystemCheckStop(&api.SdkFilesystemCheckStopRequest{VolumeId: volumeID}); err != nil {
+				log.Warnf("Failed to stop filesystem check of volume %v: %v", volumeID, err)
+			}
+			return unknown, fmt.Errorf("did not finish in %v", timeout)
+		case <-ticker.C:
+		}
+
+		status, err := volDriver.FilesystemCheckStatus(&api.SdkFilesystemCheckStatusRequest{VolumeId: volumeID})
+		if err != nil {
+			log.Warnf("Failed to get filesystem check status of volume %v: %v", volumeID, err)
+			continue
+		}
+
+		switch status.GetStatus() {
+		case api.FilesystemCheck_FS_CHECK_STARTED, api.FilesystemCheck_FS_CHECK_INPROGRESS:
+			continue
+		case api.FilesystemCheck_FS_CHECK_COMPLETED:
+			return status.GetHealthStatus(), nil
+		default:
+			return unknown, fmt.Errorf("ended in state %v: %v", status.GetStatus(), status.GetMessage())
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package snapshot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+func TestParseFsckConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]string
+		want    fsckConfig
+		wantErr bool
+	}{
+		{name: "disabled", config: map[string]string{}, want: fsckConfig{timeout: defaultFsckTimeout}},
+		{
+			name:   "fail and keep",
+			config: map[string]string{configFsckPolicy: fsckPolicyFail, configFsckTimeout: "1h", configFsckKeepFailed: "true"},
+			want:   fsckConfig{policy: fsckPolicyFail, timeout: time.Hour, keepFailed: true},
+		},
+		{name: "invalid policy", config: map[string]string{configFsckPolicy: "repair"}, wantErr: true},
+		{name: "invalid timeout", config: map[string]string{configFsckTimeout: "-1m"}, wantErr: true},
+		{name: "invalid keep", config: map[string]string{configFsckKeepFailed: "forever"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := parseFsckConfig(test.config)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parse of %v returned error %v, want error %v", test.config, err, test.wantErr)
+			}
+			if err == nil && *f != test.want {
+				t.Errorf("fsck config is %+v, want %+v", *f, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckRestoredVolume(t *testing.T) {
+	unhealthy := api.FilesystemHealthStatus_FS_HEALTH_STATUS_NEEDS_INSPECTION
+	tests := []struct {
+		name       string
+		policy     string
+		keepFailed bool
+		health     api.FilesystemHealthStatus
+		wantErr    bool
+		wantLabel  bool
+		wantDelete bool
+	}{
+		{name: "disabled", health: unhealthy},
+		{name: "healthy", policy: fsckPolicyFail, health: api.FilesystemHealthStatus_FS_HEALTH_STATUS_HEALTHY},
+		{name: "ignore", policy: fsckPolicyIgnore, health: unhealthy},
+		{name: "warn", policy: fsckPolicyWarn, health: unhealthy, wantLabel: true},
+		{name: "fail", policy: fsckPolicyFail, health: unhealthy, wantErr: true, wantDelete: true},
+		{name: "fail and keep", policy: fsckPolicyFail, keepFailed: true, health: unhealthy, wantErr: true, wantLabel: true},
+	}
+
+	interval := fsckPollInterval
+	fsckPollInterval = time.Millisecond
+	t.Cleanup(func() { fsckPollInterval = interval })
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			volDriver := newFakeVolumeDriver(testVolume("vol-1", "pvc-1", map[string]string{}))
+			volDriver.fsckHealth = test.health
+			f := &fsckConfig{policy: test.policy, timeout: time.Minute, keepFailed: test.keepFailed}
+
+			err := f.checkRestoredVolume(testClient(volDriver, nil), "vol-1", testLogger())
+			if (err != nil) != test.wantErr {
+				t.Errorf("check returned error %v, want error %v", err, test.wantErr)
+			}
+			vol := volDriver.volume("vol-1")
+			if (vol == nil) != test.wantDelete {
+				t.Fatalf("restored volume deleted is %v, want %v", vol == nil, test.wantDelete)
+			}
+			if vol != nil {
+				_, labelled := vol.Locator.VolumeLabels[fsckHealthLabel]
+				if labelled != test.wantLabel {
+					t.Errorf("restored volume labelled is %v, want %v", labelled, test.wantLabel)
+				}
+			}
+		})
+	}
+}
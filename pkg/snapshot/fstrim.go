@@ -0,0 +1,131 @@
+package snapshot
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
+)
+
+const (
+	// configFstrim enables trimming the filesystem of attached volumes
+	// before they are backed up to the cloud
+	configFstrim = "fstrimBeforeBackup"
+	// configFstrimTimeout is the maximum time to wait for the trim, as a
+	// duration string. The backup goes ahead when it expires.
+	configFstrimTimeout = "fstrimTimeout"
+
+	defaultFstrimTimeout = 5 * time.Minute
+)
+
+// fstrimPollInterval is the interval at which the status of filesystem trims
+// is checked
+var fstrimPollInterval = 5 * time.Second
+
+// fstrimConfig describes if and how volumes are trimmed before backups
+type fstrimConfig struct {
+	enabled bool
+	timeout time.Duration
+}
+
+// parseFstrimConfig parses the filesystem trim config from the plugin config
+func parseFstrimConfig(config map[string]string) (*fstrimConfig, error) {
+	f := &fstrimConfig{timeout: defaultFstrimTimeout}
+
+	if value := config[configFstrim]; value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q, must be true or false", configFstrim, value)
+		}
+		f.enabled = enabled
+	}
+
+	if value := config[configFstrimTimeout]; value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid %v %q, must be a positive duration like 5m", configFstrimTimeout, value)
+		}
+		f.timeout = timeout
+	}
+	return f, nil
+}
+
+// trimVolume trims the filesystem of the volume if it is attached, and logs
+// the space reclaimed. Failures are logged and otherwise ignored since the
+// trim only makes the backup smaller.
+func (c *cloudSnapshotPlugin) trimVolume(volDriver volume.VolumeDriver, vol *api.Volume) {
+	if c.fstrim == nil || !c.fstrim.enabled {
+		return
+	}
+	if vol.State != api.VolumeState_VOLUME_STATE_ATTACHED || len(vol.AttachPath) == 0 {
+		c.log.Infof("Volume %v is not attached, skipping filesystem trim", vol.Id)
+		return
+	}
+
+	mountPath := vol.AttachPath[0]
+	_, err := volDriver.FilesystemTrimStart(&api.SdkFilesystemTrimStartRequest{
+		VolumeId:  vol.Id,
+		MountPath: mountPath,
+	})
+	if err != nil {
+		c.log.Warnf("Failed to start filesystem trim of volume %v: %v", vol.Id, err)
+		return
+	}
+	c.log.Infof("Started filesystem trim of volume %v", vol.Id)
+
+	deadline := time.NewTimer(c.fstrim.timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(fstrimPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-deadline.C:
+			c.log.Warnf("Filesystem trim of volume %v did not finish in %v, stopping it", vol.Id, c.fstrim.timeout)
+			_, err := volDriver.FilesystemTrimStop(&api.SdkFilesystemTrimStopRequest{
+				VolumeId:  vol.Id,
+				MountPath: mountPath,
+			})
+			if err != nil {
+				c.log.Warnf("Failed to stop filesystem trim of volume %v: %v", vol.Id, err)
+			}
+			return
+		case <-ticker.C:
+		}
+
+		status, err := volDriver.FilesystemTrimStatus(&api.SdkFilesystemTrimStatusRequest{
+			VolumeId:  vol.Id,
+			MountPath: mountPath,
+		})
+		if err != nil {
+			c.log.Warnf("Failed to get filesystem trim status of volume %v: %v", vol.Id, err)
+			continue
+		}
+
+		switch status.GetStatus() {
+		case api.FilesystemTrim_FS_TRIM_STARTED, api.FilesystemTrim_FS_TRIM_INPROGRESS:
+			continue
+		case api.FilesystemTrim_FS_TRIM_COMPLETED:
+			c.logTrimmedBytes(volDriver, vol)
+		default:
+			c.log.Warnf("Filesystem trim of volume %v ended in state %v: %v", vol.Id, status.GetStatus(), status.GetMessage())
+		}
+		return
+	}
+}
+
+func (c *cloudSnapshotPlugin) logTrimmedBytes(volDriver volume.VolumeDriver, vol *api.Volume) {
+	vols, err := volDriver.Inspect([]string{vol.Id})
+	if err != nil || len(vols) == 0 {
+		c.log.Infof("Finished filesystem trim of volume %v", vol.Id)
+		return
+	}
+
+	var reclaimed uint64
+	if vols[0].Usage < vol.Usage {
+		reclaimed = vol.Usage - vols[0].Usage
+	}
+	c.log.Infof("Finished filesystem trim of volume %v, reclaimed %v bytes (usage %v -> %v)",
+		vol.Id, reclaimed, vol.Usage, vols[0].Usage)
+}
@@ -0,0 +1,114 @@
+package snapshot
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+func TestParseFstrimConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      map[string]string
+		wantEnabled bool
+		wantTimeout time.Duration
+		wantErr     bool
+	}{
+		{name: "default", config: map[string]string{}, wantTimeout: defaultFstrimTimeout},
+		{
+			name:        "enabled",
+			config:      map[string]string{configFstrim: "true", configFstrimTimeout: "10m"},
+			wantEnabled: true,
+			wantTimeout: 10 * time.Minute,
+		},
+		{name: "invalid flag", config: map[string]string{configFstrim: "always"}, wantErr: true},
+		{name: "invalid timeout", config: map[string]string{configFstrimTimeout: "5"}, wantErr: true},
+		{name: "zero timeout", config: map[string]string{configFstrimTimeout: "0s"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := parseFstrimConfig(test.config)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parse of %v returned error %v, want error %v", test.config, err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if f.enabled != test.wantEnabled || f.timeout != test.wantTimeout {
+				t.Errorf("fstrim is enabled %v with timeout %v, want %v with %v",
+					f.enabled, f.timeout, test.wantEnabled, test.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestTrimVolume(t *testing.T) {
+	tests := []struct {
+		name       string
+		disabled   bool
+		detached   bool
+		startErr   error
+		trimStates []api.FilesystemTrim_FilesystemTrimStatus
+		wantStarts int
+		wantStops  int
+	}{
+		{name: "disabled", disabled: true},
+		{name: "detached volume", detached: true},
+		{name: "start failure", startErr: errors.New("volume is not mounted"), wantStarts: 1},
+		{
+			name: "completed",
+			trimStates: []api.FilesystemTrim_FilesystemTrimStatus{
+				api.FilesystemTrim_FS_TRIM_STARTED,
+				api.FilesystemTrim_FS_TRIM_INPROGRESS,
+				api.FilesystemTrim_FS_TRIM_COMPLETED,
+			},
+			wantStarts: 1,
+		},
+		{
+			name:       "failed",
+			trimStates: []api.FilesystemTrim_FilesystemTrimStatus{api.FilesystemTrim_FS_TRIM_FAILED},
+			wantStarts: 1,
+		},
+		{
+			name:       "timed out",
+			trimStates: []api.FilesystemTrim_FilesystemTrimStatus{api.FilesystemTrim_FS_TRIM_INPROGRESS},
+			wantStarts: 1,
+			wantStops:  1,
+		},
+	}
+
+	interval := fstrimPollInterval
+	fstrimPollInterval = time.Millisecond
+	t.Cleanup(func() { fstrimPollInterval = interval })
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vol := testVolume("vol-1", "pvc-1", nil)
+			if !test.detached {
+				vol.State = api.VolumeState_VOLUME_STATE_ATTACHED
+				vol.AttachPath = []string{"/var/lib/osd/mounts/vol-1"}
+			}
+			volDriver := newFakeVolumeDriver(vol)
+			volDriver.errors["FilesystemTrimStart"] = test.startErr
+			volDriver.trimStates = test.trimStates
+			c := &cloudSnapshotPlugin{
+				log:      testLogger(),
+				pxClient: testClient(volDriver, nil),
+				fstrim:   &fstrimConfig{enabled: !test.disabled, timeout: 50 * time.Millisecond},
+			}
+
+			c.trimVolume(volDriver, vol)
+			if starts := volDriver.callCount("FilesystemTrimStart"); starts != test.wantStarts {
+				t.Errorf("%v trims were started, want %v", starts, test.wantStarts)
+			}
+			if stops := volDriver.callCount("FilesystemTrimStop"); stops != test.wantStops {
+				t.Errorf("%v trims were stopped, want %v", stops, test.wantStops)
+			}
+			if test.startErr != nil && volDriver.callCount("FilesystemTrimStatus") > 0 {
+				t.Errorf("status of a trim that failed to start was checked")
+			}
+		})
+	}
+}
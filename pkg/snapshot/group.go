@@ -0,0 +1,347 @@
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/portworx/sched-ops/k8s/core"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// configGroupMode enables group snapshots, taking the snapshots of
+	// related volumes at the same point in time
+	configGroupMode = "groupMode"
+	// configGroupLabel is the PVC label whose value groups the volumes with
+	// the label group mode
+	configGroupLabel = "groupLabel"
+
+	// groupModeBackup groups all PVCs of the Velero backup
+	groupModeBackup = "backup"
+	// groupModeLabel groups the PVCs of a namespace sharing the value of the
+	// label set by configGroupLabel
+	groupModeLabel = "label"
+	// groupModeNamespace groups the PVCs of the Velero backup in the same
+	// namespace
+	groupModeNamespace = "namespace"
+	// groupModePod groups all PVCs used by a pod using the PVC being backed
+	// up
+	groupModePod = "pod"
+
+	// groupSnapshotLabel is set on the local snapshots of a group snapshot
+	// to the key of the group in the group tracker, so that the snapshots
+	// Velero never claimed are deleted with the last one it claimed
+	groupSnapshotLabel = "portworx.io/velero-group"
+
+	// groupTrackerConfigMap is the name of the ConfigMap, in the Velero
+	// namespace, used to track the group snapshots started for each backup
+	// so that snapshots of the other volumes in the group join it
+	groupTrackerConfigMap = "px-velero-plugin-groups"
+	// groupTrackerMaxAge is the age after which entries are removed from
+	// the group tracker
+	groupTrackerMaxAge = 7 * 24 * time.Hour
+)
+
+// groupLock serializes the creation of group snapshots in the process
+var groupLock sync.Mutex
+
+// groupConfig describes how volumes are grouped. Groups only have volumes
+// the Velero backup includes, since the snapshots of other volumes would
+// never be returned to Velero or deleted with the backup.
+type groupConfig struct {
+	mode       string
+	label      string
+	csiDrivers []string
+	// getBackup returns the Velero backup with the given name
+	getBackup func(name string) (*velerov1.Backup, error)
+}
+
+// volumeGroup is a set of volumes to be snapshotted together
+type volumeGroup struct {
+	// key identifies the group within a backup
+	key string
+	// namespace is the namespace of the PVCs in the group, empty if they
+	// may be in different namespaces
+	namespace string
+	// volumeIDs are the sorted Portworx volume IDs in the group
+	volumeIDs []string
+}
+
+// groupSnapshot is the group snapshot started for a volume group
+type groupSnapshot struct {
+	// GroupID is the ID of the group snapshot
+	GroupID string `json:"groupId,omitempty"`
+	// Snapshots maps volume IDs to the IDs of their snapshots, if known when
+	// the group snapshot was started
+	Snapshots map[string]string `json:"snapshots,omitempty"`
+	// Claimed are the IDs of the volumes whose snapshot in the group was
+	// returned to Velero
+	Claimed []string `json:"claimed,omitempty"`
+	// Created is the time the group snapshot was started
+	Created time.Time `json:"created"`
+}
+
+// parseGroupConfig parses the group snapshot config from the plugin config
+func parseGroupConfig(config map[string]string) (*groupConfig, error) {
+	g := &groupConfig{
+		mode:      config[configGroupMode],
+		label:     config[configGroupLabel],
+		getBackup: getVeleroBackup,
+	}
+	var err error
+	if g.csiDrivers, err = parseCSIDrivers(config); err != nil {
+		return nil, err
+	}
+	switch g.mode {
+	case "", groupModeBackup, groupModeNamespace, groupModePod:
+	case groupModeLabel:
+		if g.label == "" {
+			return nil, fmt.Errorf("%v is required with %v %v", configGroupLabel, configGroupMode, groupModeLabel)
+		}
+	default:
+		return nil, fmt.Errorf("invalid %v %q, must be %v, %v, %v or %v", configGroupMode, g.mode,
+			groupModeBackup, groupModeNamespace, groupModeLabel, groupModePod)
+	}
+	return g, nil
+}
+
+// enabled returns true if volumes should be snapshotted in groups
+func (g *groupConfig) enabled() bool {
+	return g != nil && g.mode != ""
+}
+
+// groupForPV returns the group of Portworx volumes the given PV should be
+// snapshotted with as part of the given backup, looking up pods and PVCs
+// with the given client. Nil is returned if the PV isn't part of a group of
+// more than one volume.
+func (g *groupConfig) groupForPV(kubeOps core.Ops, pvName, backupName string) (*volumeGroup, error) {
+	if !g.enabled() || pvName == "" || backupName == "" {
+		return nil, nil
+	}
+
+	pv, err := kubeOps.GetPersistentVolume(pvName)
+	if err != nil {
+		return nil, err
+	}
+	if pv.Spec.ClaimRef == nil {
+		return nil, nil
+	}
+	namespace := pv.Spec.ClaimRef.Namespace
+	claimName := pv.Spec.ClaimRef.Name
+
+	group := &volumeGroup{namespace: namespace}
+	var pvcs []v1.PersistentVolumeClaim
+	switch g.mode {
+	case groupModeBackup:
+		group.key = groupModeBackup
+		group.namespace = ""
+		if pvcs, err = listPVCs(kubeOps, "", nil); err != nil {
+			return nil, err
+		}
+	case groupModeNamespace:
+		group.key = namespace
+		if pvcs, err = listPVCs(kubeOps, namespace, nil); err != nil {
+			return nil, err
+		}
+	case groupModeLabel:
+		pvc, err := kubeOps.GetPersistentVolumeClaim(claimName, namespace)
+		if err != nil {
+			return nil, err
+		}
+		value, ok := pvc.Labels[g.label]
+		if !ok {
+			return nil, nil
+		}
+		group.key = namespace + "/" + g.label + "=" + value
+		if pvcs, err = listPVCs(kubeOps, namespace, map[string]string{g.label: value}); err != nil {
+			return nil, err
+		}
+	default:
+		pods, err := kubeOps.GetPodsUsingPVC(claimName, namespace)
+		if err != nil {
+			return nil, err
+		}
+		if len(pods) == 0 {
+			return nil, nil
+		}
+		// Use the same pod for every PVC it uses
+		sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+		pod := pods[0]
+		for _, podVolume := range pod.Spec.Volumes {
+			if podVolume.PersistentVolumeClaim == nil {
+				continue
+			}
+			pvc, err := kubeOps.GetPersistentVolumeClaim(podVolume.PersistentVolumeClaim.ClaimName, namespace)
+			if err != nil {
+				return nil, err
+			}
+			pvcs = append(pvcs, *pvc)
+		}
+		group.key = namespace + "/pod/" + pod.Name
+	}
+
+	backup, err := g.getBackup(backupName)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pvcs {
+		pvc := &pvcs[i]
+		if pvc.Spec.VolumeName == "" {
+			continue
+		}
+		memberPV, err := kubeOps.GetPersistentVolume(pvc.Spec.VolumeName)
+		if err != nil {
+			return nil, err
+		}
+		volumeID := portworxVolumeID(memberPV, g.csiDrivers)
+		if volumeID == "" {
+			continue
+		}
+		pods, err := kubeOps.GetPodsUsingPVC(pvc.Name, pvc.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		if backupIncludesPVC(backup, pvc, pods) {
+			group.volumeIDs = append(group.volumeIDs, volumeID)
+		}
+	}
+	if len(group.volumeIDs) < 2 {
+		return nil, nil
+	}
+	sort.Strings(group.volumeIDs)
+	return group, nil
+}
+
+// listPVCs returns the PVCs in the namespace, or in all namespaces if empty,
+// with the given labels
+func listPVCs(kubeOps core.Ops, namespace string, labels map[string]string) ([]v1.PersistentVolumeClaim, error) {
+	list, err := kubeOps.GetPersistentVolumeClaims(namespace, labels)
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// contains returns true if the volume is part of the group
+func (v *volumeGroup) contains(volumeID string) bool {
+	return containsString(v.volumeIDs, volumeID)
+}
+
+// without returns a copy of the group without the given volumes
+func (v *volumeGroup) without(volumeIDs []string) *volumeGroup {
+	remaining := &volumeGroup{key: v.key, namespace: v.namespace}
+	for _, id := range v.volumeIDs {
+		if !containsString(volumeIDs, id) {
+			remaining.volumeIDs = append(remaining.volumeIDs, id)
+		}
+	}
+	return remaining
+}
+
+// claim records that the snapshot of the volume in the group was returned to
+// Velero
+func (gs *groupSnapshot) claim(volumeID string) bool {
+	if containsString(gs.Claimed, volumeID) {
+		return false
+	}
+	gs.Claimed = append(gs.Claimed, volumeID)
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// groupTrackerKey returns the key of the group in the group tracker
+func groupTrackerKey(backupName, groupKey string) string {
+	sum := sha256.Sum256([]byte(groupKey))
+	return backupName + "." + hex.EncodeToString(sum[:8])
+}
+
+// getGroupSnapshot returns the group snapshot started for the given group as
+// part of the given backup, or nil if none was started
+func getGroupSnapshot(backupName string, group *volumeGroup) (*groupSnapshot, error) {
+	cm, err := core.Instance().GetConfigMap(groupTrackerConfigMap, veleroNamespace())
+	if k8s_errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get group snapshot tracker: %v", err)
+	}
+
+	value, ok := cm.Data[groupTrackerKey(backupName, group.key)]
+	if !ok {
+		return nil, nil
+	}
+	gs := &groupSnapshot{}
+	if err := json.Unmarshal([]byte(value), gs); err != nil {
+		return nil, fmt.Errorf("invalid group snapshot for %v in backup %v: %v", group.key, backupName, err)
+	}
+	return gs, nil
+}
+
+// saveGroupSnapshot records the group snapshot started for the given group
+// as part of the given backup
+func saveGroupSnapshot(backupName string, group *volumeGroup, gs *groupSnapshot) error {
+	value, err := json.Marshal(gs)
+	if err != nil {
+		return err
+	}
+
+	namespace := veleroNamespace()
+	cm, err := core.Instance().GetConfigMap(groupTrackerConfigMap, namespace)
+	if k8s_errors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      groupTrackerConfigMap,
+				Namespace: namespace,
+			},
+			Data: map[string]string{
+				groupTrackerKey(backupName, group.key): string(value),
+			},
+		}
+		_, err = core.Instance().CreateConfigMap(cm)
+		return err
+	} else if err != nil {
+		return fmt.Errorf("failed to get group snapshot tracker: %v", err)
+	}
+
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	for key, value := range cm.Data {
+		old := &groupSnapshot{}
+		if err := json.Unmarshal([]byte(value), old); err != nil || time.Since(old.Created) > groupTrackerMaxAge {
+			delete(cm.Data, key)
+		}
+	}
+	cm.Data[groupTrackerKey(backupName, group.key)] = string(value)
+	_, err = core.Instance().UpdateConfigMap(cm)
+	return err
+}
+
+// claimGroupSnapshot records that the snapshot of the volume in the group
+// snapshot of the given group was returned to Velero, so that it isn't taken
+// again if the group snapshot is restarted
+func claimGroupSnapshot(backupName string, group *volumeGroup, volumeID string) error {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+
+	gs, err := getGroupSnapshot(backupName, group)
+	if err != nil || gs == nil || !gs.claim(volumeID) {
+		return err
+	}
+	return saveGroupSnapshot(backupName, group, gs)
+}
@@ -0,0 +1,304 @@
+package snapshot
+
+import (
+	"reflect"
+	"testing"
+
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// addClaim adds a bound PVC and its PV to the fake, provisioned by the
+// given CSI driver
+func addClaim(kubeOps *fakeKubeOps, namespace, name, volumeID, driver string, labels map[string]string) {
+	pvName := "pv-" + volumeID
+	kubeOps.pvs[pvName] = &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: pvName},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: volumeID},
+			},
+			ClaimRef: &v1.ObjectReference{Namespace: namespace, Name: name},
+		},
+	}
+	kubeOps.pvcs[namespace+"/"+name] = &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: pvName},
+	}
+}
+
+// testPod returns a pod using the given PVCs as volumes named after them
+func testPod(namespace, name string, annotations map[string]string, claimNames ...string) v1.Pod {
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Annotations: annotations}}
+	for _, claimName := range claimNames {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+			Name: claimName,
+			VolumeSource: v1.VolumeSource{
+				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claimName},
+			},
+		})
+	}
+	return pod
+}
+
+// groupKubeOps returns PVCs of a database in namespace db, with a volume
+// of another CSI driver, and of an app in namespace web
+func groupKubeOps() *fakeKubeOps {
+	kubeOps := newFakeKubeOps()
+	addClaim(kubeOps, "db", "data", "vol-data", testCSIDriver, map[string]string{"app": "cassandra"})
+	addClaim(kubeOps, "db", "wal", "vol-wal", testCSIDriver, map[string]string{"app": "cassandra"})
+	addClaim(kubeOps, "db", "logs", "vol-logs", testCSIDriver, nil)
+	addClaim(kubeOps, "db", "scratch", "vol-scratch", "ebs.csi.aws.com", map[string]string{"app": "cassandra"})
+	addClaim(kubeOps, "web", "html", "vol-html", testCSIDriver, map[string]string{"app": "cassandra"})
+	kubeOps.pods = []v1.Pod{
+		testPod("db", "cassandra-0", nil, "data", "wal", "scratch"),
+		testPod("db", "fluentd", nil, "logs"),
+		testPod("web", "nginx", nil, "html"),
+	}
+	return kubeOps
+}
+
+func TestParseGroupConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]string
+		wantErr bool
+	}{
+		{name: "disabled", config: map[string]string{}},
+		{name: "backup", config: map[string]string{configGroupMode: groupModeBackup}},
+		{name: "namespace", config: map[string]string{configGroupMode: groupModeNamespace}},
+		{name: "pod", config: map[string]string{configGroupMode: groupModePod}},
+		{name: "label", config: map[string]string{configGroupMode: groupModeLabel, configGroupLabel: "app"}},
+		{name: "label without label key", config: map[string]string{configGroupMode: groupModeLabel}, wantErr: true},
+		{name: "invalid mode", config: map[string]string{configGroupMode: "cluster"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g, err := parseGroupConfig(test.config)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parse of %v returned error %v, want error %v", test.config, err, test.wantErr)
+			}
+			if err == nil && g.enabled() != (test.config[configGroupMode] != "") {
+				t.Errorf("group snapshots enabled is %v with %v", g.enabled(), test.config)
+			}
+		})
+	}
+}
+
+func TestGroupForPV(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		label  string
+		backup velerov1.BackupSpec
+		// pvName is the PV being backed up
+		pvName string
+		// annotations are set on the database pod
+		annotations map[string]string
+		wantKey     string
+		want        []string
+	}{
+		{
+			name:    "pod",
+			mode:    groupModePod,
+			pvName:  "pv-vol-data",
+			wantKey: "db/pod/cassandra-0",
+			want:    []string{"vol-data", "vol-wal"},
+		},
+		{
+			name:    "backup",
+			mode:    groupModeBackup,
+			pvName:  "pv-vol-data",
+			wantKey: groupModeBackup,
+			want:    []string{"vol-data", "vol-html", "vol-logs", "vol-wal"},
+		},
+		{
+			name:    "backup of a namespace",
+			mode:    groupModeBackup,
+			backup:  velerov1.BackupSpec{IncludedNamespaces: []string{"db"}},
+			pvName:  "pv-vol-data",
+			wantKey: groupModeBackup,
+			want:    []string{"vol-data", "vol-logs", "vol-wal"},
+		},
+		{
+			name: "backup of selected pods",
+			mode: groupModeBackup,
+			backup: velerov1.BackupSpec{
+				ExcludedNamespaces: []string{"web"},
+				LabelSelector:      &metav1.LabelSelector{MatchLabels: map[string]string{"app": "cassandra"}},
+			},
+			pvName:  "pv-vol-data",
+			wantKey: groupModeBackup,
+			want:    []string{"vol-data", "vol-wal"},
+		},
+		{
+			name:        "backup with restic volumes",
+			mode:        groupModeBackup,
+			backup:      velerov1.BackupSpec{IncludedNamespaces: []string{"db"}},
+			annotations: map[string]string{resticVolumesAnnotation: "wal"},
+			pvName:      "pv-vol-data",
+			wantKey:     groupModeBackup,
+			want:        []string{"vol-data", "vol-logs"},
+		},
+		{
+			name:        "backup with restic by default",
+			mode:        groupModeBackup,
+			backup:      velerov1.BackupSpec{IncludedNamespaces: []string{"db"}, DefaultVolumesToRestic: boolPtr(true)},
+			annotations: map[string]string{resticVolumesExcludesAnnotation: "data, wal"},
+			pvName:      "pv-vol-data",
+			wantKey:     groupModeBackup,
+			want:        []string{"vol-data", "vol-wal"},
+		},
+		{
+			name:   "backup without volume snapshots",
+			mode:   groupModeBackup,
+			backup: velerov1.BackupSpec{SnapshotVolumes: boolPtr(false)},
+			pvName: "pv-vol-data",
+		},
+		{
+			name:    "namespace",
+			mode:    groupModeNamespace,
+			pvName:  "pv-vol-data",
+			wantKey: "db",
+			want:    []string{"vol-data", "vol-logs", "vol-wal"},
+		},
+		{
+			name:        "namespace with restic volumes",
+			mode:        groupModeNamespace,
+			annotations: map[string]string{resticVolumesAnnotation: "wal"},
+			pvName:      "pv-vol-data",
+			wantKey:     "db",
+			want:        []string{"vol-data", "vol-logs"},
+		},
+		{
+			name:   "namespace excluded from the backup",
+			mode:   groupModeNamespace,
+			backup: velerov1.BackupSpec{ExcludedNamespaces: []string{"db"}},
+			pvName: "pv-vol-data",
+		},
+		{
+			name:    "label",
+			mode:    groupModeLabel,
+			label:   "app",
+			pvName:  "pv-vol-data",
+			wantKey: "db/app=cassandra",
+			want:    []string{"vol-data", "vol-wal"},
+		},
+		{
+			name:   "PVC without the label",
+			mode:   groupModeLabel,
+			label:  "app",
+			pvName: "pv-vol-logs",
+		},
+		{
+			name:   "single volume",
+			mode:   groupModePod,
+			pvName: "pv-vol-logs",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kubeOps := groupKubeOps()
+			kubeOps.pods[0].Annotations = test.annotations
+			g := &groupConfig{
+				mode:  test.mode,
+				label: test.label,
+				getBackup: func(name string) (*velerov1.Backup, error) {
+					if name != "backup-1" {
+						t.Errorf("got backup %v, want backup-1", name)
+					}
+					return &velerov1.Backup{Spec: test.backup}, nil
+				},
+			}
+
+			group, err := g.groupForPV(kubeOps, test.pvName, "backup-1")
+			if err != nil {
+				t.Fatalf("failed to get group: %v", err)
+			}
+			if test.want == nil {
+				if group != nil {
+					t.Errorf("PV is in group %v of %v, want no group", group.key, group.volumeIDs)
+				}
+				return
+			}
+			if group == nil {
+				t.Fatalf("PV has no group, want %v", test.want)
+			}
+			if group.key != test.wantKey || !reflect.DeepEqual(group.volumeIDs, test.want) {
+				t.Errorf("PV is in group %v of %v, want %v of %v", group.key, group.volumeIDs, test.wantKey, test.want)
+			}
+		})
+	}
+}
+
+func TestCloudCreateSnapshotGroup(t *testing.T) {
+	setEnv(t, veleroNamespaceEnv, "velero")
+	fastCloudsnapPolls(t)
+	kubeOps := groupKubeOps()
+	useKubeOps(t, kubeOps)
+	volDriver := newFakeVolumeDriver(
+		testVolume("vol-data", "pvc-data", nil),
+		testVolume("vol-wal", "pvc-wal", nil),
+	)
+	c := &cloudSnapshotPlugin{
+		log:      testLogger(),
+		pxClient: testClient(volDriver, kubeOps),
+		credID:   "cred-1",
+		group: &groupConfig{
+			mode: groupModePod,
+			getBackup: func(name string) (*velerov1.Backup, error) {
+				return &velerov1.Backup{}, nil
+			},
+		},
+	}
+
+	tasks := make(map[string]string)
+	for _, volumeID := range []string{"vol-data", "vol-wal"} {
+		tags := map[string]string{
+			veleroBackupTag:              "backup-1",
+			veleroPVTag:                  "pv-" + volumeID,
+			"velero.io/storage-location": "default",
+		}
+		snapshotID, err := c.CreateSnapshot(volumeID, "", tags)
+		if err != nil {
+			t.Fatalf("backup of %v failed: %v", volumeID, err)
+		}
+		id, err := parseCloudSnapshotID(snapshotID)
+		if err != nil {
+			t.Fatalf("invalid snapshot ID %v: %v", snapshotID, err)
+		}
+		tasks[volumeID] = id.CloudBackupID
+	}
+
+	if creates := volDriver.callCount("CloudBackupGroupCreate"); creates != 1 {
+		t.Fatalf("%v group cloud backups were started, want 1", creates)
+	}
+	if creates := volDriver.callCount("CloudBackupCreate"); creates != 0 {
+		t.Errorf("%v cloud backups were started, want 0", creates)
+	}
+	wantLabels := map[string]string{
+		veleroBackupTag:              "backup-1",
+		"velero.io/storage-location": "default",
+		pvcNamespaceLabel:            "db",
+	}
+	for volumeID, backupID := range tasks {
+		var backup *fakeCloudBackup
+		for _, b := range volDriver.backups {
+			if b.backupID == backupID {
+				backup = b
+			}
+		}
+		if backup == nil || backup.volumeID != volumeID || backup.groupID == "" {
+			t.Fatalf("snapshot of %v is cloud backup %v, not part of a group backup of the volume", volumeID, backupID)
+		}
+		if !reflect.DeepEqual(backup.labels, wantLabels) {
+			t.Errorf("group cloud backup has labels %v, want %v", backup.labels, wantLabels)
+		}
+	}
+	if _, ok := volDriver.backups[cloudBackupTaskName("backup-1", "vol-data")]; ok {
+		t.Errorf("volume was backed up on its own")
+	}
+}
@@ -0,0 +1,360 @@
+package snapshot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+const (
+	// hybridLocalSnapshotLabel is added to the cloud backup of a hybrid
+	// snapshot with the ID of the local snapshot that was uploaded
+	hybridLocalSnapshotLabel = "portworx.io/velero-local-snapshot"
+	// hybridCloudBackupLabel is added to the local snapshot of a hybrid
+	// snapshot with the ID of its cloud backup once the upload is done
+	hybridCloudBackupLabel = "portworx.io/cloudsnap-id"
+	// hybridUploadTaskLabel is added to the local snapshot of a hybrid
+	// snapshot with the name of the task uploading it
+	hybridUploadTaskLabel = "portworx.io/cloudsnap-task"
+	// hybridUploadStateLabel is added to the local snapshot of a hybrid
+	// snapshot with the state of its upload, so that uploads still pending
+	// when the plugin exits are resumed by the next plugin process
+	hybridUploadStateLabel = "portworx.io/cloudsnap-upload"
+
+	hybridUploadPending = "pending"
+	hybridUploadDone    = "done"
+	hybridUploadFailed  = "failed"
+)
+
+var (
+	// hybridUploads holds the local snapshots whose upload is being waited
+	// for in the process
+	hybridUploads     = make(map[string]bool)
+	hybridUploadsLock sync.Mutex
+)
+
+// hybridSnapshotPlugin takes a local snapshot and uploads it to the cloud in
+// the background. Restores use the local snapshot if it still exists and the
+// cloud backup otherwise.
+type hybridSnapshotPlugin struct {
+	Plugin
+	pxClient *portworxClient
+	log      logrus.FieldLogger
+	local    *localSnapshotPlugin
+	cloud    *cloudSnapshotPlugin
+}
+
+func (h *hybridSnapshotPlugin) Init(config map[string]string) error {
+	if err := h.local.Init(config); err != nil {
+		return err
+	}
+	if err := h.cloud.Init(config); err != nil {
+		return err
+	}
+	// Volumes are quiesced for the local snapshot, the snapshot being
+	// uploaded doesn't need to be
+	h.cloud.quiesce = &quiesceConfig{}
+
+	h.log.Infof("Init'ing portworx hybrid snapshot")
+	h.resumeUploads()
+	return nil
+}
+
+// resumeUploads waits in the background for the uploads that were started by
+// plugin processes that exited before they were done, and records their cloud
+// backup IDs
+func (h *hybridSnapshotPlugin) resumeUploads() {
+	volDriver, err := h.pxClient.getVolumeDriver()
+	if err != nil {
+		h.log.Warnf("Failed to find pending snapshot uploads: %v", err)
+		return
+	}
+	snaps, err := volDriver.Enumerate(&api.VolumeLocator{
+		VolumeLabels: map[string]string{hybridUploadStateLabel: hybridUploadPending},
+	}, nil)
+	if err != nil {
+		h.log.Warnf("Failed to find pending snapshot uploads: %v", err)
+		return
+	}
+
+	for _, snap := range snaps {
+		labels := snap.GetLocator().GetVolumeLabels()
+		taskName := labels[hybridUploadTaskLabel]
+		// Volumes restored from the snapshot may have copied its labels
+		if taskName == "" || !snap.GetReadonly() {
+			continue
+		}
+		snapDriver, err := h.pxClient.getVolumeDriverForLabels(labels, h.log)
+		if err != nil {
+			h.log.Warnf("Failed to resume upload %v of snapshot %v: %v", taskName, snap.GetId(), err)
+			continue
+		}
+		h.log.Infof("Resuming upload %v of snapshot %v", taskName, snap.GetId())
+		h.watchUpload(snapDriver, snap.GetId(), taskName)
+	}
+}
+
+func (h *hybridSnapshotPlugin) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (string, error) {
+	id, err := parseHybridSnapshotID(snapshotID)
+	if err != nil {
+		return "", err
+	}
+
+	volDriver, err := h.pxClient.getVolumeDriverForLabels(id.Labels, h.log)
+	if err != nil {
+		return "", err
+	}
+
+	vols, err := volDriver.Inspect([]string{id.LocalSnapshotID})
+	if err != nil {
+		h.log.Warnf("Failed to inspect local snapshot %v, restoring from the cloud: %v", id.LocalSnapshotID, err)
+	} else if len(vols) > 0 {
+		h.log.Infof("Restoring from local snapshot %v", id.LocalSnapshotID)
+		return h.local.CreateVolumeFromSnapshot(id.LocalSnapshotID, volumeType, volumeAZ, iops)
+	}
+
+	cloudBackupID, err := h.findCloudBackup(volDriver, id)
+	if err != nil {
+		return "", err
+	}
+	if cloudBackupID == "" {
+		return "", fmt.Errorf("local snapshot %v not found and it wasn't uploaded to the cloud", id.LocalSnapshotID)
+	}
+	h.log.Infof("Local snapshot %v not found, restoring from cloud backup %v", id.LocalSnapshotID, cloudBackupID)
+	cloudID := newCloudSnapshotID(cloudBackupID, id.SrcVolumeName, id.CredentialUUID, id.Labels)
+	cloudID.Ownership = id.Ownership
+	return h.cloud.restoreCloudBackup(volDriver, cloudID,
+		h.cloud.overrides.forVolume(volumeType, volumeAZ, iops, h.log))
+}
+
+func (h *hybridSnapshotPlugin) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
+	return volumeInfo(h.pxClient, volumeID, "portworx-hybridsnapshot", h.log)
+}
+
+func (h *hybridSnapshotPlugin) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (string, error) {
+	labels := h.cloud.cloudBackupLabels(tags)
+
+	// A retried backup uploads the local snapshot taken before, so that its
+	// upload is resumed instead of uploading a new snapshot
+	localSnapshot, err := h.previousLocalSnapshot(volumeID, tags)
+	if err != nil {
+		return "", err
+	}
+	var localSnapshotID string
+	if localSnapshot != nil {
+		localSnapshotID = localSnapshot.GetId()
+		h.log.Infof("Reusing snapshot %v of volume %v taken by a previous attempt", localSnapshotID, volumeID)
+		for _, k := range []string{"pvName", ownershipLabel} {
+			if value, ok := localSnapshot.GetLocator().GetVolumeLabels()[k]; ok {
+				tags[k] = value
+			}
+		}
+	} else if localSnapshotID, err = h.local.CreateSnapshot(volumeID, volumeAZ, tags); err != nil {
+		return "", err
+	}
+	labels[hybridLocalSnapshotLabel] = localSnapshotID
+
+	request := &api.CloudBackupCreateRequest{
+		VolumeID:       localSnapshotID,
+		CredentialUUID: h.cloud.credID,
+		Labels:         labels,
+		Name:           cloudBackupTaskName(tags[veleroBackupTag], localSnapshotID),
+	}
+	if err := applyIncrementalCount(request, tags); err != nil {
+		return "", err
+	}
+
+	// The upload is started before returning, so that it isn't lost if the
+	// plugin exits, and only waited for in the background
+	volDriver, err := h.pxClient.getVolumeDriverForLabels(labels, h.log)
+	if err != nil {
+		return "", err
+	}
+	if localSnapshot.GetLocator().GetVolumeLabels()[hybridUploadStateLabel] != hybridUploadDone {
+		taskName, err := h.cloud.startCloudBackup(volDriver, request, "")
+		if err != nil {
+			if derr := volDriver.Delete(context.Background(), localSnapshotID); derr != nil {
+				h.log.Warnf("Failed to delete snapshot %v: %v", localSnapshotID, derr)
+			}
+			return "", fmt.Errorf("failed to start upload of snapshot %v: %v", localSnapshotID, err)
+		}
+		err = volDriver.Set(localSnapshotID, &api.VolumeLocator{
+			VolumeLabels: map[string]string{
+				hybridUploadTaskLabel:  taskName,
+				hybridUploadStateLabel: hybridUploadPending,
+			},
+		}, nil)
+		if err != nil {
+			h.log.Warnf("Failed to record upload %v on snapshot %v: %v", taskName, localSnapshotID, err)
+		}
+		h.watchUpload(volDriver, localSnapshotID, taskName)
+	}
+
+	id := &hybridSnapshotID{
+		Version:         hybridSnapshotIDVersion,
+		LocalSnapshotID: localSnapshotID,
+		SrcVolumeName:   tags["pvName"],
+		CredentialUUID:  h.cloud.credID,
+		Labels:          restoreVolumeLabels(labels),
+	}
+	if value := tags[ownershipLabel]; value != "" {
+		if id.Ownership, err = decodeOwnership(value); err != nil {
+			return "", err
+		}
+	}
+	return id.encode()
+}
+
+// previousLocalSnapshot returns the local snapshot of the volume taken by a
+// previous attempt of the same Velero backup, or nil if there is none
+func (h *hybridSnapshotPlugin) previousLocalSnapshot(volumeID string, tags map[string]string) (*api.Volume, error) {
+	if strings.TrimSpace(tags[veleroBackupTag]) == "" || tags[veleroPVTag] == "" {
+		return nil, nil
+	}
+	volDriver, err := h.pxClient.getVolumeDriverForPV(tags[veleroPVTag], h.log)
+	if err != nil {
+		return nil, err
+	}
+	snaps, err := volDriver.Enumerate(&api.VolumeLocator{
+		VolumeLabels: map[string]string{
+			veleroBackupTag: tags[veleroBackupTag],
+			veleroPVTag:     tags[veleroPVTag],
+		},
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find snapshots of volume %v: %v", volumeID, err)
+	}
+	for _, snap := range snaps {
+		// Volumes restored from the snapshot may have copied its labels
+		if snap.GetReadonly() && snap.GetSource().GetParent() == volumeID {
+			return snap, nil
+		}
+	}
+	return nil, nil
+}
+
+// watchUpload waits in the background for the upload of the local snapshot
+// to finish and records the cloud backup ID on the local snapshot, unless the
+// process already waits for it. If the plugin exits before the upload is
+// done, the next plugin process resumes waiting for it.
+func (h *hybridSnapshotPlugin) watchUpload(volDriver volume.VolumeDriver, snapshotID, taskName string) {
+	hybridUploadsLock.Lock()
+	defer hybridUploadsLock.Unlock()
+	if hybridUploads[snapshotID] {
+		return
+	}
+	hybridUploads[snapshotID] = true
+
+	go func() {
+		defer func() {
+			hybridUploadsLock.Lock()
+			delete(hybridUploads, snapshotID)
+			hybridUploadsLock.Unlock()
+		}()
+		h.finishUpload(volDriver, snapshotID, taskName)
+	}()
+}
+
+// finishUpload waits for the upload of the local snapshot to finish and
+// records its result on the local snapshot
+func (h *hybridSnapshotPlugin) finishUpload(volDriver volume.VolumeDriver, snapshotID, taskName string) {
+	labels := map[string]string{hybridUploadStateLabel: hybridUploadFailed}
+	if err := h.cloud.waitForCloudBackup(volDriver, taskName, api.CloudBackupOp); err != nil {
+		h.log.Errorf("Error uploading snapshot %v: %v", snapshotID, err)
+	} else if status, ok := h.cloud.getCloudBackupStatus(volDriver, taskName); !ok {
+		h.log.Errorf("Failed to get status of upload %v of snapshot %v", taskName, snapshotID)
+	} else {
+		h.log.Infof("Finished upload of snapshot %v to %v", snapshotID, status.ID)
+		labels = map[string]string{
+			hybridUploadStateLabel: hybridUploadDone,
+			hybridCloudBackupLabel: status.ID,
+		}
+	}
+
+	err := volDriver.Set(snapshotID, &api.VolumeLocator{VolumeLabels: labels}, nil)
+	if err != nil {
+		h.log.Warnf("Failed to record upload %v of snapshot %v: %v", taskName, snapshotID, err)
+	}
+}
+
+// stopUpload stops the upload of the local snapshot if it is still in
+// progress, so that the snapshot can be deleted
+func (h *hybridSnapshotPlugin) stopUpload(volDriver volume.VolumeDriver, snapshotID string, labels map[string]string) {
+	taskName := labels[hybridUploadTaskLabel]
+	if taskName == "" || labels[hybridUploadStateLabel] != hybridUploadPending {
+		return
+	}
+	status, ok := h.cloud.getCloudBackupStatus(volDriver, taskName)
+	if !ok || status.Status == api.CloudBackupStatusDone || !cloudBackupResumable(status.Status) {
+		return
+	}
+	h.log.Infof("Snapshot %v is being deleted while its upload %v is %v", snapshotID, taskName, status.Status)
+	h.cloud.stopCloudBackup(volDriver, taskName, api.CloudBackupOp)
+}
+
+// findCloudBackup returns the ID of the cloud backup of the hybrid snapshot,
+// or an empty string if it wasn't uploaded
+func (h *hybridSnapshotPlugin) findCloudBackup(volDriver volume.VolumeDriver, id *hybridSnapshotID) (string, error) {
+	enumResponse, err := volDriver.CloudBackupEnumerate(&api.CloudBackupEnumerateRequest{
+		CloudBackupGenericRequest: api.CloudBackupGenericRequest{
+			CredentialUUID: h.cloud.credentialForSnapshot(&cloudSnapshotID{CredentialUUID: id.CredentialUUID}),
+			All:            true,
+			StatusFilter:   api.CloudBackupStatusDone,
+			MetadataFilter: map[string]string{hybridLocalSnapshotLabel: id.LocalSnapshotID},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to find cloud backup of snapshot %v: %v", id.LocalSnapshotID, err)
+	}
+	if len(enumResponse.Backups) == 0 {
+		return "", nil
+	}
+
+	// Use the latest backup if the upload was retried
+	backups := enumResponse.Backups
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Timestamp.After(backups[j].Timestamp) })
+	return backups[0].ID, nil
+}
+
+func (h *hybridSnapshotPlugin) DeleteSnapshot(snapshotID string) error {
+	id, err := parseHybridSnapshotID(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	volDriver, err := h.pxClient.getVolumeDriverForLabels(id.Labels, h.log)
+	if err != nil {
+		return err
+	}
+
+	var cloudBackupID string
+	vols, err := volDriver.Inspect([]string{id.LocalSnapshotID})
+	if err == nil && len(vols) > 0 {
+		cloudBackupID = vols[0].Locator.VolumeLabels[hybridCloudBackupLabel]
+		h.stopUpload(volDriver, id.LocalSnapshotID, vols[0].Locator.VolumeLabels)
+		if err := volDriver.Delete(context.Background(), id.LocalSnapshotID); err != nil {
+			return err
+		}
+	}
+
+	if cloudBackupID == "" {
+		if cloudBackupID, err = h.findCloudBackup(volDriver, id); err != nil {
+			return err
+		}
+	}
+	if cloudBackupID == "" {
+		return nil
+	}
+
+	return volDriver.CloudBackupDelete(&api.CloudBackupDeleteRequest{
+		ID:             cloudBackupID,
+		CredentialUUID: h.cloud.credentialForSnapshot(&cloudSnapshotID{CredentialUUID: id.CredentialUUID}),
+		Force:          false,
+	})
+}
@@ -0,0 +1,107 @@
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+func TestHybridCreateSnapshotRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		// uploadState is the upload state of the snapshot taken by a
+		// previous attempt, if any
+		uploadState   string
+		previous      bool
+		wantSnapshots int
+		wantCreates   int
+	}{
+		{
+			name:          "first attempt",
+			wantSnapshots: 1,
+			wantCreates:   1,
+		},
+		{
+			name:        "resume the upload of the previous snapshot",
+			previous:    true,
+			uploadState: hybridUploadPending,
+		},
+		{
+			name:        "upload the previous snapshot",
+			previous:    true,
+			wantCreates: 1,
+		},
+		{
+			name:        "previous snapshot already uploaded",
+			previous:    true,
+			uploadState: hybridUploadDone,
+		},
+	}
+
+	fastCloudsnapPolls(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kubeOps := newFakeKubeOps()
+			addClaim(kubeOps, "db", "data", "vol-data", testCSIDriver, nil)
+			volDriver := newFakeVolumeDriver(testVolume("vol-data", "pvc-data", nil))
+			tags := map[string]string{veleroBackupTag: "backup-1", veleroPVTag: "pv-vol-data"}
+			var previousID string
+			if test.previous {
+				labels := map[string]string{"pvName": "pvc-data"}
+				for k, v := range tags {
+					labels[k] = v
+				}
+				var err error
+				previousID, err = volDriver.Snapshot("vol-data", true, &api.VolumeLocator{VolumeLabels: labels}, true)
+				if err != nil {
+					t.Fatalf("failed to take previous snapshot: %v", err)
+				}
+				if test.uploadState != "" {
+					taskName := cloudBackupTaskName("backup-1", previousID)
+					volDriver.backups[taskName] = &fakeCloudBackup{
+						volumeID: previousID,
+						backupID: "bucket/" + previousID + "-backup-1",
+						status:   api.CloudBackupStatusDone,
+					}
+					volDriver.volumes[previousID].Locator.VolumeLabels[hybridUploadTaskLabel] = taskName
+					volDriver.volumes[previousID].Locator.VolumeLabels[hybridUploadStateLabel] = test.uploadState
+				}
+				volDriver.calls = make(map[string]int)
+			}
+
+			pxClient := testClient(volDriver, kubeOps)
+			h := &hybridSnapshotPlugin{
+				pxClient: pxClient,
+				log:      testLogger(),
+				local:    &localSnapshotPlugin{pxClient: pxClient, log: testLogger()},
+				cloud:    &cloudSnapshotPlugin{pxClient: pxClient, log: testLogger(), credID: "cred-1"},
+			}
+
+			snapshotID, err := h.CreateSnapshot("vol-data", "", tags)
+			if err != nil {
+				t.Fatalf("backup failed: %v", err)
+			}
+			id, err := parseHybridSnapshotID(snapshotID)
+			if err != nil {
+				t.Fatalf("invalid snapshot ID %v: %v", snapshotID, err)
+			}
+			if snapshots := volDriver.callCount("Snapshot"); snapshots != test.wantSnapshots {
+				t.Errorf("%v snapshots were taken, want %v", snapshots, test.wantSnapshots)
+			}
+			if creates := volDriver.callCount("CloudBackupCreate"); creates != test.wantCreates {
+				t.Errorf("%v uploads were started, want %v", creates, test.wantCreates)
+			}
+			if test.previous && id.LocalSnapshotID != previousID {
+				t.Errorf("snapshot is %v, want %v taken by the previous attempt", id.LocalSnapshotID, previousID)
+			}
+			if id.SrcVolumeName != "pvc-data" {
+				t.Errorf("snapshot is of volume %v, want pvc-data", id.SrcVolumeName)
+			}
+			if test.wantCreates > 0 {
+				if _, ok := volDriver.backups[cloudBackupTaskName("backup-1", id.LocalSnapshotID)]; !ok {
+					t.Errorf("upload of snapshot %v not found", id.LocalSnapshotID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package snapshot
+
+import (
+	"fmt"
+
+	lsecrets "github.com/libopenstorage/secrets"
+	k8s_secrets "github.com/libopenstorage/secrets/k8s"
+	"github.com/portworx/sched-ops/k8s/core"
+)
+
+// kubeSecrets is the secrets provider of the Kubernetes Secrets of a
+// cluster. It works like the k8s provider of libopenstorage/secrets, which
+// only reads the cluster Velero runs in, and takes the same key context.
+type kubeSecrets struct {
+	kubeOps core.Ops
+}
+
+// newKubeSecrets returns the secrets provider of the cluster of the client
+func newKubeSecrets(kubeOps core.Ops) lsecrets.Secrets {
+	return &kubeSecrets{kubeOps: kubeOps}
+}
+
+func (s *kubeSecrets) String() string {
+	return k8s_secrets.Name
+}
+
+func (s *kubeSecrets) GetSecret(secretName string, keyContext map[string]string) (map[string]interface{}, error) {
+	namespace, ok := keyContext[k8s_secrets.SecretNamespace]
+	if !ok {
+		return nil, fmt.Errorf("namespace of secret %v is not set", secretName)
+	}
+	secret, err := s.kubeOps.GetSecret(secretName, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %v/%v: %v", namespace, secretName, err)
+	}
+	if secret == nil {
+		return nil, lsecrets.ErrInvalidSecretId
+	}
+
+	data := make(map[string]interface{})
+	for key, value := range secret.Data {
+		data[key] = string(value)
+	}
+	return data, nil
+}
+
+func (s *kubeSecrets) PutSecret(secretName string, secretData map[string]interface{}, keyContext map[string]string) error {
+	namespace, ok := keyContext[k8s_secrets.SecretNamespace]
+	if !ok {
+		return fmt.Errorf("namespace of secret %v is not set", secretName)
+	}
+	if len(secretData) == 0 {
+		return nil
+	}
+
+	data := make(map[string][]byte)
+	for key, value := range secretData {
+		switch v := value.(type) {
+		case string:
+			data[key] = []byte(v)
+		case []byte:
+			data[key] = v
+		default:
+			return fmt.Errorf("unsupported type %T of key %v of secret %v/%v", value, key, namespace, secretName)
+		}
+	}
+	_, err := s.kubeOps.UpdateSecretData(secretName, namespace, data)
+	return err
+}
+
+func (s *kubeSecrets) DeleteSecret(secretName string, keyContext map[string]string) error {
+	namespace, ok := keyContext[k8s_secrets.SecretNamespace]
+	if !ok {
+		return fmt.Errorf("namespace of secret %v is not set", secretName)
+	}
+	return s.kubeOps.DeleteSecret(secretName, namespace)
+}
+
+func (s *kubeSecrets) ListSecrets() ([]string, error) {
+	return nil, lsecrets.ErrNotSupported
+}
+
+func (s *kubeSecrets) Encrypt(secretID string, plainTextData string, keyContext map[string]string) (string, error) {
+	return "", lsecrets.ErrNotSupported
+}
+
+func (s *kubeSecrets) Decrypt(secretID string, encryptedData string, keyContext map[string]string) (string, error) {
+	return "", lsecrets.ErrNotSupported
+}
+
+func (s *kubeSecrets) Rencrypt(
+	originalSecretID string,
+	newSecretID string,
+	originalKeyContext map[string]string,
+	newKeyContext map[string]string,
+	encryptedData string,
+) (string, error) {
+	return "", lsecrets.ErrNotSupported
+}
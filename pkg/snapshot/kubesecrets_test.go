@@ -0,0 +1,31 @@
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+	k8s_secrets "github.com/libopenstorage/secrets/k8s"
+)
+
+func TestKubeSecrets(t *testing.T) {
+	// Secrets are read in the cluster of the client, not the one of the
+	// process
+	useKubeOps(t, newFakeKubeOps())
+	kubeOps := newFakeKubeOps()
+	kubeOps.secrets["velero/s3-creds"] = credSecret("key-1")
+	secrets := newKubeSecrets(kubeOps)
+
+	data, err := secrets.GetSecret("s3-creds", map[string]string{k8s_secrets.SecretNamespace: "velero"})
+	if err != nil {
+		t.Fatalf("failed to get secret: %v", err)
+	}
+	if data[api.OptCredAccessKey] != "key-1" {
+		t.Errorf("secret is %v, want access key key-1", data)
+	}
+	if _, err := secrets.GetSecret("s3-creds", map[string]string{}); err == nil {
+		t.Errorf("secret without a namespace was found")
+	}
+	if _, err := secrets.GetSecret("s3-creds", map[string]string{k8s_secrets.SecretNamespace: "default"}); err == nil {
+		t.Errorf("secret in another namespace was found")
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"golang.org/x/net/context"
 	"strings"
+	"time"
 
 	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
 	"github.com/sirupsen/logrus"
 )
 
@@ -17,21 +19,34 @@ type localSnapshotPlugin struct {
 	Plugin
 	pxClient *portworxClient
 	log logrus.FieldLogger
+	overrides *restoreOverrides
+	group *groupConfig
+	quiesce *quiesceConfig
 }
 
 func (l *localSnapshotPlugin) Init(config map[string]string) error {
+	var err error
+	if l.group, err = parseGroupConfig(config); err != nil {
+		l.log.Errorf("%v", err)
+		return err
+	}
+	if l.quiesce, err = parseQuiesceConfig(config); err != nil {
+		l.log.Errorf("%v", err)
+		return err
+	}
+
 	l.log.Infof("Init'ing portworx local snapshot")
 	return nil
 }
 
 func (l *localSnapshotPlugin) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (string, error) {
-	volDriver, err := l.pxClient.getVolumeDriver()
+	volDriver, err := l.snapshotVolumeDriver(snapshotID)
 	if err != nil {
 		return "", err
 	}
 	vols, err := volDriver.Inspect([]string{snapshotID})
 	if err != nil {
-		return "", nil
+		return "", fmt.Errorf("failed to inspect snapshot %v: %v", snapshotID, err)
 	}
 	if len(vols) == 0 {
 		return "", fmt.Errorf("Snapshot %v not found", snapshotID)
@@ -44,15 +59,39 @@ func (l *localSnapshotPlugin) CreateVolumeFromSnapshot(snapshotID, volumeType, v
 	if err != nil {
 		return "", err
 	}
+
+	// Record the PVC and CSI driver of the snapshot on the restored volume,
+	// like for volumes restored from the cloud
+	if labels := restoreVolumeLabels(vols[0].Locator.VolumeLabels); len(labels) > 0 {
+		err := volDriver.Set(volumeID, &api.VolumeLocator{VolumeLabels: labels}, nil)
+		if err != nil {
+			l.log.Warnf("Failed to set labels %v on restored volume %v: %v", labels, volumeID, err)
+		}
+	}
+
+	overrides := l.overrides.forVolume(volumeType, volumeAZ, iops, l.log)
+	if err := overrides.apply(volDriver, volumeID, l.log); err != nil {
+		l.log.Errorf("Error applying restore overrides to volume %v: %v", volumeID, err)
+		return "", err
+	}
+
+	if value := vols[0].Locator.VolumeLabels[ownershipLabel]; value != "" {
+		ownership, err := decodeOwnership(value)
+		if err != nil {
+			l.log.Warnf("Ownership of snapshot %v will not be restored: %v", snapshotID, err)
+		} else {
+			overrides.ownership.applyOwnership(volDriver, volumeID, ownership, l.log)
+		}
+	}
 	return volumeID, err
 }
 
 func (l *localSnapshotPlugin) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
-	return "portworx-snapshot", nil, nil
+	return volumeInfo(l.pxClient, volumeID, "portworx-snapshot", l.log)
 }
 
 func (l *localSnapshotPlugin) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (string, error) {
-	volDriver, err := l.pxClient.getVolumeDriver()
+	volDriver, err := l.pxClient.getVolumeDriverForPV(tags[veleroPVTag], l.log)
 	if err != nil {
 		return "", err
 	}
@@ -66,11 +105,41 @@ func (l *localSnapshotPlugin) CreateSnapshot(volumeID, volumeAZ string, tags map
 	}
 
 	tags["pvName"] = vols[0].Locator.Name
+	if ownership := vols[0].GetSpec().GetOwnership(); ownership != nil {
+		value, err := encodeOwnership(ownership)
+		if err != nil {
+			return "", err
+		}
+		tags[ownershipLabel] = value
+	}
+	for k, v := range pvLabels(l.pxClient.kubeOps, tags[veleroPVTag], l.log) {
+		tags[k] = v
+	}
 	l.log.Infof("Tags: %v", tags)
+
+	backupName := strings.TrimSpace(tags[veleroBackupTag])
+	group, err := l.group.groupForPV(l.pxClient.kubeOps, tags[veleroPVTag], backupName)
+	if err != nil {
+		return "", fmt.Errorf("failed to get group of volume %v: %v", volumeID, err)
+	}
+	if group != nil && group.contains(volumeID) && backupName != "" {
+		snapshotID, err := l.createGroupSnapshot(volDriver, volumeID, backupName, group, tags)
+		if err != nil || snapshotID != "" {
+			return snapshotID, err
+		}
+	}
+
 	locator := &api.VolumeLocator{
-		Name:         strings.TrimSpace(tags["velero.io/backup"]) + "_" + vols[0].Locator.Name,
+		Name:         backupName + "_" + vols[0].Locator.Name,
 		VolumeLabels: tags,
 	}
+
+	unquiesce, err := l.quiesce.quiesceVolumes(volDriver, []string{volumeID}, backupName, l.log)
+	if err != nil {
+		return "", err
+	}
+	defer unquiesce()
+
 	snapshotID, err := volDriver.Snapshot(volumeID, true, locator, true)
 	if err != nil {
 		return "", err
@@ -79,11 +148,136 @@ func (l *localSnapshotPlugin) CreateSnapshot(volumeID, volumeAZ string, tags map
 	return snapshotID, err
 }
 
+// createGroupSnapshot takes a group snapshot of the volumes in the group,
+// unless one was already taken for the group as part of the same Velero
+// backup, and returns the ID of the snapshot of the given volume. An empty ID
+// is returned if the volume isn't part of the group snapshot taken before.
+func (l *localSnapshotPlugin) createGroupSnapshot(
+	volDriver volume.VolumeDriver,
+	volumeID string,
+	backupName string,
+	group *volumeGroup,
+	tags map[string]string,
+) (string, error) {
+	groupLock.Lock()
+	defer groupLock.Unlock()
+
+	gs, err := getGroupSnapshot(backupName, group)
+	if err != nil {
+		return "", err
+	}
+	if gs == nil {
+		unquiesce, err := l.quiesce.quiesceVolumes(volDriver, group.volumeIDs, backupName, l.log)
+		if err != nil {
+			return "", err
+		}
+		response, err := volDriver.SnapshotGroup("", nil, group.volumeIDs, true)
+		unquiesce()
+		if err != nil {
+			return "", fmt.Errorf("failed to take group snapshot of %v: %v", group.volumeIDs, err)
+		}
+		if response.Error != "" {
+			return "", fmt.Errorf("failed to take group snapshot of %v: %v", group.volumeIDs, response.Error)
+		}
+
+		gs = &groupSnapshot{
+			Snapshots: make(map[string]string),
+			Created:   time.Now(),
+		}
+		for memberID, snap := range response.Snapshots {
+			if snap.GetVolumeCreateResponse() != nil {
+				gs.Snapshots[memberID] = snap.GetVolumeCreateResponse().GetId()
+			}
+		}
+		l.log.Infof("Took group snapshot of %v: %v", group.volumeIDs, gs.Snapshots)
+
+		// Label every snapshot of the group with the backup and the group
+		// until Velero claims it, so that none is left behind unlabelled
+		for memberID, memberSnapshotID := range gs.Snapshots {
+			err := volDriver.Set(memberSnapshotID, &api.VolumeLocator{
+				VolumeLabels: map[string]string{
+					veleroBackupTag:    backupName,
+					groupSnapshotLabel: groupTrackerKey(backupName, group.key),
+				},
+			}, nil)
+			if err != nil {
+				l.log.Warnf("Failed to label snapshot %v of volume %v with backup %v: %v",
+					memberSnapshotID, memberID, backupName, err)
+			}
+		}
+		if err := saveGroupSnapshot(backupName, group, gs); err != nil {
+			return "", fmt.Errorf("failed to save group snapshot: %v", err)
+		}
+	}
+
+	snapshotID, ok := gs.Snapshots[volumeID]
+	if !ok {
+		// The volume joined the group after its snapshot was taken
+		l.log.Infof("Volume %v not found in group snapshot of %v, taking its own snapshot", volumeID, group.volumeIDs)
+		return "", nil
+	}
+
+	// The group snapshot doesn't carry the labels needed to restore each
+	// snapshot, so add the ones for this volume
+	if err := volDriver.Set(snapshotID, &api.VolumeLocator{VolumeLabels: tags}, nil); err != nil {
+		return "", fmt.Errorf("failed to set labels on snapshot %v of volume %v: %v", snapshotID, volumeID, err)
+	}
+	if gs.claim(volumeID) {
+		if err := saveGroupSnapshot(backupName, group, gs); err != nil {
+			l.log.Warnf("Failed to record snapshot %v of volume %v in the group tracker: %v", snapshotID, volumeID, err)
+		}
+	}
+	return snapshotID, nil
+}
+
 func (l *localSnapshotPlugin) DeleteSnapshot(snapshotID string) error {
-	volDriver, err := l.pxClient.getVolumeDriver()
+	volDriver, err := l.snapshotVolumeDriver(snapshotID)
 	if err != nil {
 		return err
 	}
 
-	return volDriver.Delete(context.Background(), snapshotID)
+	vols, err := volDriver.Inspect([]string{snapshotID})
+	if err != nil {
+		return fmt.Errorf("failed to inspect snapshot %v: %v", snapshotID, err)
+	}
+	if err := volDriver.Delete(context.Background(), snapshotID); err != nil {
+		return err
+	}
+	if len(vols) > 0 {
+		if groupKey := vols[0].GetLocator().GetVolumeLabels()[groupSnapshotLabel]; groupKey != "" {
+			l.deleteUnclaimedGroupSnapshots(volDriver, groupKey)
+		}
+	}
+	return nil
+}
+
+// deleteUnclaimedGroupSnapshots deletes the snapshots of the group snapshot
+// that were never returned to Velero, once the snapshots returned to Velero
+// were all deleted
+func (l *localSnapshotPlugin) deleteUnclaimedGroupSnapshots(volDriver volume.VolumeDriver, groupKey string) {
+	snaps, err := volDriver.Enumerate(&api.VolumeLocator{
+		VolumeLabels: map[string]string{groupSnapshotLabel: groupKey},
+	}, nil)
+	if err != nil {
+		l.log.Warnf("Failed to find snapshots of group %v: %v", groupKey, err)
+		return
+	}
+	for _, snap := range snaps {
+		// Snapshots returned to Velero are labelled with their PV
+		if snap.GetLocator().GetVolumeLabels()[veleroPVTag] != "" {
+			return
+		}
+	}
+	for _, snap := range snaps {
+		l.log.Infof("Deleting snapshot %v of group %v, not part of the backup", snap.Id, groupKey)
+		if err := volDriver.Delete(context.Background(), snap.Id); err != nil {
+			l.log.Warnf("Failed to delete snapshot %v of group %v: %v", snap.Id, groupKey, err)
+		}
+	}
+}
+
+// snapshotVolumeDriver returns the volume driver making calls as the tenant
+// owning the PVC recorded on the snapshot
+func (l *localSnapshotPlugin) snapshotVolumeDriver(snapshotID string) (volume.VolumeDriver, error) {
+	return l.pxClient.getVolumeDriverForVolume(snapshotID, l.log)
 }
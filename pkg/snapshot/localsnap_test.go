@@ -0,0 +1,134 @@
+package snapshot
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+func TestLocalCreateVolumeFromSnapshot(t *testing.T) {
+	snapshotLabels := map[string]string{
+		"pvName":          "pvc-1",
+		veleroBackupTag:   "backup-1",
+		pvcNameLabel:      "data",
+		pvcNamespaceLabel: "app",
+	}
+	volDriver := newFakeVolumeDriver(testVolume("snap-0", "backup-1_pvc-1", snapshotLabels))
+	l := &localSnapshotPlugin{
+		pxClient:  testClient(volDriver, nil),
+		log:       testLogger(),
+		overrides: &restoreOverrides{},
+	}
+
+	volumeID, err := l.CreateVolumeFromSnapshot("snap-0", "portworx-snapshot?repl=2", "", nil)
+	if err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	vol := volDriver.volume(volumeID)
+	if vol == nil {
+		t.Fatalf("restored volume %v not found", volumeID)
+	}
+	if vol.Locator.Name != "pvc-1" {
+		t.Errorf("restored volume is named %v, want pvc-1", vol.Locator.Name)
+	}
+	wantLabels := map[string]string{
+		veleroBackupTag:   "backup-1",
+		pvcNameLabel:      "data",
+		pvcNamespaceLabel: "app",
+	}
+	if !reflect.DeepEqual(vol.Locator.VolumeLabels, wantLabels) {
+		t.Errorf("restored volume labels are %v, want %v", vol.Locator.VolumeLabels, wantLabels)
+	}
+	if vol.Spec.HaLevel != 2 {
+		t.Errorf("restored volume HA level is %v, want 2", vol.Spec.HaLevel)
+	}
+}
+
+func TestLocalCreateVolumeFromSnapshotErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		snapshotID string
+		inspectErr error
+	}{
+		{name: "inspect failure", snapshotID: "snap-0", inspectErr: errors.New("node is not in quorum")},
+		{name: "snapshot not found", snapshotID: "snap-1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			volDriver := newFakeVolumeDriver(testVolume("snap-0", "backup-1_pvc-1", nil))
+			volDriver.errors["Inspect"] = test.inspectErr
+			l := &localSnapshotPlugin{
+				pxClient:  testClient(volDriver, nil),
+				log:       testLogger(),
+				overrides: &restoreOverrides{},
+			}
+
+			volumeID, err := l.CreateVolumeFromSnapshot(test.snapshotID, "portworx-snapshot", "", nil)
+			if err == nil {
+				t.Errorf("restore returned volume %q, want an error", volumeID)
+			}
+			if snapshots := volDriver.snapshotsOf(test.snapshotID); len(snapshots) > 0 {
+				t.Errorf("volumes %v were restored, want none", snapshots)
+			}
+		})
+	}
+}
+
+func TestLocalGroupSnapshotCleanup(t *testing.T) {
+	setEnv(t, veleroNamespaceEnv, "velero")
+	kubeOps := groupKubeOps()
+	useKubeOps(t, kubeOps)
+	volDriver := newFakeVolumeDriver(
+		testVolume("vol-data", "pvc-data", nil),
+		testVolume("vol-wal", "pvc-wal", nil),
+		testVolume("vol-logs", "pvc-logs", nil),
+	)
+	l := &localSnapshotPlugin{
+		pxClient: testClient(volDriver, kubeOps),
+		log:      testLogger(),
+		group: &groupConfig{
+			mode: groupModeNamespace,
+			getBackup: func(name string) (*velerov1.Backup, error) {
+				return &velerov1.Backup{}, nil
+			},
+		},
+	}
+
+	// The backup fails before Velero backs up vol-logs
+	var snapshotIDs []string
+	for _, volumeID := range []string{"vol-data", "vol-wal"} {
+		snapshotID, err := l.CreateSnapshot(volumeID, "", map[string]string{
+			veleroBackupTag: "backup-1",
+			veleroPVTag:     "pv-" + volumeID,
+		})
+		if err != nil {
+			t.Fatalf("backup of %v failed: %v", volumeID, err)
+		}
+		snapshotIDs = append(snapshotIDs, snapshotID)
+	}
+	if snapshots := volDriver.callCount("SnapshotGroup"); snapshots != 1 {
+		t.Fatalf("%v group snapshots were taken, want 1", snapshots)
+	}
+	unclaimed := volDriver.snapshotsOf("vol-logs")
+	if len(unclaimed) != 1 {
+		t.Fatalf("vol-logs has snapshots %v, want the one of the group", unclaimed)
+	}
+
+	if err := l.DeleteSnapshot(snapshotIDs[0]); err != nil {
+		t.Fatalf("failed to delete snapshot %v: %v", snapshotIDs[0], err)
+	}
+	if volDriver.volume(unclaimed[0]) == nil {
+		t.Fatalf("unclaimed snapshot %v was deleted before the backup", unclaimed[0])
+	}
+	if err := l.DeleteSnapshot(snapshotIDs[1]); err != nil {
+		t.Fatalf("failed to delete snapshot %v: %v", snapshotIDs[1], err)
+	}
+	for _, volumeID := range []string{"vol-data", "vol-wal", "vol-logs"} {
+		if snapshots := volDriver.snapshotsOf(volumeID); len(snapshots) > 0 {
+			t.Errorf("snapshots %v of %v were not deleted", snapshots, volumeID)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// configRestoreOwnerMap maps the users owning or collaborating on
+	// backed up volumes to the users set on restored volumes, as comma
+	// separated source=target pairs. Users that aren't mapped are kept.
+	configRestoreOwnerMap = "restoreOwnerMap"
+	// configRestoreGroupMap maps the groups with access to backed up volumes
+	// to the groups set on restored volumes, as comma separated
+	// source=target pairs. Groups that aren't mapped are kept.
+	configRestoreGroupMap = "restoreGroupMap"
+
+	// ownershipLabel is set on local snapshots with the ownership of the
+	// source volume, since clones are owned by the user creating them
+	ownershipLabel = "portworx.io/ownership"
+)
+
+// ownershipMap maps the users and groups of the ownership of backed up
+// volumes to the ones of restored volumes
+type ownershipMap struct {
+	owners map[string]string
+	groups map[string]string
+}
+
+// parseOwnershipMap parses the restore owner and group mappings from the
+// plugin config
+func parseOwnershipMap(config map[string]string) (*ownershipMap, error) {
+	owners, err := parseNameMap(config, configRestoreOwnerMap, "user")
+	if err != nil {
+		return nil, err
+	}
+	groups, err := parseNameMap(config, configRestoreGroupMap, "group")
+	if err != nil {
+		return nil, err
+	}
+	return &ownershipMap{owners: owners, groups: groups}, nil
+}
+
+// parseNameMap parses the comma separated source=target pairs of the config
+// key
+func parseNameMap(config map[string]string, key, kind string) (map[string]string, error) {
+	names := make(map[string]string)
+	value := config[key]
+	if value == "" {
+		return names, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid %v %q, must be comma separated source=target %v pairs",
+				key, value, kind)
+		}
+		names[parts[0]] = parts[1]
+	}
+	return names, nil
+}
+
+// remap returns a copy of the ownership with its owner, collaborators and
+// groups mapped
+func (m *ownershipMap) remap(o *api.Ownership) *api.Ownership {
+	if m == nil {
+		m = &ownershipMap{}
+	}
+	mapped := &api.Ownership{Owner: mapName(m.owners, o.GetOwner())}
+	if acls := o.GetAcls(); acls != nil {
+		mapped.Acls = &api.Ownership_AccessControl{Public: acls.GetPublic()}
+		if len(acls.GetGroups()) > 0 {
+			mapped.Acls.Groups = make(map[string]api.Ownership_AccessType)
+			for group, access := range acls.GetGroups() {
+				mapped.Acls.Groups[mapName(m.groups, group)] = access
+			}
+		}
+		if len(acls.GetCollaborators()) > 0 {
+			mapped.Acls.Collaborators = make(map[string]api.Ownership_AccessType)
+			for user, access := range acls.GetCollaborators() {
+				mapped.Acls.Collaborators[mapName(m.owners, user)] = access
+			}
+		}
+	}
+	return mapped
+}
+
+func mapName(names map[string]string, name string) string {
+	if target, ok := names[name]; ok {
+		return target
+	}
+	return name
+}
+
+// encodeOwnership returns the ownership in the format of ownershipLabel
+func encodeOwnership(o *api.Ownership) (string, error) {
+	value, err := json.Marshal(o)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode ownership: %v", err)
+	}
+	return string(value), nil
+}
+
+// decodeOwnership parses the ownership recorded in ownershipLabel
+func decodeOwnership(value string) (*api.Ownership, error) {
+	o := &api.Ownership{}
+	if err := json.Unmarshal([]byte(value), o); err != nil {
+		return nil, fmt.Errorf("invalid %v label %q: %v", ownershipLabel, value, err)
+	}
+	return o, nil
+}
+
+// ownershipEqual returns true if both ownerships have the same owner and
+// ACLs
+func ownershipEqual(a, b *api.Ownership) bool {
+	// JSON encoding sorts map keys, so equal ownerships encode the same
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(encodedA) == string(encodedB)
+}
+
+// applyOwnership sets the ownership of the backed up volume, after mapping,
+// on the volume restored from it. The owner is only sent when it changes
+// since only administrators can set it. Failures are logged as the volume
+// is restored and only its ownership is off.
+func (m *ownershipMap) applyOwnership(
+	volDriver volume.VolumeDriver,
+	volumeID string,
+	ownership *api.Ownership,
+	log logrus.FieldLogger,
+) {
+	if ownership == nil {
+		return
+	}
+	target := m.remap(ownership)
+
+	vols, err := volDriver.Inspect([]string{volumeID})
+	if err != nil || len(vols) == 0 {
+		log.Warnf("Failed to inspect restored volume %v to set its ownership: %v", volumeID, err)
+		return
+	}
+	current := vols[0].GetSpec().GetOwnership()
+	if ownershipEqual(current, target) {
+		return
+	}
+
+	update := target
+	if current.GetOwner() == target.GetOwner() {
+		update = &api.Ownership{Acls: target.GetAcls()}
+	}
+	if err := volDriver.Set(volumeID, &api.VolumeLocator{Ownership: update}, nil); err != nil {
+		log.Warnf("Failed to set ownership of restored volume %v to owner %q: %v", volumeID, target.GetOwner(), err)
+		return
+	}
+	log.Infof("Set ownership of restored volume %v to owner %q", volumeID, target.GetOwner())
+}
@@ -0,0 +1,141 @@
+package snapshot
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+func testOwnership(owner string, groups, collaborators map[string]api.Ownership_AccessType) *api.Ownership {
+	return &api.Ownership{
+		Owner: owner,
+		Acls:  &api.Ownership_AccessControl{Groups: groups, Collaborators: collaborators},
+	}
+}
+
+func TestParseOwnershipMap(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     map[string]string
+		wantOwners map[string]string
+		wantGroups map[string]string
+		wantErr    bool
+	}{
+		{name: "empty", config: map[string]string{}, wantOwners: map[string]string{}, wantGroups: map[string]string{}},
+		{
+			name:       "mapped",
+			config:     map[string]string{configRestoreOwnerMap: "alice=bob, carol=dave", configRestoreGroupMap: "dev=qa"},
+			wantOwners: map[string]string{"alice": "bob", "carol": "dave"},
+			wantGroups: map[string]string{"dev": "qa"},
+		},
+		{name: "missing target", config: map[string]string{configRestoreOwnerMap: "alice="}, wantErr: true},
+		{name: "missing pair", config: map[string]string{configRestoreGroupMap: "dev"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, err := parseOwnershipMap(test.config)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parse of %v returned error %v, want error %v", test.config, err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(m.owners, test.wantOwners) || !reflect.DeepEqual(m.groups, test.wantGroups) {
+				t.Errorf("maps are %v and %v, want %v and %v", m.owners, m.groups, test.wantOwners, test.wantGroups)
+			}
+		})
+	}
+}
+
+func TestRemapOwnership(t *testing.T) {
+	m := &ownershipMap{
+		owners: map[string]string{"alice": "bob", "carol": "dave"},
+		groups: map[string]string{"dev": "qa"},
+	}
+	source := testOwnership("alice",
+		map[string]api.Ownership_AccessType{"dev": api.Ownership_Write, "ops": api.Ownership_Read},
+		map[string]api.Ownership_AccessType{"carol": api.Ownership_Admin, "erin": api.Ownership_Read})
+	want := testOwnership("bob",
+		map[string]api.Ownership_AccessType{"qa": api.Ownership_Write, "ops": api.Ownership_Read},
+		map[string]api.Ownership_AccessType{"dave": api.Ownership_Admin, "erin": api.Ownership_Read})
+
+	if mapped := m.remap(source); !ownershipEqual(mapped, want) {
+		t.Errorf("remapped ownership is %v, want %v", mapped, want)
+	}
+	if source.Owner != "alice" {
+		t.Errorf("source ownership was modified")
+	}
+	var none *ownershipMap
+	if mapped := none.remap(source); !ownershipEqual(mapped, source) {
+		t.Errorf("ownership without map is %v, want %v", mapped, source)
+	}
+}
+
+func TestEncodeOwnership(t *testing.T) {
+	o := testOwnership("alice", map[string]api.Ownership_AccessType{"dev": api.Ownership_Write}, nil)
+	value, err := encodeOwnership(o)
+	if err != nil {
+		t.Fatalf("failed to encode ownership: %v", err)
+	}
+	decoded, err := decodeOwnership(value)
+	if err != nil {
+		t.Fatalf("failed to decode %v: %v", value, err)
+	}
+	if !ownershipEqual(decoded, o) {
+		t.Errorf("decoded ownership is %v, want %v", decoded, o)
+	}
+	if _, err := decodeOwnership("alice"); err == nil {
+		t.Errorf("invalid ownership was decoded")
+	}
+}
+
+func TestApplyOwnership(t *testing.T) {
+	groups := map[string]api.Ownership_AccessType{"dev": api.Ownership_Write}
+	tests := []struct {
+		name      string
+		current   *api.Ownership
+		ownership *api.Ownership
+		want      *api.Ownership
+	}{
+		{name: "no ownership", current: testOwnership("velero", nil, nil)},
+		{
+			name:      "same ownership",
+			current:   testOwnership("bob", map[string]api.Ownership_AccessType{"qa": api.Ownership_Write}, nil),
+			ownership: testOwnership("alice", groups, nil),
+		},
+		{
+			name:      "owner changed",
+			current:   testOwnership("velero", nil, nil),
+			ownership: testOwnership("alice", groups, nil),
+			want:      testOwnership("bob", map[string]api.Ownership_AccessType{"qa": api.Ownership_Write}, nil),
+		},
+		{
+			name:      "only ACLs changed",
+			current:   testOwnership("bob", nil, nil),
+			ownership: testOwnership("alice", groups, nil),
+			want:      &api.Ownership{Acls: &api.Ownership_AccessControl{Groups: map[string]api.Ownership_AccessType{"qa": api.Ownership_Write}}},
+		},
+	}
+
+	m := &ownershipMap{owners: map[string]string{"alice": "bob"}, groups: map[string]string{"dev": "qa"}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vol := testVolume("vol-1", "pvc-1", nil)
+			vol.Spec.Ownership = test.current
+			volDriver := newFakeVolumeDriver(vol)
+
+			m.applyOwnership(volDriver, "vol-1", test.ownership, testLogger())
+			if test.want == nil {
+				if len(volDriver.ownershipUpdates) > 0 {
+					t.Errorf("ownership was set to %v, want no update", volDriver.ownershipUpdates)
+				}
+				return
+			}
+			if len(volDriver.ownershipUpdates) != 1 || !ownershipEqual(volDriver.ownershipUpdates[0], test.want) {
+				t.Errorf("ownership updates are %v, want %v", volDriver.ownershipUpdates, test.want)
+			}
+		})
+	}
+}
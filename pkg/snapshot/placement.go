@@ -0,0 +1,142 @@
+package snapshot
+
+import (
+	"sort"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+const (
+	// configRestoreZoneMap maps the zones volumes were backed up in to the
+	// zones they are restored to, as comma separated source=target pairs.
+	// Zones that aren't mapped are preferably restored to the same zone.
+	configRestoreZoneMap = "restoreZoneMap"
+
+	// Portworx node labels with the zone and rack of nodes, recorded at
+	// backup and used to place replicas on restore
+	pxZoneLabel = "topology.portworx.io/zone"
+	pxRackLabel = "topology.portworx.io/rack"
+)
+
+// parseZoneMap parses the restore zone mapping from the plugin config
+func parseZoneMap(config map[string]string) (map[string]string, error) {
+	return parseNameMap(config, configRestoreZoneMap, "zone")
+}
+
+// replicaTopology returns the sorted zones and racks of the nodes with
+// replicas of the volume. The topology is only a placement hint for restores,
+// so it is skipped if the SDK isn't available and nodes that can't be
+// inspected are skipped.
+func replicaTopology(pxClient *portworxClient, vol *api.Volume, log logrus.FieldLogger) ([]string, []string) {
+	nodes := make(map[string]bool)
+	for _, replicaSet := range vol.ReplicaSets {
+		for _, node := range replicaSet.Nodes {
+			nodes[node] = true
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+
+	conn, err := pxClient.getSdkConnection()
+	if err != nil {
+		log.Warnf("Portworx SDK is not available, not recording topology of volume %v: %v", vol.Id, err)
+		return nil, nil
+	}
+	nodeClient := api.NewOpenStorageNodeClient(conn)
+
+	zones := make(map[string]bool)
+	racks := make(map[string]bool)
+	for nodeID := range nodes {
+		ctx, cancel := context.WithTimeout(context.Background(), sdkCallTimeout)
+		resp, err := nodeClient.Inspect(ctx, &api.SdkNodeInspectRequest{NodeId: nodeID})
+		cancel()
+		if err != nil {
+			log.Warnf("Failed to inspect node %v with replicas of volume %v: %v", nodeID, vol.Id, err)
+			continue
+		}
+		node := resp.GetNode()
+		if zone := nodeTopologyLabel(node, pxZoneLabel); zone != "" {
+			zones[zone] = true
+		}
+		if rack := nodeTopologyLabel(node, pxRackLabel); rack != "" {
+			racks[rack] = true
+		}
+	}
+	return sortedKeys(zones), sortedKeys(racks)
+}
+
+// nodeTopologyLabel returns the value of the topology label of the node. The
+// same label is matched by the placement strategy of restored volumes.
+func nodeTopologyLabel(node *api.StorageNode, key string) string {
+	if value := node.GetNodeLabels()[key]; value != "" {
+		return value
+	}
+	return node.GetSchedulerTopology().GetLabels()[key]
+}
+
+func sortedKeys(m map[string]bool) []string {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// restorePlacement returns the placement strategy that places the replicas of
+// a restored volume in the given zones, after mapping them, and preferably in
+// the given racks. The zones are only required if they were chosen for the
+// restore, and preferred otherwise since the target cluster may not have the
+// zones of the source cluster. Racks are ignored when a zone is remapped since
+// they belong to the source cluster. Nil is returned if there are no zones or
+// racks.
+func restorePlacement(zones, racks []string, zoneMap map[string]string, zonesRequired bool) *api.VolumePlacementStrategy {
+	var targetZones []string
+	remapped := false
+	for _, zone := range zones {
+		if target, ok := zoneMap[zone]; ok {
+			remapped = remapped || target != zone
+			zone = target
+		}
+		targetZones = append(targetZones, zone)
+	}
+	if remapped {
+		racks = nil
+	}
+
+	placement := &api.VolumePlacementStrategy{}
+	if len(targetZones) > 0 {
+		enforcement := api.EnforcementType_preferred
+		if zonesRequired || remapped {
+			enforcement = api.EnforcementType_required
+		}
+		placement.ReplicaAffinity = append(placement.ReplicaAffinity, &api.ReplicaPlacementSpec{
+			Enforcement: enforcement,
+			MatchExpressions: []*api.LabelSelectorRequirement{{
+				Key:      pxZoneLabel,
+				Operator: api.LabelSelectorRequirement_In,
+				Values:   targetZones,
+			}},
+		})
+	}
+	if len(racks) > 0 {
+		placement.ReplicaAffinity = append(placement.ReplicaAffinity, &api.ReplicaPlacementSpec{
+			Enforcement: api.EnforcementType_preferred,
+			MatchExpressions: []*api.LabelSelectorRequirement{{
+				Key:      pxRackLabel,
+				Operator: api.LabelSelectorRequirement_In,
+				Values:   racks,
+			}},
+		})
+	}
+	if len(placement.ReplicaAffinity) == 0 {
+		return nil
+	}
+	return placement
+}
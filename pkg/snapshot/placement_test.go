@@ -0,0 +1,44 @@
+package snapshot
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+func TestReplicaTopology(t *testing.T) {
+	endpoint := startFakeSDK(t, nil, map[string]*api.StorageNode{
+		"node-1": {Id: "node-1", NodeLabels: map[string]string{pxZoneLabel: "zone-a", pxRackLabel: "rack-1"}},
+		"node-2": {
+			Id:                "node-2",
+			SchedulerTopology: &api.SchedulerTopology{Labels: map[string]string{pxZoneLabel: "zone-b"}},
+		},
+		"node-3": {Id: "node-3", NodeLabels: map[string]string{pxZoneLabel: "zone-a", pxRackLabel: "rack-1"}},
+	})
+	vol := testVolume("vol-1", "pvc-1", nil)
+	vol.ReplicaSets = []*api.ReplicaSet{
+		{Nodes: []string{"node-1", "node-2"}},
+		{Nodes: []string{"node-3", "node-gone"}},
+	}
+
+	pxClient := sdkTestClient(t, endpoint)
+	zones, racks := replicaTopology(pxClient, vol, testLogger())
+	if want := []string{"zone-a", "zone-b"}; !reflect.DeepEqual(zones, want) {
+		t.Errorf("zones are %v, want %v", zones, want)
+	}
+	if want := []string{"rack-1"}; !reflect.DeepEqual(racks, want) {
+		t.Errorf("racks are %v, want %v", racks, want)
+	}
+
+	// The SDK isn't dialled when it was found unavailable
+	pxClient = testClient(newFakeVolumeDriver(), nil)
+	pxClient.sdkConn.endpoint = endpoint
+	zones, racks = replicaTopology(pxClient, vol, testLogger())
+	if zones != nil || racks != nil {
+		t.Errorf("topology is %v and %v without the SDK, want none", zones, racks)
+	}
+	if pxClient.sdkConn.conn != nil {
+		t.Errorf("SDK was dialled while unavailable")
+	}
+}
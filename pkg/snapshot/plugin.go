@@ -5,11 +5,14 @@ import (
 	"os"
 	"fmt"
 	apiclient "github.com/libopenstorage/openstorage/api/client"
-	"github.com/libopenstorage/openstorage/pkg/auth"
-	"github.com/libopenstorage/openstorage/volume/drivers/pwx"
+	"github.com/libopenstorage/openstorage/pkg/grpcserver"
 	lsecrets "github.com/libopenstorage/secrets"
-	k8s_secrets "github.com/libopenstorage/secrets/k8s"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+	"github.com/libopenstorage/openstorage/api"
+	"golang.org/x/net/context"
+	"sync"
 	"time"
 
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
@@ -40,8 +43,26 @@ const (
 
 	typeLocal = "local"
 	typeCloud = "cloud"
+	typeHybrid = "hybrid"
 	pxDriverName = "pxd"
 	uniqueID = "velero-portworx-plugin"
+
+	// veleroBackupTag is the tag set by Velero with the name of the backup
+	veleroBackupTag = "velero.io/backup"
+	// veleroPVTag is the tag set by Velero with the name of the PV
+	veleroPVTag = "velero.io/pv"
+
+	veleroNamespaceEnv     = "VELERO_NAMESPACE"
+	defaultVeleroNamespace = "velero"
+
+	// sdkRecheckInterval is the time after which a cluster whose SDK didn't
+	// answer is checked again
+	sdkRecheckInterval = 5 * time.Minute
+	// Keepalive pings detect broken SDK connections while calls are in
+	// flight. The interval stays at the minimum the SDK server permits so
+	// it doesn't close the connection for pinging too often.
+	sdkKeepaliveTime    = 5 * time.Minute
+	sdkKeepaliveTimeout = 10 * time.Second
 )
 
 // Plugin for managing Portworx snapshots
@@ -49,12 +70,20 @@ type Plugin struct {
 	Log    logrus.FieldLogger
 	plugin velero.VolumeSnapshotter
 	pxClient *portworxClient
+	fsck *fsckConfig
+	pvSource string
+	csiDrivers []string
 }
 
 type portworxGrpcConnection struct {
 	conn        *grpc.ClientConn
 	dialOptions []grpc.DialOption
 	endpoint    string
+	lock        sync.Mutex
+	// sdkAvailable is set once the SDK has answered, and sdkCheckedAt is
+	// the time it last failed to
+	sdkAvailable bool
+	sdkCheckedAt time.Time
 }
 
 type portworxClient struct {
@@ -64,6 +93,21 @@ type portworxClient struct {
 	pxEndpoint string
 	sdkConn         *portworxGrpcConnection
 	tlsConfig       *tls.Config
+	tokens          *tokenManager
+	tenants         *tenantConfig
+	// kubeOps is the client of the Kubernetes cluster running Portworx
+	kubeOps core.Ops
+	// secrets is the provider the cloud credential Secret is read with
+	secrets lsecrets.Secrets
+	retries *retryPolicy
+
+	restLock   sync.Mutex
+	restDriver volume.VolumeDriver
+	// restToken is the token restDriver authenticates with
+	restToken string
+	// tenantRestDrivers are the REST drivers authenticating with tenant
+	// tokens, by token
+	tenantRestDrivers map[string]volume.VolumeDriver
 }
 
 // Init the plugin
@@ -77,10 +121,12 @@ func (p *Plugin) Init(config map[string]string) error {
 		p.pxClient.namespace = defaultNamespace
 	}
 
-	if err := os.Setenv(pxNamespaceKey, p.pxClient.namespace); err != nil {
-		p.Log.Errorf("Failed to set Portworx namespace: %v", err)
-	} else {
-		p.Log.Infof("Using namespace: %v", p.pxClient.namespace)
+	p.Log.Infof("Using namespace: %v", p.pxClient.namespace)
+
+	endpoint, err := parseEndpointConfig(config, p.pxClient.namespace, p.Log)
+	if err != nil {
+		p.Log.Errorf("%v", err)
+		return err
 	}
 	if pxSharedSecret, ok := config[pxSharedSecretKey]; ok && len(pxSharedSecret) > 0 {
 		p.pxClient.jwtSharedSecret = pxSharedSecret
@@ -89,17 +135,70 @@ func (p *Plugin) Init(config map[string]string) error {
 	if pxJwtIssuer, ok := config[pxJwtIssuerKey]; ok && len(pxJwtIssuer) > 0 {
 		p.pxClient.jwtIssuer = pxJwtIssuer
 	}
+
+	tokens, err := newTokenManager(config, p.pxClient.jwtSharedSecret, p.pxClient.jwtIssuer)
+	if err != nil {
+		p.Log.Errorf("%v", err)
+		return err
+	}
+	p.pxClient.tokens = tokens
+	if p.pxClient.tenants, err = parseTenantConfig(config); err != nil {
+		p.Log.Errorf("%v", err)
+		return err
+	}
+	if p.pxClient.retries, err = parseRetryPolicy(config); err != nil {
+		p.Log.Errorf("%v", err)
+		return err
+	}
+	p.pxClient.restDriver = nil
+	p.pxClient.tenantRestDrivers = nil
+	if p.pxClient.kubeOps, err = clusterKubeOps(config); err != nil {
+		p.Log.Errorf("%v", err)
+		return err
+	}
 	p.Log.Infof("Initializing portworx client")
-	if err := p.pxClient.initPortworxClients(); err != nil {
+	if err := p.pxClient.initPortworxClients(endpoint); err != nil {
 		p.Log.Errorf("Failed to init portworx clients: %v", err)
 		return err
 	}
+	if err := p.pxClient.checkClusterHealth(config[configRemoteKubeconfigSecret] != ""); err != nil {
+		p.Log.Errorf("%v", err)
+		return err
+	}
 	p.Log.Infof("Init'ing portworx plugin with config %v", config)
 
+	overrides, err := parseRestoreOverrides(config)
+	if err != nil {
+		p.Log.Errorf("%v", err)
+		return err
+	}
+
+	if p.fsck, err = parseFsckConfig(config); err != nil {
+		p.Log.Errorf("%v", err)
+		return err
+	}
+
+	if p.pvSource, err = parsePVSource(config); err != nil {
+		p.Log.Errorf("%v", err)
+		return err
+	}
+
+	if p.csiDrivers, err = parseCSIDrivers(config); err != nil {
+		p.Log.Errorf("%v", err)
+		return err
+	}
+
 	if snapType, ok := config[configTypeKey]; !ok || snapType == typeLocal {
-		p.plugin = &localSnapshotPlugin{log: p.Log, pxClient: p.pxClient}
+		p.plugin = &localSnapshotPlugin{log: p.Log, pxClient: p.pxClient, overrides: overrides}
 	} else if snapType == typeCloud {
-		p.plugin = &cloudSnapshotPlugin{log: p.Log, pxClient: p.pxClient}
+		p.plugin = &cloudSnapshotPlugin{log: p.Log, pxClient: p.pxClient, overrides: overrides}
+	} else if snapType == typeHybrid {
+		p.plugin = &hybridSnapshotPlugin{
+			log:      p.Log,
+			pxClient: p.pxClient,
+			local:    &localSnapshotPlugin{log: p.Log, pxClient: p.pxClient, overrides: overrides},
+			cloud:    &cloudSnapshotPlugin{log: p.Log, pxClient: p.pxClient, overrides: overrides},
+		}
 	} else {
 		err := fmt.Errorf("Snapshot type %v not supported", snapType)
 		p.Log.Errorf("%v", err)
@@ -111,7 +210,15 @@ func (p *Plugin) Init(config map[string]string) error {
 
 // CreateVolumeFromSnapshot Create a volume form given snapshot
 func (p *Plugin) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (string, error) {
-	return p.plugin.CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ, iops)
+	volumeID, err := p.plugin.CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ, iops)
+	if err != nil {
+		return "", err
+	}
+
+	if err := p.fsck.checkRestoredVolume(p.pxClient, volumeID, p.Log); err != nil {
+		return "", err
+	}
+	return volumeID, nil
 }
 
 // GetVolumeInfo Get information about the volume
@@ -137,10 +244,11 @@ func (p *Plugin) GetVolumeID(unstructuredPV runtime.Unstructured) (string, error
 	}
 	if pv.Spec.CSI != nil {
 		driver := pv.Spec.CSI.Driver
-		if driver == pxdDriverName {
+		if isPortworxCSIDriver(p.csiDrivers, driver) {
 			return pv.Spec.CSI.VolumeHandle, nil
 		}
-		logrus.Infof("Unable to handle CSI driver: %s", driver)
+		logrus.Infof("Unable to handle CSI driver %s of PV %s, add it to %s if it is backed by Portworx",
+			driver, pv.Name, configCSIDrivers)
 	}
 
 	if pv.Spec.PortworxVolume != nil {
@@ -153,6 +261,60 @@ func (p *Plugin) GetVolumeID(unstructuredPV runtime.Unstructured) (string, error
 	return "", nil
 }
 
+// portworxVolumeID returns the Portworx volume ID of the PV, or an empty
+// string if it isn't a Portworx volume
+func portworxVolumeID(pv *v1.PersistentVolume, csiDrivers []string) string {
+	if pv.Spec.CSI != nil && isPortworxCSIDriver(csiDrivers, pv.Spec.CSI.Driver) {
+		return pv.Spec.CSI.VolumeHandle
+	}
+	if pv.Spec.PortworxVolume != nil {
+		return pv.Spec.PortworxVolume.VolumeID
+	}
+	return ""
+}
+
+// defaultCSIDriver returns the CSI driver used for PVs converted to CSI
+func (p *Plugin) defaultCSIDriver() string {
+	if len(p.csiDrivers) == 0 {
+		return pxdDriverName
+	}
+	return p.csiDrivers[0]
+}
+
+// restoreCSIDriver sets the CSI driver of the restored PV to the driver
+// recorded when the volume was backed up, if it is one of the Portworx CSI
+// drivers. The volume is inspected as the tenant owning it.
+func (p *Plugin) restoreCSIDriver(pv *v1.PersistentVolume, volumeID string) {
+	volDriver, err := p.pxClient.getVolumeDriverForVolume(volumeID, p.Log)
+	if err != nil {
+		p.Log.Warnf("Failed to get CSI driver recorded for volume %v: %v", volumeID, err)
+		return
+	}
+	driver, err := recordedCSIDriver(volDriver, volumeID)
+	if err != nil {
+		p.Log.Warnf("Failed to get CSI driver recorded for volume %v: %v", volumeID, err)
+		return
+	}
+	if driver == "" || driver == pv.Spec.CSI.Driver {
+		return
+	}
+	if !isPortworxCSIDriver(p.csiDrivers, driver) {
+		p.Log.Warnf("CSI driver %v recorded for volume %v is not in %v, keeping %v",
+			driver, volumeID, configCSIDrivers, pv.Spec.CSI.Driver)
+		return
+	}
+	p.Log.Infof("Restoring PV %v with CSI driver %v", pv.Name, driver)
+	pv.Spec.CSI.Driver = driver
+}
+
+// veleroNamespace returns the namespace Velero is running in
+func veleroNamespace() string {
+	if namespace := os.Getenv(veleroNamespaceEnv); namespace != "" {
+		return namespace
+	}
+	return defaultVeleroNamespace
+}
+
 // SetVolumeID Set the volume ID in the spec
 func (p *Plugin) SetVolumeID(unstructuredPV runtime.Unstructured, volumeID string) (runtime.Unstructured, error) {
 	pv := new(v1.PersistentVolume)
@@ -162,7 +324,7 @@ func (p *Plugin) SetVolumeID(unstructuredPV runtime.Unstructured, volumeID strin
 	if pv.Spec.CSI != nil {
 		// PV is provisioned by CSI driver
 		driver := pv.Spec.CSI.Driver
-		if driver == pxdDriverName {
+		if isPortworxCSIDriver(p.csiDrivers, driver) {
 			pv.Spec.CSI.VolumeHandle = volumeID
 		} else {
 			return nil, fmt.Errorf("unable to handle CSI driver: %s", driver)
@@ -175,6 +337,23 @@ func (p *Plugin) SetVolumeID(unstructuredPV runtime.Unstructured, volumeID strin
 		return nil, errors.New("spec.csi and spec.portworxVolume not found")
 	}
 
+	if p.pvSource == pvSourceCSI && pv.Spec.PortworxVolume != nil {
+		if err := convertToCSI(pv, p.defaultCSIDriver()); err != nil {
+			return nil, err
+		}
+		p.Log.Infof("Converted PV %v to a CSI PV", pv.Name)
+	} else if p.pvSource == pvSourceInTree && pv.Spec.CSI != nil {
+		if err := convertToInTree(pv); err != nil {
+			return nil, err
+		}
+		pv.Name = volumeID
+		p.Log.Infof("Converted PV %v to an in-tree portworxVolume PV", pv.Name)
+	}
+
+	if pv.Spec.CSI != nil {
+		p.restoreCSIDriver(pv, volumeID)
+	}
+
 	res, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -183,52 +362,102 @@ func (p *Plugin) SetVolumeID(unstructuredPV runtime.Unstructured, volumeID strin
 	return &unstructured.Unstructured{Object: res}, nil
 }
 
+// getVolumeDriver returns the volume driver to make Portworx calls with. It
+// uses the SDK when the cluster supports it and REST otherwise. Transient
+// failures of the calls are retried.
 func (p *portworxClient) getVolumeDriver() (volume.VolumeDriver, error) {
-	if len(p.jwtSharedSecret) != 0 {
-		claims := &auth.Claims{
-			Issuer: p.jwtIssuer,
-			Name:   "Stork",
+	var driver volume.VolumeDriver
+	err := p.retries.do(opConnect, true, func() (err error) {
+		driver, err = p.newVolumeDriver()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &retryVolumeDriver{VolumeDriver: driver, retries: p.retries}, nil
+}
 
-			// Unique id for stork
-			// this id must be unique across all accounts accessing the px system
-			Subject: p.jwtIssuer + "." + uniqueID,
+func (p *portworxClient) newVolumeDriver() (volume.VolumeDriver, error) {
+	rest, err := p.getRestVolumeDriver()
+	if err != nil {
+		return nil, err
+	}
 
-			// Only allow certain calls
-			Roles: []string{"system.user"},
+	conn, err := p.getSdkConnection()
+	if err != nil {
+		return rest, nil
+	}
+	return newSdkVolumeDriver(conn, rest), nil
+}
 
-			// Be in all groups to have access to all resources
-			Groups: []string{"*"},
-		}
+// getSdkConnection returns the connection to the Portworx SDK if it is
+// available. The SDK is checked again when the connection fails after it was
+// available, and calls fall back to REST if it doesn't answer. Clusters that
+// don't answer are checked again after sdkRecheckInterval.
+func (p *portworxClient) getSdkConnection() (*grpc.ClientConn, error) {
+	p.sdkConn.lock.Lock()
+	if !p.sdkConn.sdkAvailable && time.Since(p.sdkConn.sdkCheckedAt) < sdkRecheckInterval {
+		p.sdkConn.lock.Unlock()
+		return nil, fmt.Errorf("Portworx SDK is not available")
+	}
+	available := p.sdkConn.sdkAvailable
+	p.sdkConn.lock.Unlock()
+
+	conn, err := p.getGrpcConnection()
+	if err == nil && (!available || !sdkConnectionHealthy(conn)) {
+		ctx, cancel := context.WithTimeout(context.Background(), sdkCallTimeout)
+		defer cancel()
+		_, err = api.NewOpenStorageIdentityClient(conn).Version(ctx, &api.SdkIdentityVersionRequest{})
+	}
 
-		// This never returns an error, but just in case, check the value
-		signature, err := auth.NewSignatureSharedSecret(p.jwtSharedSecret)
-		if err != nil {
-			return nil, err
-		}
+	p.sdkConn.lock.Lock()
+	defer p.sdkConn.lock.Unlock()
+	if err != nil {
+		logrus.Warnf("Portworx SDK is not available at %v, using REST: %v", p.sdkConn.endpoint, err)
+		p.sdkConn.sdkAvailable = false
+		p.sdkConn.sdkCheckedAt = time.Now()
+		return nil, err
+	}
+	p.sdkConn.sdkAvailable = true
+	return conn, nil
+}
 
-		// Set the token expiration
-		options := &auth.Options{
-			Expiration:  time.Now().Add(time.Hour).Unix(),
-			IATSubtract: 1 * time.Minute,
-		}
+// sdkConnectionHealthy returns false if the connection to the SDK failed or
+// was closed
+func sdkConnectionHealthy(conn *grpc.ClientConn) bool {
+	switch conn.GetState() {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		return false
+	}
+	return true
+}
 
-		token, err := auth.Token(claims, signature, options)
-		if err != nil {
-			return nil, err
-		}
+// getRestVolumeDriver returns the REST volume driver. The driver is reused
+// until the token it authenticates with is refreshed.
+func (p *portworxClient) getRestVolumeDriver() (volume.VolumeDriver, error) {
+	token, err := p.tokens.getToken()
+	if err != nil {
+		return nil, err
+	}
 
-		clnt, err := p.getRestClientWithAuth(token)
-		if err != nil {
-			return nil, err
-		}
-		return volumeclient.VolumeDriver(clnt), nil
+	p.restLock.Lock()
+	defer p.restLock.Unlock()
+	if p.restDriver != nil && p.restToken == token {
+		return p.restDriver, nil
 	}
 
-	clnt, err := p.getRestClient()
+	var clnt *apiclient.Client
+	if token != "" {
+		clnt, err = p.getRestClientWithAuth(token)
+	} else {
+		clnt, err = p.getRestClient()
+	}
 	if err != nil {
 		return nil, err
 	}
-	return volumeclient.VolumeDriver(clnt), nil
+	p.restDriver = volumeclient.VolumeDriver(clnt)
+	p.restToken = token
+	return p.restDriver, nil
 }
 
 func (p *portworxClient) getRestClientWithAuth(token string) (*apiclient.Client, error) {
@@ -247,95 +476,84 @@ func (p *portworxClient) getRestClient() (*apiclient.Client, error) {
 	return restClient, err
 }
 
-func (p *portworxClient) initPortworxClients() error {
-	kubeOps := core.Instance()
-
-	pbc := pwx.NewConnectionParamsBuilderDefaultConfig()
-
-	if len(p.jwtSharedSecret) > 0 {
-		pbc.AuthTokenGenerator = p.tokenGenerator
-		pbc.AuthEnabled = true
+// getGrpcConnection returns the connection to the Portworx SDK, connecting
+// to it on first use
+func (p *portworxClient) getGrpcConnection() (*grpc.ClientConn, error) {
+	p.sdkConn.lock.Lock()
+	defer p.sdkConn.lock.Unlock()
+
+	if p.sdkConn.conn == nil {
+		// Copy the options so that the ones of the connection aren't
+		// modified by the append
+		dialOptions := make([]grpc.DialOption, 0, len(p.sdkConn.dialOptions)+1)
+		dialOptions = append(dialOptions, p.sdkConn.dialOptions...)
+		dialOptions = append(dialOptions, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    sdkKeepaliveTime,
+			Timeout: sdkKeepaliveTimeout,
+		}))
+		conn, err := grpcserver.Connect(p.sdkConn.endpoint, dialOptions)
+		if err != nil {
+			return nil, err
+		}
+		p.sdkConn.conn = conn
 	}
+	return p.sdkConn.conn, nil
+}
 
-	paramsBuilder, err := pwx.NewConnectionParamsBuilder(kubeOps, pbc)
-	if err != nil {
-		return err
+// setSdkConnection replaces the SDK connection with one to the endpoint,
+// closing the connection set up by a previous Init
+func (p *portworxClient) setSdkConnection(endpoint string, dialOptions []grpc.DialOption) {
+	if old := p.sdkConn; old != nil {
+		old.lock.Lock()
+		if old.conn != nil {
+			if err := old.conn.Close(); err != nil {
+				logrus.Warnf("Failed to close connection to %v: %v", old.endpoint, err)
+			}
+			old.conn = nil
+		}
+		old.lock.Unlock()
+	}
+	p.sdkConn = &portworxGrpcConnection{
+		endpoint:    endpoint,
+		dialOptions: dialOptions,
 	}
+}
 
-	pxMgmtEndpoint, sdkEndpoint, err := paramsBuilder.BuildClientsEndpoints()
+// initPortworxClients sets up the connections to Portworx from the endpoint
+// configuration of the plugin instance
+func (p *portworxClient) initPortworxClients(endpoint *endpointConfig) error {
+	pxMgmtEndpoint, sdkEndpoint, err := endpoint.endpoints(p.kubeOps)
 	if err != nil {
 		return err
 	}
+	logrus.Infof("Using %v as endpoint for portworx REST API and %v for gRPC API", pxMgmtEndpoint, sdkEndpoint)
 
 	p.pxEndpoint = pxMgmtEndpoint
-	p.tlsConfig, err = paramsBuilder.BuildTlsConfig()
+	p.tlsConfig, err = endpoint.tlsConfig(p.kubeOps)
 	if err != nil {
 		return err
 	}
+	sdkDialOps := dialOptions(p.tlsConfig)
 
-	sdkDialOps, err := paramsBuilder.BuildDialOps()
-	if err != nil {
-		return err
-	}
+	// SDK calls authenticate with the tenant token of the call, if any, and
+	// the plugin token otherwise. With no token the openstorage API clients
+	// are bootstrapped with no authorization.
+	sdkDialOps = append(sdkDialOps, grpc.WithPerRPCCredentials(&tokenCredentials{
+		tokens: p.tokens,
+		secure: p.tlsConfig != nil,
+	}))
 
 	// Setup gRPC clients
-	p.sdkConn = &portworxGrpcConnection{
-		endpoint:    sdkEndpoint,
-		dialOptions: sdkDialOps,
-	}
+	p.setSdkConnection(sdkEndpoint, sdkDialOps)
 
-	// Setup secrets instance
-	k8sSecrets, err := k8s_secrets.New(nil)
-	if err != nil {
-		return fmt.Errorf("failed to initialize secrets provider: %v", err)
-	}
+	// Setup secrets instance, reading the Secrets of the cluster running
+	// Portworx
+	k8sSecrets := newKubeSecrets(p.kubeOps)
 	err = lsecrets.SetInstance(k8sSecrets)
 	if err != nil {
 		return fmt.Errorf("failed to set secrets provider: %v", err)
 	}
+	p.secrets = k8sSecrets
 
 	return err
 }
-
-// 	tokenGenerator generates authorization token for system.admin
-//	when shared secret is not configured authz token is empty string
-//	this let openstorage API clients be bootstrapped with no authorization (by accepting empty token)
-func (p *portworxClient) tokenGenerator() (string, error) {
-	if len(p.jwtSharedSecret) == 0 {
-		return "", nil
-	}
-
-	claims := &auth.Claims{
-		Issuer: p.jwtIssuer,
-		Name:   "Stork",
-
-		// Unique id for stork
-		// this id must be unique across all accounts accessing the px system
-		Subject: p.jwtIssuer + "." + uniqueID,
-
-		// Only allow certain calls
-		Roles: []string{"system.admin"},
-
-		// Be in all groups to have access to all resources
-		Groups: []string{"*"},
-	}
-
-	// This never returns an error, but just in case, check the value
-	signature, err := auth.NewSignatureSharedSecret(p.jwtSharedSecret)
-	if err != nil {
-		return "", err
-	}
-
-	// Set the token expiration
-	options := &auth.Options{
-		Expiration:  time.Now().Add(time.Hour * 1).Unix(),
-		IATSubtract: 1 * time.Minute,
-	}
-
-	token, err := auth.Token(claims, signature, options)
-	if err != nil {
-		return "", err
-	}
-
-	return token, nil
-}
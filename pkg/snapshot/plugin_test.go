@@ -0,0 +1,76 @@
+package snapshot
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+func TestSetSdkConnection(t *testing.T) {
+	endpoint := startFakeSDK(t, nil, nil)
+	pxClient := sdkTestClient(t, endpoint)
+	conn, err := pxClient.getSdkConnection()
+	if err != nil {
+		t.Fatalf("failed to connect to the SDK: %v", err)
+	}
+
+	// A re-Init closes the connection of the previous one
+	pxClient.setSdkConnection(endpoint, []grpc.DialOption{grpc.WithInsecure()})
+	if state := conn.GetState(); state != connectivity.Shutdown {
+		t.Errorf("previous connection is %v, want %v", state, connectivity.Shutdown)
+	}
+	newConn, err := pxClient.getSdkConnection()
+	if err != nil {
+		t.Fatalf("failed to connect to the SDK again: %v", err)
+	}
+	if newConn == conn {
+		t.Errorf("previous connection was reused")
+	}
+}
+
+func TestGetGrpcConnectionDialOptions(t *testing.T) {
+	endpoint := startFakeSDK(t, nil, nil)
+	// Spare capacity lets an append write past the options of the connection
+	dialOptions := make([]grpc.DialOption, 1, 2)
+	dialOptions[0] = grpc.WithInsecure()
+	pxClient := sdkTestClient(t, endpoint)
+	pxClient.sdkConn.dialOptions = dialOptions
+
+	if _, err := pxClient.getGrpcConnection(); err != nil {
+		t.Fatalf("failed to connect to the SDK: %v", err)
+	}
+	if len(pxClient.sdkConn.dialOptions) != 1 || dialOptions[:2][1] != nil {
+		t.Errorf("dial options of the connection were modified")
+	}
+}
+
+func TestGetSdkConnectionUnavailable(t *testing.T) {
+	// Nothing listens on the port once the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	endpoint := listener.Addr().String()
+	listener.Close()
+	pxClient := sdkTestClient(t, endpoint)
+	pxClient.sdkConn.dialOptions = append(pxClient.sdkConn.dialOptions, grpc.WithTimeout(100*time.Millisecond))
+
+	if _, err := pxClient.getSdkConnection(); err == nil {
+		t.Fatalf("connected to an SDK that isn't running")
+	}
+	if pxClient.sdkConn.sdkAvailable || pxClient.sdkConn.sdkCheckedAt.IsZero() {
+		t.Errorf("SDK is available %v, checked at %v, want unavailable", pxClient.sdkConn.sdkAvailable, pxClient.sdkConn.sdkCheckedAt)
+	}
+
+	// The SDK isn't dialled again until the recheck interval expires
+	start := time.Now()
+	if _, err := pxClient.getSdkConnection(); err == nil {
+		t.Fatalf("connected to an SDK that isn't running")
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("SDK was dialled again after %v", elapsed)
+	}
+}
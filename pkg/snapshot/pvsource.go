@@ -0,0 +1,94 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// configRestorePVSource converts the source of restored PVs to the
+	// given type. By default PVs are restored with the source they had.
+	configRestorePVSource = "restorePVSource"
+
+	// pvSourceCSI restores PVs as CSI PVs using the Portworx CSI driver
+	pvSourceCSI = "csi"
+	// pvSourceInTree restores PVs as in-tree portworxVolume PVs
+	pvSourceInTree = "intree"
+
+	// inTreeProvisionerName is the provisioner of in-tree Portworx PVs
+	inTreeProvisionerName = "kubernetes.io/portworx-volume"
+	// provisionedByAnnotation is set by Kubernetes on dynamically
+	// provisioned PVs with the name of the provisioner
+	provisionedByAnnotation = "pv.kubernetes.io/provisioned-by"
+	// csiVolumeAttributesAnnotation keeps the volume attributes of CSI PVs
+	// converted to in-tree PVs so they can be converted back
+	csiVolumeAttributesAnnotation = "portworx.io/csi-volume-attributes"
+)
+
+// parsePVSource parses the PV source to restore PVs with from the plugin
+// config
+func parsePVSource(config map[string]string) (string, error) {
+	switch source := config[configRestorePVSource]; source {
+	case "", pvSourceCSI, pvSourceInTree:
+		return source, nil
+	default:
+		return "", fmt.Errorf("invalid %v %q, must be %v or %v",
+			configRestorePVSource, source, pvSourceCSI, pvSourceInTree)
+	}
+}
+
+// convertToCSI replaces the in-tree Portworx source of the PV with a CSI
+// source for the given Portworx CSI driver
+func convertToCSI(pv *v1.PersistentVolume, driver string) error {
+	inTree := pv.Spec.PortworxVolume
+	attributes := make(map[string]string)
+	if value, ok := pv.Annotations[csiVolumeAttributesAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &attributes); err != nil {
+			return fmt.Errorf("invalid %v annotation on PV %v: %v", csiVolumeAttributesAnnotation, pv.Name, err)
+		}
+		delete(pv.Annotations, csiVolumeAttributesAnnotation)
+	}
+
+	pv.Spec.PortworxVolume = nil
+	pv.Spec.CSI = &v1.CSIPersistentVolumeSource{
+		Driver:           driver,
+		VolumeHandle:     inTree.VolumeID,
+		FSType:           inTree.FSType,
+		ReadOnly:         inTree.ReadOnly,
+		VolumeAttributes: attributes,
+	}
+	if _, ok := pv.Annotations[provisionedByAnnotation]; ok {
+		pv.Annotations[provisionedByAnnotation] = driver
+	}
+	return nil
+}
+
+// convertToInTree replaces the CSI source of the PV with an in-tree Portworx
+// source. The CSI volume attributes, which in-tree PVs don't have, are kept
+// in an annotation.
+func convertToInTree(pv *v1.PersistentVolume) error {
+	csi := pv.Spec.CSI
+	if len(csi.VolumeAttributes) > 0 {
+		value, err := json.Marshal(csi.VolumeAttributes)
+		if err != nil {
+			return err
+		}
+		if pv.Annotations == nil {
+			pv.Annotations = make(map[string]string)
+		}
+		pv.Annotations[csiVolumeAttributesAnnotation] = string(value)
+	}
+
+	pv.Spec.CSI = nil
+	pv.Spec.PortworxVolume = &v1.PortworxVolumeSource{
+		VolumeID: csi.VolumeHandle,
+		FSType:   csi.FSType,
+		ReadOnly: csi.ReadOnly,
+	}
+	if _, ok := pv.Annotations[provisionedByAnnotation]; ok {
+		pv.Annotations[provisionedByAnnotation] = inTreeProvisionerName
+	}
+	return nil
+}
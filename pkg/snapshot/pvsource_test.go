@@ -0,0 +1,158 @@
+package snapshot
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testCSIDriver = "pxd.portworx.com"
+
+func inTreePV(annotations map[string]string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234", Annotations: annotations},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				PortworxVolume: &v1.PortworxVolumeSource{VolumeID: "1234", FSType: "ext4", ReadOnly: true},
+			},
+		},
+	}
+}
+
+func csiPV(annotations, attributes map[string]string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1234", Annotations: annotations},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:           testCSIDriver,
+					VolumeHandle:     "1234",
+					FSType:           "ext4",
+					ReadOnly:         true,
+					VolumeAttributes: attributes,
+				},
+			},
+		},
+	}
+}
+
+func TestParsePVSource(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "", want: ""},
+		{value: pvSourceCSI, want: pvSourceCSI},
+		{value: pvSourceInTree, want: pvSourceInTree},
+		{value: "flexvolume", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			source, err := parsePVSource(map[string]string{configRestorePVSource: test.value})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parse of %q returned error %v, want error %v", test.value, err, test.wantErr)
+			}
+			if source != test.want {
+				t.Errorf("PV source is %q, want %q", source, test.want)
+			}
+		})
+	}
+}
+
+func TestConvertToCSI(t *testing.T) {
+	tests := []struct {
+		name string
+		pv   *v1.PersistentVolume
+		want *v1.PersistentVolume
+	}{
+		{
+			name: "static PV",
+			pv:   inTreePV(nil),
+			want: csiPV(nil, map[string]string{}),
+		},
+		{
+			name: "provisioned PV",
+			pv:   inTreePV(map[string]string{provisionedByAnnotation: inTreeProvisionerName}),
+			want: csiPV(map[string]string{provisionedByAnnotation: testCSIDriver}, map[string]string{}),
+		},
+		{
+			name: "PV converted from CSI",
+			pv: inTreePV(map[string]string{
+				provisionedByAnnotation:       inTreeProvisionerName,
+				csiVolumeAttributesAnnotation: `{"repl":"3"}`,
+			}),
+			want: csiPV(map[string]string{provisionedByAnnotation: testCSIDriver}, map[string]string{"repl": "3"}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := convertToCSI(test.pv, testCSIDriver); err != nil {
+				t.Fatalf("conversion failed: %v", err)
+			}
+			if !reflect.DeepEqual(test.pv, test.want) {
+				t.Errorf("PV is %+v, want %+v", test.pv, test.want)
+			}
+		})
+	}
+}
+
+func TestConvertToCSIInvalidAttributes(t *testing.T) {
+	pv := inTreePV(map[string]string{csiVolumeAttributesAnnotation: "repl=3"})
+	if err := convertToCSI(pv, testCSIDriver); err == nil {
+		t.Errorf("conversion succeeded, want an error")
+	}
+}
+
+func TestConvertToInTree(t *testing.T) {
+	tests := []struct {
+		name string
+		pv   *v1.PersistentVolume
+		want *v1.PersistentVolume
+	}{
+		{
+			name: "static PV",
+			pv:   csiPV(nil, nil),
+			want: inTreePV(nil),
+		},
+		{
+			name: "provisioned PV with attributes",
+			pv:   csiPV(map[string]string{provisionedByAnnotation: testCSIDriver}, map[string]string{"repl": "3"}),
+			want: inTreePV(map[string]string{
+				provisionedByAnnotation:       inTreeProvisionerName,
+				csiVolumeAttributesAnnotation: `{"repl":"3"}`,
+			}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := convertToInTree(test.pv); err != nil {
+				t.Fatalf("conversion failed: %v", err)
+			}
+			if !reflect.DeepEqual(test.pv, test.want) {
+				t.Errorf("PV is %+v, want %+v", test.pv, test.want)
+			}
+		})
+	}
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	attributes := map[string]string{"repl": "3", "io_profile": "db"}
+	pv := csiPV(map[string]string{provisionedByAnnotation: testCSIDriver}, attributes)
+
+	if err := convertToInTree(pv); err != nil {
+		t.Fatalf("conversion to in-tree failed: %v", err)
+	}
+	if err := convertToCSI(pv, testCSIDriver); err != nil {
+		t.Fatalf("conversion to CSI failed: %v", err)
+	}
+	want := csiPV(map[string]string{provisionedByAnnotation: testCSIDriver}, attributes)
+	if !reflect.DeepEqual(pv, want) {
+		t.Errorf("PV is %+v, want %+v", pv, want)
+	}
+}
@@ -0,0 +1,93 @@
+package snapshot
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/libopenstorage/openstorage/volume"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// configQuiesce enables quiescing volumes before they are snapshotted
+	configQuiesce = "quiesce"
+	// configQuiesceTimeout is the maximum time volumes are kept quiesced, as
+	// a duration string. Portworx unquiesces them after it expires.
+	configQuiesceTimeout = "quiesceTimeout"
+
+	defaultQuiesceTimeout = 30 * time.Second
+)
+
+// quiesceConfig describes if and how volumes are quiesced before snapshots
+type quiesceConfig struct {
+	enabled bool
+	timeout time.Duration
+}
+
+// parseQuiesceConfig parses the quiesce config from the plugin config
+func parseQuiesceConfig(config map[string]string) (*quiesceConfig, error) {
+	q := &quiesceConfig{timeout: defaultQuiesceTimeout}
+
+	if value := config[configQuiesce]; value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q, must be true or false", configQuiesce, value)
+		}
+		q.enabled = enabled
+	}
+
+	if value := config[configQuiesceTimeout]; value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < time.Second {
+			return nil, fmt.Errorf("invalid %v %q, must be a duration of at least 1s", configQuiesceTimeout, value)
+		}
+		q.timeout = timeout
+	}
+	return q, nil
+}
+
+// quiesceVolumes quiesces the given volumes and returns a function that
+// unquiesces them, which must always be called. If any volume fails to
+// quiesce the ones already quiesced are unquiesced and an error is returned.
+func (q *quiesceConfig) quiesceVolumes(
+	volDriver volume.VolumeDriver,
+	volumeIDs []string,
+	backupName string,
+	log logrus.FieldLogger,
+) (func(), error) {
+	var quiesced []string
+	unquiesce := func() {
+		for _, volumeID := range quiesced {
+			if err := volDriver.Unquiesce(volumeID); err != nil {
+				log.Errorf("Failed to unquiesce volume %v: %v", volumeID, err)
+			} else {
+				log.Infof("Unquiesced volume %v", volumeID)
+			}
+		}
+		quiesced = nil
+	}
+	if q == nil || !q.enabled {
+		return unquiesce, nil
+	}
+
+	quiesceID := quiesceIDForBackup(backupName)
+	for _, volumeID := range volumeIDs {
+		if err := volDriver.Quiesce(volumeID, uint64(q.timeout.Seconds()), quiesceID); err != nil {
+			unquiesce()
+			return func() {}, fmt.Errorf("failed to quiesce volume %v: %v", volumeID, err)
+		}
+		log.Infof("Quiesced volume %v with ID %v", volumeID, quiesceID)
+		quiesced = append(quiesced, volumeID)
+	}
+	return unquiesce, nil
+}
+
+// quiesceIDForBackup returns the quiesce ID used for the volumes of the
+// given Velero backup
+func quiesceIDForBackup(backupName string) string {
+	if backupName == "" {
+		return uniqueID
+	}
+	return "velero-" + backupName
+}
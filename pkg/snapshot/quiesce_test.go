@@ -0,0 +1,120 @@
+package snapshot
+
+import (
+	"testing"
+	"time"
+
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+)
+
+func TestParseQuiesceConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      map[string]string
+		wantEnabled bool
+		wantTimeout time.Duration
+		wantErr     bool
+	}{
+		{name: "default", config: map[string]string{}, wantTimeout: defaultQuiesceTimeout},
+		{
+			name:        "enabled",
+			config:      map[string]string{configQuiesce: "true", configQuiesceTimeout: "2m"},
+			wantEnabled: true,
+			wantTimeout: 2 * time.Minute,
+		},
+		{name: "invalid flag", config: map[string]string{configQuiesce: "yes please"}, wantErr: true},
+		{name: "invalid timeout", config: map[string]string{configQuiesceTimeout: "30"}, wantErr: true},
+		{name: "timeout too short", config: map[string]string{configQuiesceTimeout: "500ms"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q, err := parseQuiesceConfig(test.config)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parse of %v returned error %v, want error %v", test.config, err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if q.enabled != test.wantEnabled || q.timeout != test.wantTimeout {
+				t.Errorf("quiesce is enabled %v with timeout %v, want %v with %v",
+					q.enabled, q.timeout, test.wantEnabled, test.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestQuiesceVolumes(t *testing.T) {
+	volDriver := newFakeVolumeDriver(testVolume("vol-1", "pvc-1", nil), testVolume("vol-2", "pvc-2", nil))
+	q := &quiesceConfig{enabled: true, timeout: time.Minute}
+
+	unquiesce, err := q.quiesceVolumes(volDriver, []string{"vol-1", "vol-2"}, "backup-1", testLogger())
+	if err != nil {
+		t.Fatalf("quiesce failed: %v", err)
+	}
+	for _, volumeID := range []string{"vol-1", "vol-2"} {
+		if id := volDriver.quiesced[volumeID]; id != "velero-backup-1" {
+			t.Errorf("volume %v quiesced with ID %q, want velero-backup-1", volumeID, id)
+		}
+	}
+	unquiesce()
+	unquiesce()
+	if len(volDriver.quiesced) > 0 || volDriver.callCount("Unquiesce") != 2 {
+		t.Errorf("volumes %v still quiesced after %v unquiesce calls", volDriver.quiesced, volDriver.callCount("Unquiesce"))
+	}
+
+	// Volumes quiesced before a failure are unquiesced
+	unquiesce, err = q.quiesceVolumes(volDriver, []string{"vol-1", "vol-3"}, "backup-1", testLogger())
+	if err == nil {
+		t.Fatalf("quiesce of a missing volume succeeded")
+	}
+	unquiesce()
+	if len(volDriver.quiesced) > 0 {
+		t.Errorf("volumes %v still quiesced after the failure", volDriver.quiesced)
+	}
+
+	var disabled *quiesceConfig
+	if _, err := disabled.quiesceVolumes(volDriver, []string{"vol-1"}, "backup-1", testLogger()); err != nil {
+		t.Fatalf("quiesce with no config failed: %v", err)
+	}
+	if quiesces := volDriver.callCount("Quiesce"); quiesces != 4 {
+		t.Errorf("%v volumes were quiesced, want 4", quiesces)
+	}
+}
+
+func TestLocalCreateSnapshotQuiesce(t *testing.T) {
+	setEnv(t, veleroNamespaceEnv, "velero")
+	kubeOps := groupKubeOps()
+	useKubeOps(t, kubeOps)
+
+	for _, grouped := range []bool{false, true} {
+		volDriver := newFakeVolumeDriver(testVolume("vol-data", "pvc-data", nil), testVolume("vol-wal", "pvc-wal", nil))
+		l := &localSnapshotPlugin{
+			pxClient: testClient(volDriver, kubeOps),
+			log:      testLogger(),
+			quiesce:  &quiesceConfig{enabled: true, timeout: time.Minute},
+		}
+		want := 1
+		if grouped {
+			l.group = &groupConfig{
+				mode:      groupModePod,
+				getBackup: func(string) (*velerov1.Backup, error) { return &velerov1.Backup{}, nil },
+			}
+			want = 2
+		}
+
+		_, err := l.CreateSnapshot("vol-data", "", map[string]string{
+			veleroBackupTag: "backup-1",
+			veleroPVTag:     "pv-vol-data",
+		})
+		if err != nil {
+			t.Fatalf("backup failed: %v", err)
+		}
+		if volDriver.quiescedSnapshots != want {
+			t.Errorf("%v snapshots of quiesced volumes were taken, want %v", volDriver.quiescedSnapshots, want)
+		}
+		if len(volDriver.quiesced) > 0 {
+			t.Errorf("volumes %v still quiesced after the snapshot", volDriver.quiesced)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package snapshot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/portworx/sched-ops/k8s/core"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+const (
+	// configRemoteKubeconfigSecret is the name of a Secret with the
+	// kubeconfig of a remote Kubernetes cluster running Portworx. The
+	// Portworx endpoints, TLS Secrets, PVs, PVCs, StorageClasses, pods of
+	// volume groups, tenant token Secrets and the cloud credential Secret
+	// are read in that cluster. The kubeconfig Secret, the plugin token
+	// Secret and the trackers of group snapshots and cloud credentials stay
+	// in the cluster Velero runs in. A remote Portworx cluster can also be reached directly with
+	// PX_MGMT_ENDPOINT and PX_SDK_ENDPOINT, or PX_ENDPOINT, and a token.
+	configRemoteKubeconfigSecret = "remoteKubeconfigSecret"
+	// configRemoteKubeconfigSecretNamespace is the namespace of the
+	// kubeconfig Secret, the Velero namespace by default
+	configRemoteKubeconfigSecretNamespace = "remoteKubeconfigSecretNamespace"
+	// configRemoteKubeconfigSecretKey is the key of the kubeconfig in the
+	// Secret
+	configRemoteKubeconfigSecretKey = "remoteKubeconfigSecretKey"
+
+	defaultKubeconfigSecretKey = "kubeconfig"
+)
+
+var (
+	// remoteClusters holds the clients of remote clusters, by the
+	// namespace/name of their kubeconfig Secret
+	remoteClusters     = make(map[string]*remoteCluster)
+	remoteClustersLock sync.Mutex
+)
+
+// remoteCluster is the client of a remote cluster and the version of the
+// kubeconfig Secret it was created from
+type remoteCluster struct {
+	kubeOps         core.Ops
+	resourceVersion string
+}
+
+// clusterKubeOps returns the client of the Kubernetes cluster running
+// Portworx, which is the remote cluster of the kubeconfig Secret if there is
+// one and the cluster Velero runs in otherwise. Remote clients are reused
+// until the Secret changes.
+func clusterKubeOps(config map[string]string) (core.Ops, error) {
+	name := config[configRemoteKubeconfigSecret]
+	if name == "" {
+		return core.Instance(), nil
+	}
+	namespace := config[configRemoteKubeconfigSecretNamespace]
+	if namespace == "" {
+		namespace = veleroNamespace()
+	}
+	key := config[configRemoteKubeconfigSecretKey]
+	if key == "" {
+		key = defaultKubeconfigSecretKey
+	}
+
+	secret, err := core.Instance().GetSecret(name, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kubeconfig secret %v/%v: %v", namespace, name, err)
+	}
+	kubeconfig := secret.Data[key]
+	if len(kubeconfig) == 0 {
+		return nil, fmt.Errorf("kubeconfig secret %v/%v has no %v key", namespace, name, key)
+	}
+
+	secretKey := namespace + "/" + name
+	remoteClustersLock.Lock()
+	defer remoteClustersLock.Unlock()
+	if cluster, ok := remoteClusters[secretKey]; ok && cluster.resourceVersion == secret.ResourceVersion {
+		return cluster.kubeOps, nil
+	}
+
+	kubeOps, err := kubeOpsFromKubeconfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig in secret %v/%v: %v", namespace, name, err)
+	}
+	remoteClusters[secretKey] = &remoteCluster{kubeOps: kubeOps, resourceVersion: secret.ResourceVersion}
+	return kubeOps, nil
+}
+
+// kubeOpsFromKubeconfig returns a client of the cluster of the kubeconfig.
+// The client can only be loaded from a file, which is removed once loaded.
+func kubeOpsFromKubeconfig(kubeconfig []byte) (core.Ops, error) {
+	file, err := ioutil.TempFile("", "kubeconfig")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(kubeconfig)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return core.NewInstanceFromConfigFile(file.Name())
+}
+
+// checkClusterHealth checks that the cluster Velero runs in, the remote
+// Kubernetes cluster if any and the Portworx cluster can be reached. A
+// Portworx cluster that is reachable but not healthy is only logged, since
+// backups and restores of healthy volumes can still succeed.
+func (p *portworxClient) checkClusterHealth(remoteKubeOps bool) error {
+	if _, err := core.Instance().GetVersion(); err != nil {
+		return fmt.Errorf("failed to reach the Kubernetes cluster: %v", err)
+	}
+	if remoteKubeOps {
+		if _, err := p.kubeOps.GetVersion(); err != nil {
+			return fmt.Errorf("failed to reach the remote Kubernetes cluster: %v", err)
+		}
+	}
+
+	conn, err := p.getSdkConnection()
+	if err != nil {
+		// Clusters without the SDK are only checked to answer
+		volDriver, err := p.getVolumeDriver()
+		if err != nil {
+			return fmt.Errorf("failed to reach Portworx at %v: %v", p.pxEndpoint, err)
+		}
+		if _, err := volDriver.Enumerate(&api.VolumeLocator{Name: uniqueID}, nil); err != nil {
+			return fmt.Errorf("failed to reach Portworx at %v: %v", p.pxEndpoint, err)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sdkCallTimeout)
+	defer cancel()
+	resp, err := api.NewOpenStorageClusterClient(conn).InspectCurrent(ctx, &api.SdkClusterInspectCurrentRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to inspect Portworx cluster at %v: %v", p.sdkConn.endpoint, err)
+	}
+	if status := resp.GetCluster().GetStatus(); status != api.Status_STATUS_OK {
+		logrus.Warnf("Portworx cluster %v at %v is not healthy: %v",
+			resp.GetCluster().GetName(), p.sdkConn.endpoint, status)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package snapshot
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+func TestCheckClusterHealth(t *testing.T) {
+	tests := []struct {
+		name string
+		// cluster is the Portworx cluster, unreachable if nil
+		cluster   *api.StorageCluster
+		remoteErr error
+		wantErr   bool
+	}{
+		{name: "healthy", cluster: &api.StorageCluster{Name: "px", Status: api.Status_STATUS_OK}},
+		{name: "not healthy", cluster: &api.StorageCluster{Name: "px", Status: api.Status_STATUS_NOT_IN_QUORUM}},
+		{name: "Portworx unreachable", wantErr: true},
+		{
+			name:      "remote cluster unreachable",
+			cluster:   &api.StorageCluster{Name: "px", Status: api.Status_STATUS_OK},
+			remoteErr: errors.New("connection refused"),
+			wantErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useKubeOps(t, newFakeKubeOps())
+			remoteKubeOps := newFakeKubeOps()
+			remoteKubeOps.versionErr = test.remoteErr
+			pxClient := sdkTestClient(t, startFakeSDK(t, test.cluster, nil))
+			pxClient.kubeOps = remoteKubeOps
+
+			err := pxClient.checkClusterHealth(true)
+			if (err != nil) != test.wantErr {
+				t.Errorf("health check returned error %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package snapshot
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Config parameters to override the spec of restored volumes
+	configRestoreHaLevel   = "restoreHaLevel"
+	configRestoreIoProfile = "restoreIoProfile"
+	configRestoreCos       = "restoreCos"
+	configRestoreSharedv4  = "restoreSharedv4"
+	configRestoreJournal   = "restoreJournal"
+
+	minHaLevel = 1
+	maxHaLevel = 3
+)
+
+// restoreOverrides are changes to the spec of the source volume that are
+// applied to restored volumes. Unset fields keep the value of the source.
+type restoreOverrides struct {
+	haLevel   int64
+	cos       api.CosType
+	ioProfile *api.IoProfile
+	sharedv4  *bool
+	journal   *bool
+	// ioThrottle and placement are only set from the volume info recorded
+	// by Velero
+	ioThrottle *api.IoThrottle
+	placement  *api.VolumePlacementStrategy
+	// zoneMap maps source zones to the zones volumes are restored to
+	zoneMap map[string]string
+	// ownership maps the ownership of source volumes to the one of
+	// restored volumes
+	ownership *ownershipMap
+}
+
+// parseRestoreOverrides parses the restore overrides from the plugin config
+func parseRestoreOverrides(config map[string]string) (*restoreOverrides, error) {
+	r := &restoreOverrides{}
+
+	if value := config[configRestoreHaLevel]; value != "" {
+		haLevel, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || haLevel < minHaLevel || haLevel > maxHaLevel {
+			return nil, fmt.Errorf("invalid %v %q, must be between %v and %v",
+				configRestoreHaLevel, value, minHaLevel, maxHaLevel)
+		}
+		r.haLevel = haLevel
+	}
+
+	if value := config[configRestoreCos]; value != "" {
+		cos, err := api.CosTypeSimpleValueOf(value)
+		if err != nil || cos == api.CosType_NONE {
+			return nil, fmt.Errorf("invalid %v %q, must be one of low, medium or high", configRestoreCos, value)
+		}
+		r.cos = cos
+	}
+
+	if value := config[configRestoreIoProfile]; value != "" {
+		ioProfile, err := api.IoProfileSimpleValueOf(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q: %v", configRestoreIoProfile, value, err)
+		}
+		r.ioProfile = &ioProfile
+	}
+
+	var err error
+	if r.zoneMap, err = parseZoneMap(config); err != nil {
+		return nil, err
+	}
+	if r.ownership, err = parseOwnershipMap(config); err != nil {
+		return nil, err
+	}
+	if r.sharedv4, err = parseOptionalBool(config, configRestoreSharedv4); err != nil {
+		return nil, err
+	}
+	if r.journal, err = parseOptionalBool(config, configRestoreJournal); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// isEmpty returns true if no overrides are configured
+func (r *restoreOverrides) isEmpty() bool {
+	return r.haLevel == 0 && r.cos == api.CosType_NONE &&
+		r.ioProfile == nil && r.sharedv4 == nil && r.journal == nil &&
+		r.ioThrottle == nil && r.placement == nil
+}
+
+// forVolume returns the overrides for restoring a volume with the type, AZ
+// and IOPS recorded by Velero, which are used for the fields without an
+// override
+func (r *restoreOverrides) forVolume(volumeType, volumeAZ string, iops *int64, log logrus.FieldLogger) *restoreOverrides {
+	return r.withDefaults(parseVolumeInfo(volumeType, volumeAZ, iops, r.zoneMap, log))
+}
+
+// withDefaults returns the overrides with unset fields taken from defaults
+func (r *restoreOverrides) withDefaults(defaults *restoreOverrides) *restoreOverrides {
+	merged := *r
+	if merged.haLevel == 0 {
+		merged.haLevel = defaults.haLevel
+	}
+	if merged.cos == api.CosType_NONE {
+		merged.cos = defaults.cos
+	}
+	if merged.ioProfile == nil {
+		merged.ioProfile = defaults.ioProfile
+	}
+	if merged.sharedv4 == nil {
+		merged.sharedv4 = defaults.sharedv4
+	}
+	if merged.journal == nil {
+		merged.journal = defaults.journal
+	}
+	if merged.ioThrottle == nil {
+		merged.ioThrottle = defaults.ioThrottle
+	}
+	if merged.placement == nil {
+		merged.placement = defaults.placement
+	}
+	return &merged
+}
+
+// cloudRestoreSpec returns the spec to use for cloud backup restores, or nil
+// if the volume should be restored with the spec stored in the backup
+func (r *restoreOverrides) cloudRestoreSpec() *api.RestoreVolumeSpec {
+	if r.isEmpty() {
+		return nil
+	}
+
+	spec := &api.RestoreVolumeSpec{
+		HaLevel:           r.haLevel,
+		Cos:               r.cos,
+		IoProfileBkupSrc:  true,
+		Sharedv4:          restoreParamBool(r.sharedv4),
+		Journal:           restoreParamBool(r.journal),
+		IoThrottle:        r.ioThrottle,
+		PlacementStrategy: r.placement,
+	}
+	if r.ioProfile != nil {
+		spec.IoProfile = *r.ioProfile
+		spec.IoProfileBkupSrc = false
+	}
+	return spec
+}
+
+// apply updates the spec of an existing volume with the overrides. Each
+// change is made with a separate update since Portworx doesn't allow some of
+// them, like HA level changes, to be combined with others. The placement
+// isn't applied since the replicas of existing volumes aren't moved.
+func (r *restoreOverrides) apply(volDriver volume.VolumeDriver, volumeID string, log logrus.FieldLogger) error {
+	if r.isEmpty() {
+		return nil
+	}
+
+	vols, err := volDriver.Inspect([]string{volumeID})
+	if err != nil {
+		return err
+	}
+	if len(vols) == 0 {
+		return fmt.Errorf("Volume %v not found", volumeID)
+	}
+	spec := vols[0].Spec
+
+	var updates []func()
+	if r.cos != api.CosType_NONE && spec.Cos != r.cos {
+		updates = append(updates, func() { spec.Cos = r.cos })
+	}
+	if r.ioProfile != nil && spec.IoProfile != *r.ioProfile {
+		updates = append(updates, func() { spec.IoProfile = *r.ioProfile })
+	}
+	if r.sharedv4 != nil && spec.Sharedv4 != *r.sharedv4 {
+		updates = append(updates, func() { spec.Sharedv4 = *r.sharedv4 })
+	}
+	if r.journal != nil && spec.Journal != *r.journal {
+		updates = append(updates, func() { spec.Journal = *r.journal })
+	}
+	if r.ioThrottle != nil && !ioThrottleEqual(spec.IoThrottle, r.ioThrottle) {
+		updates = append(updates, func() { spec.IoThrottle = r.ioThrottle })
+	}
+	if r.haLevel != 0 && spec.HaLevel != r.haLevel {
+		updates = append(updates, func() { spec.HaLevel = r.haLevel })
+	}
+
+	for _, update := range updates {
+		update()
+		if err := volDriver.Set(volumeID, nil, spec); err != nil {
+			return fmt.Errorf("failed to update spec of restored volume %v: %v", volumeID, err)
+		}
+	}
+	if len(updates) > 0 {
+		log.Infof("Updated spec of restored volume %v", volumeID)
+	}
+	return nil
+}
+
+func ioThrottleEqual(a, b *api.IoThrottle) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.ReadIops == b.ReadIops && a.WriteIops == b.WriteIops &&
+		a.ReadBwMbytes == b.ReadBwMbytes && a.WriteBwMbytes == b.WriteBwMbytes
+}
+
+func parseOptionalBool(config map[string]string, key string) (*bool, error) {
+	value := config[key]
+	if value == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v %q, must be true or false", key, value)
+	}
+	return &b, nil
+}
+
+func restoreParamBool(b *bool) api.RestoreParamBoolType {
+	if b == nil {
+		return api.RestoreParamBoolType_PARAM_BKUPSRC
+	}
+	if *b {
+		return api.RestoreParamBoolType_PARAM_TRUE
+	}
+	return api.RestoreParamBoolType_PARAM_FALSE
+}
@@ -0,0 +1,134 @@
+package snapshot
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestParseRestoreOverrides(t *testing.T) {
+	db := api.IoProfile_IO_PROFILE_DB
+
+	tests := []struct {
+		name    string
+		config  map[string]string
+		want    *restoreOverrides
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			config: map[string]string{},
+			want:   &restoreOverrides{},
+		},
+		{
+			name: "overrides",
+			config: map[string]string{
+				configRestoreHaLevel:   "2",
+				configRestoreCos:       "high",
+				configRestoreIoProfile: "db",
+				configRestoreSharedv4:  "true",
+				configRestoreJournal:   "false",
+			},
+			want: &restoreOverrides{
+				haLevel:   2,
+				cos:       api.CosType_HIGH,
+				ioProfile: &db,
+				sharedv4:  boolPtr(true),
+				journal:   boolPtr(false),
+			},
+		},
+		{name: "ha level too low", config: map[string]string{configRestoreHaLevel: "0"}, wantErr: true},
+		{name: "ha level too high", config: map[string]string{configRestoreHaLevel: "4"}, wantErr: true},
+		{name: "invalid cos", config: map[string]string{configRestoreCos: "fast"}, wantErr: true},
+		{name: "no cos", config: map[string]string{configRestoreCos: "none"}, wantErr: true},
+		{name: "invalid io profile", config: map[string]string{configRestoreIoProfile: "unknown"}, wantErr: true},
+		{name: "invalid sharedv4", config: map[string]string{configRestoreSharedv4: "maybe"}, wantErr: true},
+		{name: "invalid journal", config: map[string]string{configRestoreJournal: "maybe"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := parseRestoreOverrides(test.config)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parse of %v succeeded, want an error", test.config)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse of %v failed: %v", test.config, err)
+			}
+			// The zone and ownership maps are tested with their parsers
+			r.zoneMap, r.ownership = nil, nil
+			if !reflect.DeepEqual(r, test.want) {
+				t.Errorf("overrides are %+v, want %+v", r, test.want)
+			}
+		})
+	}
+}
+
+func TestCloudRestoreSpec(t *testing.T) {
+	db := api.IoProfile_IO_PROFILE_DB
+
+	if spec := (&restoreOverrides{}).cloudRestoreSpec(); spec != nil {
+		t.Errorf("spec without overrides is %+v, want nil", spec)
+	}
+
+	r := &restoreOverrides{haLevel: 2, ioProfile: &db, journal: boolPtr(true)}
+	want := &api.RestoreVolumeSpec{
+		HaLevel:   2,
+		IoProfile: db,
+		Sharedv4:  api.RestoreParamBoolType_PARAM_BKUPSRC,
+		Journal:   api.RestoreParamBoolType_PARAM_TRUE,
+	}
+	if spec := r.cloudRestoreSpec(); !reflect.DeepEqual(spec, want) {
+		t.Errorf("spec is %+v, want %+v", spec, want)
+	}
+}
+
+func TestRestoreOverridesWithDefaults(t *testing.T) {
+	db := api.IoProfile_IO_PROFILE_DB
+	cms := api.IoProfile_IO_PROFILE_CMS
+
+	r := &restoreOverrides{haLevel: 3, ioProfile: &db}
+	defaults := &restoreOverrides{
+		haLevel:    2,
+		cos:        api.CosType_LOW,
+		ioProfile:  &cms,
+		ioThrottle: &api.IoThrottle{ReadIops: 100},
+	}
+	want := &restoreOverrides{
+		haLevel:    3,
+		cos:        api.CosType_LOW,
+		ioProfile:  &db,
+		ioThrottle: &api.IoThrottle{ReadIops: 100},
+	}
+	if merged := r.withDefaults(defaults); !reflect.DeepEqual(merged, want) {
+		t.Errorf("overrides are %+v, want %+v", merged, want)
+	}
+}
+
+func TestRestoreOverridesApply(t *testing.T) {
+	vol := testVolume("vol-1", "pvc-1", nil)
+	vol.Spec = &api.VolumeSpec{HaLevel: 1, Cos: api.CosType_LOW, Journal: true}
+	volDriver := newFakeVolumeDriver(vol)
+
+	r := &restoreOverrides{haLevel: 2, cos: api.CosType_LOW, journal: boolPtr(false)}
+	if err := r.apply(volDriver, "vol-1", testLogger()); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+
+	spec := volDriver.volume("vol-1").Spec
+	if spec.HaLevel != 2 || spec.Cos != api.CosType_LOW || spec.Journal {
+		t.Errorf("spec is %+v, want HA level 2, low cos and no journal", spec)
+	}
+	// The HA level is updated on its own and the unchanged cos isn't
+	if sets := volDriver.callCount("Set"); sets != 2 {
+		t.Errorf("spec was updated %v times, want 2", sets)
+	}
+}
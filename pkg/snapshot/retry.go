@@ -0,0 +1,504 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// configRetryBudgets is the time transient failures of each type of
+	// Portworx call are retried for, as comma separated operation=duration
+	// pairs. A duration of 0 disables retries of the operation.
+	configRetryBudgets = "retryBudgets"
+	// configRetryInitialBackoff and configRetryMaxBackoff bound the
+	// exponential backoff between retries
+	configRetryInitialBackoff = "retryInitialBackoff"
+	configRetryMaxBackoff     = "retryMaxBackoff"
+	// configCircuitBreakerFailures is the number of consecutive transient
+	// failures after which calls fail fast, 0 to never fail fast
+	configCircuitBreakerFailures = "circuitBreakerFailures"
+	// configCircuitBreakerCooldown is the time calls fail fast for before
+	// Portworx is tried again
+	configCircuitBreakerCooldown = "circuitBreakerCooldown"
+
+	// Types of Portworx calls with their own retry budget
+	opConnect     = "connect"
+	opInspect     = "inspect"
+	opSnapshot    = "snapshot"
+	opUpdate      = "update"
+	opCloudBackup = "cloudBackup"
+	opDelete      = "delete"
+	opCreds       = "creds"
+
+	defaultRetryInitialBackoff    = time.Second
+	defaultRetryMaxBackoff        = 30 * time.Second
+	defaultCircuitBreakerFailures = 5
+	defaultCircuitBreakerCooldown = time.Minute
+)
+
+// defaultRetryBudgets are the retry budgets of the operations not set in the
+// config
+var defaultRetryBudgets = map[string]time.Duration{
+	opConnect:     30 * time.Second,
+	opInspect:     time.Minute,
+	opSnapshot:    time.Minute,
+	opUpdate:      time.Minute,
+	opCloudBackup: 2 * time.Minute,
+	opDelete:      time.Minute,
+	opCreds:       30 * time.Second,
+}
+
+// transientErrors are parts of the messages of errors, mostly from the REST
+// API, that are caused by Portworx being temporarily unreachable, or by the
+// KVDB of Portworx electing a new leader
+var transientErrors = []string{
+	"connection refused",
+	"connection reset",
+	"broken pipe",
+	"no route to host",
+	"unexpected eof",
+	"service unavailable",
+	"bad gateway",
+	"not in quorum",
+	"etcdserver: no leader",
+	"etcdserver: leader changed",
+	"no cluster leader",
+}
+
+// errorClass is the classification of errors of Portworx calls
+type errorClass int
+
+const (
+	errorNone errorClass = iota
+	// errorPermanent errors, like NotFound, auth failures or bad
+	// credentials, don't go away by retrying
+	errorPermanent
+	// errorTransient errors happened before the call was processed
+	errorTransient
+	// errorUnknownOutcome errors, like timeouts, may have happened after
+	// the call was processed. Only idempotent calls are retried.
+	errorUnknownOutcome
+)
+
+// classifyError returns the class of the error of a Portworx call
+func classifyError(err error) errorClass {
+	if err == nil {
+		return errorNone
+	}
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+			return errorTransient
+		case codes.DeadlineExceeded:
+			return errorUnknownOutcome
+		case codes.Unknown, codes.Internal:
+			// Portworx reports some cluster state errors this way
+		default:
+			return errorPermanent
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return errorUnknownOutcome
+		}
+		return errorTransient
+	}
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "timeout") {
+		return errorUnknownOutcome
+	}
+	for _, transient := range transientErrors {
+		if strings.Contains(msg, transient) {
+			return errorTransient
+		}
+	}
+	return errorPermanent
+}
+
+// retryPolicy retries transient failures of Portworx calls with exponential
+// backoff, within a time budget per type of call, and fails calls fast while
+// Portworx is down
+type retryPolicy struct {
+	budgets        map[string]time.Duration
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	breaker        *circuitBreaker
+}
+
+// parseRetryPolicy parses the retry settings from the plugin config
+func parseRetryPolicy(config map[string]string) (*retryPolicy, error) {
+	r := &retryPolicy{
+		budgets:        make(map[string]time.Duration),
+		initialBackoff: defaultRetryInitialBackoff,
+		maxBackoff:     defaultRetryMaxBackoff,
+		breaker: &circuitBreaker{
+			threshold: defaultCircuitBreakerFailures,
+			cooldown:  defaultCircuitBreakerCooldown,
+		},
+	}
+	for op, budget := range defaultRetryBudgets {
+		r.budgets[op] = budget
+	}
+
+	budgets, err := parseNameMap(config, configRetryBudgets, "operation=duration")
+	if err != nil {
+		return nil, err
+	}
+	for op, value := range budgets {
+		if _, ok := defaultRetryBudgets[op]; !ok {
+			return nil, fmt.Errorf("invalid %v operation %q, must be one of %v, %v, %v, %v, %v, %v or %v",
+				configRetryBudgets, op, opConnect, opInspect, opSnapshot, opUpdate, opCloudBackup, opDelete, opCreds)
+		}
+		budget, err := time.ParseDuration(value)
+		if err != nil || budget < 0 {
+			return nil, fmt.Errorf("invalid %v budget %q of %v, must be a duration", configRetryBudgets, value, op)
+		}
+		r.budgets[op] = budget
+	}
+
+	if r.initialBackoff, err = parsePositiveDuration(config, configRetryInitialBackoff, r.initialBackoff); err != nil {
+		return nil, err
+	}
+	if r.maxBackoff, err = parsePositiveDuration(config, configRetryMaxBackoff, r.maxBackoff); err != nil {
+		return nil, err
+	}
+	if r.maxBackoff < r.initialBackoff {
+		return nil, fmt.Errorf("%v must not be less than %v", configRetryMaxBackoff, configRetryInitialBackoff)
+	}
+	if r.breaker.cooldown, err = parsePositiveDuration(config, configCircuitBreakerCooldown, r.breaker.cooldown); err != nil {
+		return nil, err
+	}
+	if value := config[configCircuitBreakerFailures]; value != "" {
+		failures, err := strconv.Atoi(value)
+		if err != nil || failures < 0 {
+			return nil, fmt.Errorf("invalid %v %q, must be a number of failures", configCircuitBreakerFailures, value)
+		}
+		r.breaker.threshold = failures
+	}
+	return r, nil
+}
+
+func parsePositiveDuration(config map[string]string, key string, defaultValue time.Duration) (time.Duration, error) {
+	value := config[key]
+	if value == "" {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid %v %q, must be a positive duration", key, value)
+	}
+	return duration, nil
+}
+
+// do makes the call, retrying transient failures within the budget of the
+// operation. Failures with an unknown outcome are only retried for
+// idempotent calls. The error of the last attempt is returned.
+func (r *retryPolicy) do(op string, idempotent bool, call func() error) error {
+	if r == nil {
+		return call()
+	}
+
+	deadline := time.Now().Add(r.budgets[op])
+	backoff := r.initialBackoff
+	for attempt := 1; ; attempt++ {
+		if err := r.breaker.allow(); err != nil {
+			return err
+		}
+		err := call()
+		class := classifyError(err)
+		r.breaker.record(class)
+
+		retriable := class == errorTransient || (class == errorUnknownOutcome && idempotent)
+		if !retriable {
+			return err
+		}
+		// Sleep between half and all of the backoff so that calls failing
+		// together don't retry together
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if time.Now().Add(sleep).After(deadline) {
+			return err
+		}
+		logrus.Warnf("Portworx %v call failed, retrying in %v (attempt %v): %v", op, sleep.Round(time.Millisecond), attempt, err)
+		time.Sleep(sleep)
+
+		if backoff *= 2; backoff > r.maxBackoff {
+			backoff = r.maxBackoff
+		}
+	}
+}
+
+// circuitBreaker fails calls fast once consecutive calls failed with
+// transient errors, until the cooldown is over. The next call is then let
+// through and closes the breaker if it succeeds.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// allow returns an error if calls must fail fast
+func (b *circuitBreaker) allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if remaining := time.Until(b.openUntil); remaining > 0 {
+		return fmt.Errorf("Portworx is unavailable after %v consecutive failures, not retrying for %v",
+			b.failures, remaining.Round(time.Second))
+	}
+	return nil
+}
+
+// record counts the consecutive transient failures. Permanent errors count
+// as successes since Portworx answered.
+func (b *circuitBreaker) record(class errorClass) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if class != errorTransient && class != errorUnknownOutcome {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		if time.Now().After(b.openUntil) {
+			logrus.Errorf("Portworx is unavailable after %v consecutive failures, failing calls for %v", b.failures, b.cooldown)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// retryVolumeDriver retries the volume driver calls made by the plugin with
+// the retry policy. Calls the plugin doesn't make go to the embedded driver
+// directly.
+type retryVolumeDriver struct {
+	volume.VolumeDriver
+	retries *retryPolicy
+}
+
+func (r *retryVolumeDriver) Inspect(volumeIDs []string) ([]*api.Volume, error) {
+	var vols []*api.Volume
+	err := r.retries.do(opInspect, true, func() (err error) {
+		vols, err = r.VolumeDriver.Inspect(volumeIDs)
+		return err
+	})
+	return vols, err
+}
+
+func (r *retryVolumeDriver) Enumerate(locator *api.VolumeLocator, labels map[string]string) ([]*api.Volume, error) {
+	var vols []*api.Volume
+	err := r.retries.do(opInspect, true, func() (err error) {
+		vols, err = r.VolumeDriver.Enumerate(locator, labels)
+		return err
+	})
+	return vols, err
+}
+
+func (r *retryVolumeDriver) Snapshot(volumeID string, readonly bool, locator *api.VolumeLocator, noRetry bool) (string, error) {
+	var snapshotID string
+	err := r.retries.do(opSnapshot, false, func() (err error) {
+		snapshotID, err = r.VolumeDriver.Snapshot(volumeID, readonly, locator, noRetry)
+		return err
+	})
+	return snapshotID, err
+}
+
+func (r *retryVolumeDriver) SnapshotGroup(
+	groupID string,
+	labels map[string]string,
+	volumeIDs []string,
+	deleteOnFailure bool,
+) (*api.GroupSnapCreateResponse, error) {
+	var resp *api.GroupSnapCreateResponse
+	err := r.retries.do(opSnapshot, false, func() (err error) {
+		resp, err = r.VolumeDriver.SnapshotGroup(groupID, labels, volumeIDs, deleteOnFailure)
+		return err
+	})
+	return resp, err
+}
+
+func (r *retryVolumeDriver) Set(volumeID string, locator *api.VolumeLocator, spec *api.VolumeSpec) error {
+	return r.retries.do(opUpdate, true, func() error {
+		return r.VolumeDriver.Set(volumeID, locator, spec)
+	})
+}
+
+// Quiesce isn't idempotent since quiescing a quiesced volume fails
+func (r *retryVolumeDriver) Quiesce(volumeID string, timeoutSeconds uint64, quiesceID string) error {
+	return r.retries.do(opUpdate, false, func() error {
+		return r.VolumeDriver.Quiesce(volumeID, timeoutSeconds, quiesceID)
+	})
+}
+
+func (r *retryVolumeDriver) Unquiesce(volumeID string) error {
+	return r.retries.do(opUpdate, true, func() error {
+		return r.VolumeDriver.Unquiesce(volumeID)
+	})
+}
+
+// Delete isn't idempotent since deleting a deleted volume fails
+func (r *retryVolumeDriver) Delete(ctx context.Context, volumeID string) error {
+	return r.retries.do(opDelete, false, func() error {
+		return r.VolumeDriver.Delete(ctx, volumeID)
+	})
+}
+
+// CloudBackupCreate is idempotent for named tasks, a task with the same name
+// not being started twice
+func (r *retryVolumeDriver) CloudBackupCreate(input *api.CloudBackupCreateRequest) (*api.CloudBackupCreateResponse, error) {
+	var resp *api.CloudBackupCreateResponse
+	err := r.retries.do(opCloudBackup, input.Name != "", func() (err error) {
+		resp, err = r.VolumeDriver.CloudBackupCreate(input)
+		return err
+	})
+	return resp, err
+}
+
+func (r *retryVolumeDriver) CloudBackupGroupCreate(input *api.CloudBackupGroupCreateRequest) (*api.CloudBackupGroupCreateResponse, error) {
+	var resp *api.CloudBackupGroupCreateResponse
+	err := r.retries.do(opCloudBackup, false, func() (err error) {
+		resp, err = r.VolumeDriver.CloudBackupGroupCreate(input)
+		return err
+	})
+	return resp, err
+}
+
+func (r *retryVolumeDriver) CloudBackupRestore(input *api.CloudBackupRestoreRequest) (*api.CloudBackupRestoreResponse, error) {
+	var resp *api.CloudBackupRestoreResponse
+	err := r.retries.do(opCloudBackup, false, func() (err error) {
+		resp, err = r.VolumeDriver.CloudBackupRestore(input)
+		return err
+	})
+	return resp, err
+}
+
+func (r *retryVolumeDriver) CloudBackupEnumerate(input *api.CloudBackupEnumerateRequest) (*api.CloudBackupEnumerateResponse, error) {
+	var resp *api.CloudBackupEnumerateResponse
+	err := r.retries.do(opInspect, true, func() (err error) {
+		resp, err = r.VolumeDriver.CloudBackupEnumerate(input)
+		return err
+	})
+	return resp, err
+}
+
+func (r *retryVolumeDriver) CloudBackupDelete(input *api.CloudBackupDeleteRequest) error {
+	return r.retries.do(opDelete, false, func() error {
+		return r.VolumeDriver.CloudBackupDelete(input)
+	})
+}
+
+func (r *retryVolumeDriver) CloudBackupStatus(input *api.CloudBackupStatusRequest) (*api.CloudBackupStatusResponse, error) {
+	var resp *api.CloudBackupStatusResponse
+	err := r.retries.do(opInspect, true, func() (err error) {
+		resp, err = r.VolumeDriver.CloudBackupStatus(input)
+		return err
+	})
+	return resp, err
+}
+
+func (r *retryVolumeDriver) CloudBackupStateChange(input *api.CloudBackupStateChangeRequest) error {
+	return r.retries.do(opCloudBackup, true, func() error {
+		return r.VolumeDriver.CloudBackupStateChange(input)
+	})
+}
+
+// FilesystemTrimStart isn't idempotent since starting a running trim fails
+func (r *retryVolumeDriver) FilesystemTrimStart(request *api.SdkFilesystemTrimStartRequest) (*api.SdkFilesystemTrimStartResponse, error) {
+	var resp *api.SdkFilesystemTrimStartResponse
+	err := r.retries.do(opUpdate, false, func() (err error) {
+		resp, err = r.VolumeDriver.FilesystemTrimStart(request)
+		return err
+	})
+	return resp, err
+}
+
+func (r *retryVolumeDriver) FilesystemTrimStatus(request *api.SdkFilesystemTrimStatusRequest) (*api.SdkFilesystemTrimStatusResponse, error) {
+	var resp *api.SdkFilesystemTrimStatusResponse
+	err := r.retries.do(opInspect, true, func() (err error) {
+		resp, err = r.VolumeDriver.FilesystemTrimStatus(request)
+		return err
+	})
+	return resp, err
+}
+
+func (r *retryVolumeDriver) FilesystemTrimStop(request *api.SdkFilesystemTrimStopRequest) (*api.SdkFilesystemTrimStopResponse, error) {
+	var resp *api.SdkFilesystemTrimStopResponse
+	err := r.retries.do(opUpdate, true, func() (err error) {
+		resp, err = r.VolumeDriver.FilesystemTrimStop(request)
+		return err
+	})
+	return resp, err
+}
+
+// FilesystemCheckStart isn't idempotent since starting a running check fails
+func (r *retryVolumeDriver) FilesystemCheckStart(request *api.SdkFilesystemCheckStartRequest) (*api.SdkFilesystemCheckStartResponse, error) {
+	var resp *api.SdkFilesystemCheckStartResponse
+	err := r.retries.do(opUpdate, false, func() (err error) {
+		resp, err = r.VolumeDriver.FilesystemCheckStart(request)
+		return err
+	})
+	return resp, err
+}
+
+func (r *retryVolumeDriver) FilesystemCheckStatus(request *api.SdkFilesystemCheckStatusRequest) (*api.SdkFilesystemCheckStatusResponse, error) {
+	var resp *api.SdkFilesystemCheckStatusResponse
+	err := r.retries.do(opInspect, true, func() (err error) {
+		resp, err = r.VolumeDriver.FilesystemCheckStatus(request)
+		return err
+	})
+	return resp, err
+}
+
+func (r *retryVolumeDriver) FilesystemCheckStop(request *api.SdkFilesystemCheckStopRequest) (*api.SdkFilesystemCheckStopResponse, error) {
+	var resp *api.SdkFilesystemCheckStopResponse
+	err := r.retries.do(opUpdate, true, func() (err error) {
+		resp, err = r.VolumeDriver.FilesystemCheckStop(request)
+		return err
+	})
+	return resp, err
+}
+
+func (r *retryVolumeDriver) CredsCreate(params map[string]string) (string, error) {
+	var credID string
+	err := r.retries.do(opCreds, false, func() (err error) {
+		credID, err = r.VolumeDriver.CredsCreate(params)
+		return err
+	})
+	return credID, err
+}
+
+func (r *retryVolumeDriver) CredsUpdate(name string, params map[string]string) error {
+	return r.retries.do(opCreds, true, func() error {
+		return r.VolumeDriver.CredsUpdate(name, params)
+	})
+}
+
+func (r *retryVolumeDriver) CredsEnumerate() (map[string]interface{}, error) {
+	var creds map[string]interface{}
+	err := r.retries.do(opCreds, true, func() (err error) {
+		creds, err = r.VolumeDriver.CredsEnumerate()
+		return err
+	})
+	return creds, err
+}
+
+func (r *retryVolumeDriver) CredsValidate(credUUID string) error {
+	return r.retries.do(opCreds, true, func() error {
+		return r.VolumeDriver.CredsValidate(credUUID)
+	})
+}
@@ -0,0 +1,146 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want errorClass
+	}{
+		{name: "nil", err: nil, want: errorNone},
+		{name: "grpc unavailable", err: status.Error(codes.Unavailable, "down"), want: errorTransient},
+		{name: "grpc resource exhausted", err: status.Error(codes.ResourceExhausted, "busy"), want: errorTransient},
+		{name: "grpc aborted", err: status.Error(codes.Aborted, "conflict"), want: errorTransient},
+		{name: "grpc deadline", err: status.Error(codes.DeadlineExceeded, "slow"), want: errorUnknownOutcome},
+		{name: "grpc not found", err: status.Error(codes.NotFound, "gone"), want: errorPermanent},
+		{name: "grpc permission denied", err: status.Error(codes.PermissionDenied, "denied"), want: errorPermanent},
+		{name: "grpc internal quorum", err: status.Error(codes.Internal, "node is not in quorum"), want: errorTransient},
+		{name: "grpc internal", err: status.Error(codes.Internal, "bad request"), want: errorPermanent},
+		{name: "kvdb leader changed", err: errors.New("failed to update volume: etcdserver: leader changed"), want: errorTransient},
+		{name: "kvdb no leader", err: errors.New("Failed to get lock: etcdserver: no leader"), want: errorTransient},
+		{name: "consul no leader", err: errors.New("Unexpected response code: 500 (No cluster leader)"), want: errorTransient},
+		{name: "leader in a name", err: errors.New("volume pvc-leader-election not found"), want: errorPermanent},
+		{
+			name: "net timeout",
+			err:  &net.OpError{Op: "dial", Err: timeoutError{}},
+			want: errorUnknownOutcome,
+		},
+		{
+			name: "net error",
+			err:  fmt.Errorf("request failed: %w", &net.OpError{Op: "dial", Err: errors.New("refused")}),
+			want: errorTransient,
+		},
+		{name: "rest timeout", err: errors.New("Client.Timeout exceeded"), want: errorUnknownOutcome},
+		{name: "rest connection refused", err: errors.New("dial tcp: Connection refused"), want: errorTransient},
+		{name: "rest unavailable", err: errors.New("503 Service Unavailable"), want: errorTransient},
+		{name: "rest not found", err: errors.New("volume not found"), want: errorPermanent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := classifyError(test.err); got != test.want {
+				t.Errorf("class of %v is %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+// timeoutError is a net error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestParseRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]string
+		check   func(*retryPolicy) error
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			config: map[string]string{},
+			check: func(r *retryPolicy) error {
+				for op, budget := range defaultRetryBudgets {
+					if r.budgets[op] != budget {
+						return fmt.Errorf("budget of %v is %v, want %v", op, r.budgets[op], budget)
+					}
+				}
+				if r.initialBackoff != defaultRetryInitialBackoff || r.maxBackoff != defaultRetryMaxBackoff {
+					return fmt.Errorf("backoff is %v-%v", r.initialBackoff, r.maxBackoff)
+				}
+				if r.breaker.threshold != defaultCircuitBreakerFailures || r.breaker.cooldown != defaultCircuitBreakerCooldown {
+					return fmt.Errorf("circuit breaker is %v/%v", r.breaker.threshold, r.breaker.cooldown)
+				}
+				return nil
+			},
+		},
+		{
+			name: "overrides",
+			config: map[string]string{
+				configRetryBudgets:           "inspect=5m, delete=0s",
+				configRetryInitialBackoff:    "2s",
+				configRetryMaxBackoff:        "1m",
+				configCircuitBreakerFailures: "0",
+				configCircuitBreakerCooldown: "30s",
+			},
+			check: func(r *retryPolicy) error {
+				if r.budgets[opInspect] != 5*time.Minute || r.budgets[opDelete] != 0 {
+					return fmt.Errorf("budgets are %v", r.budgets)
+				}
+				if r.budgets[opSnapshot] != defaultRetryBudgets[opSnapshot] {
+					return fmt.Errorf("budget of %v is %v", opSnapshot, r.budgets[opSnapshot])
+				}
+				if r.initialBackoff != 2*time.Second || r.maxBackoff != time.Minute {
+					return fmt.Errorf("backoff is %v-%v", r.initialBackoff, r.maxBackoff)
+				}
+				if r.breaker.threshold != 0 || r.breaker.cooldown != 30*time.Second {
+					return fmt.Errorf("circuit breaker is %v/%v", r.breaker.threshold, r.breaker.cooldown)
+				}
+				return nil
+			},
+		},
+		{name: "unknown operation", config: map[string]string{configRetryBudgets: "resize=1m"}, wantErr: true},
+		{name: "invalid budget", config: map[string]string{configRetryBudgets: "inspect=soon"}, wantErr: true},
+		{name: "negative budget", config: map[string]string{configRetryBudgets: "inspect=-1s"}, wantErr: true},
+		{name: "invalid pair", config: map[string]string{configRetryBudgets: "inspect"}, wantErr: true},
+		{name: "zero backoff", config: map[string]string{configRetryInitialBackoff: "0s"}, wantErr: true},
+		{
+			name:    "max backoff below initial",
+			config:  map[string]string{configRetryInitialBackoff: "10s", configRetryMaxBackoff: "5s"},
+			wantErr: true,
+		},
+		{name: "invalid failures", config: map[string]string{configCircuitBreakerFailures: "-1"}, wantErr: true},
+		{name: "invalid cooldown", config: map[string]string{configCircuitBreakerCooldown: "later"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := parseRetryPolicy(test.config)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parse of %v succeeded, want an error", test.config)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse of %v failed: %v", test.config, err)
+			}
+			if err := test.check(r); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
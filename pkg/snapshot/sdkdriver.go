@@ -0,0 +1,488 @@
+package snapshot
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/libopenstorage/openstorage/volume"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// sdkCallTimeout is the timeout of calls to the Portworx SDK
+	sdkCallTimeout = time.Minute
+
+	// Cloud credential types in the credential params
+	credTypeS3     = "s3"
+	credTypeAzure  = "azure"
+	credTypeGoogle = "google"
+)
+
+// sdkVolumeDriver implements the volume driver calls made by the plugin with
+// the Portworx SDK. Calls without an SDK equivalent go to the embedded REST
+// volume driver.
+type sdkVolumeDriver struct {
+	volume.VolumeDriver
+	volumes      api.OpenStorageVolumeClient
+	cloudBackups api.OpenStorageCloudBackupClient
+	creds        api.OpenStorageCredentialsClient
+	trims        api.OpenStorageFilesystemTrimClient
+	checks       api.OpenStorageFilesystemCheckClient
+	// token is the tenant token calls are made with instead of the plugin
+	// token, if any
+	token string
+}
+
+func newSdkVolumeDriver(conn *grpc.ClientConn, rest volume.VolumeDriver) *sdkVolumeDriver {
+	return &sdkVolumeDriver{
+		VolumeDriver: rest,
+		volumes:      api.NewOpenStorageVolumeClient(conn),
+		cloudBackups: api.NewOpenStorageCloudBackupClient(conn),
+		creds:        api.NewOpenStorageCredentialsClient(conn),
+		trims:        api.NewOpenStorageFilesystemTrimClient(conn),
+		checks:       api.NewOpenStorageFilesystemCheckClient(conn),
+	}
+}
+
+func (s *sdkVolumeDriver) context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), sdkCallTimeout)
+	return withTenantToken(ctx, s.token), cancel
+}
+
+// Inspect returns the volumes that exist out of the given ones, like the
+// REST driver
+func (s *sdkVolumeDriver) Inspect(volumeIDs []string) ([]*api.Volume, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	var vols []*api.Volume
+	for _, volumeID := range volumeIDs {
+		resp, err := s.volumes.Inspect(ctx, &api.SdkVolumeInspectRequest{VolumeId: volumeID})
+		if status.Code(err) == codes.NotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		vols = append(vols, resp.GetVolume())
+	}
+	return vols, nil
+}
+
+// Snapshot takes a read-only snapshot of the volume, or a writable clone
+// if readonly is false
+func (s *sdkVolumeDriver) Snapshot(volumeID string, readonly bool, locator *api.VolumeLocator, noRetry bool) (string, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	if readonly {
+		resp, err := s.volumes.SnapshotCreate(ctx, &api.SdkVolumeSnapshotCreateRequest{
+			VolumeId: volumeID,
+			Name:     locator.GetName(),
+			Labels:   locator.GetVolumeLabels(),
+		})
+		if err != nil {
+			return "", err
+		}
+		return resp.GetSnapshotId(), nil
+	}
+
+	resp, err := s.volumes.Clone(ctx, &api.SdkVolumeCloneRequest{
+		Name:     locator.GetName(),
+		ParentId: volumeID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if labels := locator.GetVolumeLabels(); len(labels) > 0 {
+		_, err = s.volumes.Update(ctx, &api.SdkVolumeUpdateRequest{
+			VolumeId: resp.GetVolumeId(),
+			Labels:   labels,
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return resp.GetVolumeId(), nil
+}
+
+// Set updates the labels and ownership of the volume with the SDK. Spec
+// updates go to the REST driver since the plugin updates whole specs while
+// the SDK only takes the changed fields.
+func (s *sdkVolumeDriver) Set(volumeID string, locator *api.VolumeLocator, spec *api.VolumeSpec) error {
+	if spec != nil {
+		return s.VolumeDriver.Set(volumeID, locator, spec)
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+	request := &api.SdkVolumeUpdateRequest{
+		VolumeId: volumeID,
+		Labels:   locator.GetVolumeLabels(),
+	}
+	if ownership := locator.GetOwnership(); ownership != nil {
+		request.Spec = &api.VolumeSpecUpdate{Ownership: ownership}
+	}
+	_, err := s.volumes.Update(ctx, request)
+	return err
+}
+
+func (s *sdkVolumeDriver) Delete(ctx context.Context, volumeID string) error {
+	_, err := s.volumes.Delete(withTenantToken(ctx, s.token), &api.SdkVolumeDeleteRequest{VolumeId: volumeID})
+	return err
+}
+
+func (s *sdkVolumeDriver) CloudBackupCreate(input *api.CloudBackupCreateRequest) (*api.CloudBackupCreateResponse, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	resp, err := s.cloudBackups.Create(ctx, &api.SdkCloudBackupCreateRequest{
+		VolumeId:            input.VolumeID,
+		CredentialId:        input.CredentialUUID,
+		Full:                input.Full,
+		TaskId:              input.Name,
+		Labels:              input.Labels,
+		FullBackupFrequency: input.FullBackupFrequency,
+		DeleteLocal:         input.DeleteLocal,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &api.CloudBackupCreateResponse{Name: resp.GetTaskId()}, nil
+}
+
+func (s *sdkVolumeDriver) CloudBackupGroupCreate(input *api.CloudBackupGroupCreateRequest) (*api.CloudBackupGroupCreateResponse, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	resp, err := s.cloudBackups.GroupCreate(ctx, &api.SdkCloudBackupGroupCreateRequest{
+		GroupId:      input.GroupID,
+		VolumeIds:    input.VolumeIDs,
+		CredentialId: input.CredentialUUID,
+		Full:         input.Full,
+		Labels:       input.Labels,
+		DeleteLocal:  input.DeleteLocal,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &api.CloudBackupGroupCreateResponse{
+		GroupCloudBackupID: resp.GetGroupCloudBackupId(),
+		Names:              resp.GetTaskIds(),
+	}, nil
+}
+
+func (s *sdkVolumeDriver) CloudBackupRestore(input *api.CloudBackupRestoreRequest) (*api.CloudBackupRestoreResponse, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	resp, err := s.cloudBackups.Restore(ctx, &api.SdkCloudBackupRestoreRequest{
+		BackupId:          input.ID,
+		RestoreVolumeName: input.RestoreVolumeName,
+		CredentialId:      input.CredentialUUID,
+		NodeId:            input.NodeID,
+		TaskId:            input.Name,
+		Spec:              input.Spec,
+		Locator:           input.Locator,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &api.CloudBackupRestoreResponse{
+		RestoreVolumeID: resp.GetRestoreVolumeId(),
+		Name:            resp.GetTaskId(),
+	}, nil
+}
+
+func (s *sdkVolumeDriver) CloudBackupEnumerate(input *api.CloudBackupEnumerateRequest) (*api.CloudBackupEnumerateResponse, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	request := &api.SdkCloudBackupEnumerateWithFiltersRequest{
+		SrcVolumeId:       input.SrcVolumeID,
+		ClusterId:         input.ClusterID,
+		CredentialId:      input.CredentialUUID,
+		All:               input.All,
+		MetadataFilter:    input.MetadataFilter,
+		MaxBackups:        input.MaxBackups,
+		ContinuationToken: input.ContinuationToken,
+		CloudBackupId:     input.CloudBackupID,
+		MissingSrcVolumes: input.MissingSrcVolumes,
+	}
+	if input.StatusFilter != "" {
+		request.StatusFilter = api.CloudBackupStatusTypeToSdkCloudBackupStatusType(input.StatusFilter)
+	}
+	resp, err := s.cloudBackups.EnumerateWithFilters(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	enumResponse := &api.CloudBackupEnumerateResponse{ContinuationToken: resp.GetContinuationToken()}
+	for _, backup := range resp.GetBackups() {
+		info := api.CloudBackupInfo{
+			ID:            backup.GetId(),
+			SrcVolumeID:   backup.GetSrcVolumeId(),
+			SrcVolumeName: backup.GetSrcVolumeName(),
+			Metadata:      backup.GetMetadata(),
+			Status:        api.SdkCloudBackupStatusTypeToCloudBackupStatusString(backup.GetStatus()),
+			ClusterType:   backup.GetClusterType(),
+			Namespace:     backup.GetNamespace(),
+		}
+		if backup.GetTimestamp() != nil {
+			info.Timestamp = backup.GetTimestamp().AsTime()
+		}
+		enumResponse.Backups = append(enumResponse.Backups, info)
+	}
+	return enumResponse, nil
+}
+
+func (s *sdkVolumeDriver) CloudBackupDelete(input *api.CloudBackupDeleteRequest) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	_, err := s.cloudBackups.Delete(ctx, &api.SdkCloudBackupDeleteRequest{
+		BackupId:     input.ID,
+		CredentialId: input.CredentialUUID,
+		Force:        input.Force,
+	})
+	return err
+}
+
+func (s *sdkVolumeDriver) CloudBackupStatus(input *api.CloudBackupStatusRequest) (*api.CloudBackupStatusResponse, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	resp, err := s.cloudBackups.Status(ctx, &api.SdkCloudBackupStatusRequest{
+		VolumeId: input.SrcVolumeID,
+		Local:    input.Local,
+		TaskId:   input.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	statusResponse := &api.CloudBackupStatusResponse{Statuses: make(map[string]api.CloudBackupStatus)}
+	for name, st := range resp.GetStatuses() {
+		cbStatus := api.CloudBackupStatus{
+			ID:     st.GetBackupId(),
+			OpType: api.SdkCloudBackupOpTypeToCloudBackupOpType(st.GetOptype()),
+			Status: api.CloudBackupStatusType(
+				api.SdkCloudBackupStatusTypeToCloudBackupStatusString(st.GetStatus())),
+			BytesDone:          st.GetBytesDone(),
+			BytesTotal:         st.GetBytesTotal(),
+			EtaSeconds:         st.GetEtaSeconds(),
+			NodeID:             st.GetNodeId(),
+			SrcVolumeID:        st.GetSrcVolumeId(),
+			Info:               st.GetInfo(),
+			CredentialUUID:     st.GetCredentialId(),
+			GroupCloudBackupID: st.GetGroupId(),
+		}
+		if st.GetStartTime() != nil {
+			cbStatus.StartTime = st.GetStartTime().AsTime()
+		}
+		if st.GetCompletedTime() != nil {
+			cbStatus.CompletedTime = st.GetCompletedTime().AsTime()
+		}
+		statusResponse.Statuses[name] = cbStatus
+	}
+	return statusResponse, nil
+}
+
+func (s *sdkVolumeDriver) CloudBackupStateChange(input *api.CloudBackupStateChangeRequest) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	_, err := s.cloudBackups.StateChange(ctx, &api.SdkCloudBackupStateChangeRequest{
+		TaskId:         input.Name,
+		RequestedState: api.CloudBackupRequestedStateToSdkCloudBackupRequestedState(input.RequestedState),
+	})
+	return err
+}
+
+func (s *sdkVolumeDriver) FilesystemTrimStart(request *api.SdkFilesystemTrimStartRequest) (*api.SdkFilesystemTrimStartResponse, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.trims.Start(ctx, request)
+}
+
+func (s *sdkVolumeDriver) FilesystemTrimStatus(request *api.SdkFilesystemTrimStatusRequest) (*api.SdkFilesystemTrimStatusResponse, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.trims.Status(ctx, request)
+}
+
+func (s *sdkVolumeDriver) FilesystemTrimStop(request *api.SdkFilesystemTrimStopRequest) (*api.SdkFilesystemTrimStopResponse, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.trims.Stop(ctx, request)
+}
+
+func (s *sdkVolumeDriver) FilesystemCheckStart(request *api.SdkFilesystemCheckStartRequest) (*api.SdkFilesystemCheckStartResponse, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.checks.Start(ctx, request)
+}
+
+func (s *sdkVolumeDriver) FilesystemCheckStatus(request *api.SdkFilesystemCheckStatusRequest) (*api.SdkFilesystemCheckStatusResponse, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.checks.Status(ctx, request)
+}
+
+func (s *sdkVolumeDriver) FilesystemCheckStop(request *api.SdkFilesystemCheckStopRequest) (*api.SdkFilesystemCheckStopResponse, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.checks.Stop(ctx, request)
+}
+
+// CredsCreate creates the credential with the SDK, or with the REST driver
+// if its params have no SDK equivalent
+func (s *sdkVolumeDriver) CredsCreate(params map[string]string) (string, error) {
+	request, err := sdkCredentialRequest(params)
+	if err != nil {
+		return s.VolumeDriver.CredsCreate(params)
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+	resp, err := s.creds.Create(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	return resp.GetCredentialId(), nil
+}
+
+// CredsUpdate updates the credential with the given name or UUID with the
+// SDK, or with the REST driver if its params have no SDK equivalent
+func (s *sdkVolumeDriver) CredsUpdate(name string, params map[string]string) error {
+	request, err := sdkCredentialRequest(params)
+	if err != nil {
+		return s.VolumeDriver.CredsUpdate(name, params)
+	}
+
+	credID, err := s.credentialID(name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+	_, err = s.creds.Update(ctx, &api.SdkCredentialUpdateRequest{
+		CredentialId: credID,
+		UpdateReq:    request,
+	})
+	return err
+}
+
+// CredsEnumerate returns the params of the credentials by UUID. Only the
+// name, type and bucket are returned since the SDK doesn't return secrets.
+func (s *sdkVolumeDriver) CredsEnumerate() (map[string]interface{}, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	resp, err := s.creds.Enumerate(ctx, &api.SdkCredentialEnumerateRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	creds := make(map[string]interface{})
+	for _, credID := range resp.GetCredentialIds() {
+		cred, err := s.creds.Inspect(ctx, &api.SdkCredentialInspectRequest{CredentialId: credID})
+		if err != nil {
+			return nil, err
+		}
+
+		params := map[string]interface{}{
+			api.OptCredUUID:   credID,
+			api.OptCredName:   cred.GetName(),
+			api.OptCredBucket: cred.GetBucket(),
+		}
+		switch {
+		case cred.GetAwsCredential() != nil:
+			params[api.OptCredType] = credTypeS3
+		case cred.GetAzureCredential() != nil:
+			params[api.OptCredType] = credTypeAzure
+		case cred.GetGoogleCredential() != nil:
+			params[api.OptCredType] = credTypeGoogle
+		}
+		creds[credID] = params
+	}
+	return creds, nil
+}
+
+func (s *sdkVolumeDriver) CredsValidate(credUUID string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	_, err := s.creds.Validate(ctx, &api.SdkCredentialValidateRequest{CredentialId: credUUID})
+	return err
+}
+
+// credentialID returns the UUID of the credential with the given name or
+// UUID
+func (s *sdkVolumeDriver) credentialID(name string) (string, error) {
+	creds, err := s.CredsEnumerate()
+	if err != nil {
+		return "", err
+	}
+	if _, ok := creds[name]; ok {
+		return name, nil
+	}
+	return resolveCredentialName(s, name)
+}
+
+// sdkCredentialRequest converts credential params to an SDK request
+func sdkCredentialRequest(params map[string]string) (*api.SdkCredentialCreateRequest, error) {
+	if params[api.OptCredOwnership] != "" {
+		return nil, fmt.Errorf("credential ownership is not supported by the SDK")
+	}
+
+	request := &api.SdkCredentialCreateRequest{
+		Name:           params[api.OptCredName],
+		Bucket:         params[api.OptCredBucket],
+		EncryptionKey:  params[api.OptCredEncrKey],
+		S3StorageClass: params[api.OptCredStorageClass],
+		UseProxy:       parseCredBool(params[api.OptCredProxy]),
+		IamPolicy:      parseCredBool(params[api.OptCredIAMPolicy]),
+	}
+
+	switch credType := params[api.OptCredType]; credType {
+	case credTypeS3:
+		request.CredentialType = &api.SdkCredentialCreateRequest_AwsCredential{
+			AwsCredential: &api.SdkAwsCredentialRequest{
+				AccessKey:        params[api.OptCredAccessKey],
+				SecretKey:        params[api.OptCredSecretKey],
+				Endpoint:         params[api.OptCredEndpoint],
+				Region:           params[api.OptCredRegion],
+				DisableSsl:       parseCredBool(params[api.OptCredDisableSSL]),
+				DisablePathStyle: parseCredBool(params[api.OptCredDisablePathStyle]),
+			},
+		}
+	case credTypeAzure:
+		request.CredentialType = &api.SdkCredentialCreateRequest_AzureCredential{
+			AzureCredential: &api.SdkAzureCredentialRequest{
+				AccountName: params[api.OptCredAzureAccountName],
+				AccountKey:  params[api.OptCredAzureAccountKey],
+			},
+		}
+	case credTypeGoogle:
+		request.CredentialType = &api.SdkCredentialCreateRequest_GoogleCredential{
+			GoogleCredential: &api.SdkGoogleCredentialRequest{
+				ProjectId: params[api.OptCredGoogleProjectID],
+				JsonKey:   params[api.OptCredGoogleJsonKey],
+			},
+		}
+	default:
+		return nil, fmt.Errorf("credential type %q is not supported by the SDK", credType)
+	}
+	return request, nil
+}
+
+func parseCredBool(value string) bool {
+	b, _ := strconv.ParseBool(value)
+	return b
+}
@@ -0,0 +1,146 @@
+package snapshot
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+const (
+	// cloudSnapshotIDPrefix identifies snapshot IDs that carry the cloud
+	// backup details needed for restore. IDs without it are legacy IDs
+	// which are just the Portworx cloud backup ID.
+	cloudSnapshotIDPrefix = "px-cloudsnap:"
+
+	cloudSnapshotIDVersion = 1
+
+	// hybridSnapshotIDPrefix identifies snapshot IDs of hybrid snapshots
+	hybridSnapshotIDPrefix = "px-hybridsnap:"
+
+	hybridSnapshotIDVersion = 1
+)
+
+// cloudSnapshotID is the snapshot ID returned to Velero for cloud snapshots
+type cloudSnapshotID struct {
+	// Version of the ID format, 0 for legacy IDs
+	Version int `json:"v"`
+	// CloudBackupID is the Portworx cloud backup ID
+	CloudBackupID string `json:"id"`
+	// SrcVolumeName is the name of the volume that was backed up
+	SrcVolumeName string `json:"volumeName,omitempty"`
+	// CredentialUUID is the credential used to take the backup
+	CredentialUUID string `json:"credId,omitempty"`
+	// Labels are set on the volume restored from the backup
+	Labels map[string]string `json:"labels,omitempty"`
+	// Ownership of the volume that was backed up
+	Ownership *api.Ownership `json:"ownership,omitempty"`
+}
+
+// isLegacy returns true if the ID was parsed from a plain cloud backup ID
+func (id *cloudSnapshotID) isLegacy() bool {
+	return id.Version == 0
+}
+
+// encode returns the ID in the format returned to Velero
+func (id *cloudSnapshotID) encode() (string, error) {
+	if id.isLegacy() {
+		return id.CloudBackupID, nil
+	}
+	return encodeSnapshotID(cloudSnapshotIDPrefix, id)
+}
+
+// newCloudSnapshotID returns an ID in the current format
+func newCloudSnapshotID(cloudBackupID, srcVolumeName, credID string, labels map[string]string) *cloudSnapshotID {
+	return &cloudSnapshotID{
+		Version:        cloudSnapshotIDVersion,
+		CloudBackupID:  cloudBackupID,
+		SrcVolumeName:  srcVolumeName,
+		CredentialUUID: credID,
+		Labels:         labels,
+	}
+}
+
+// parseCloudSnapshotID parses a snapshot ID returned by CreateSnapshot.
+// Legacy IDs are returned with only the cloud backup ID set.
+func parseCloudSnapshotID(snapshotID string) (*cloudSnapshotID, error) {
+	if !strings.HasPrefix(snapshotID, cloudSnapshotIDPrefix) {
+		return &cloudSnapshotID{CloudBackupID: snapshotID}, nil
+	}
+
+	id := &cloudSnapshotID{}
+	if err := decodeSnapshotID(cloudSnapshotIDPrefix, snapshotID, id); err != nil {
+		return nil, err
+	}
+	if id.Version < 1 || id.Version > cloudSnapshotIDVersion {
+		return nil, fmt.Errorf("unsupported cloud snapshot ID version %v in %v", id.Version, snapshotID)
+	}
+	if id.CloudBackupID == "" {
+		return nil, fmt.Errorf("cloud backup ID missing from cloud snapshot ID %v", snapshotID)
+	}
+	return id, nil
+}
+
+// hybridSnapshotID is the snapshot ID returned to Velero for hybrid
+// snapshots. The cloud backup ID isn't known when the snapshot is returned,
+// so the cloud backup is found from its labels when needed.
+type hybridSnapshotID struct {
+	// Version of the ID format
+	Version int `json:"v"`
+	// LocalSnapshotID is the ID of the local snapshot
+	LocalSnapshotID string `json:"localId"`
+	// SrcVolumeName is the name of the volume that was snapshotted
+	SrcVolumeName string `json:"volumeName,omitempty"`
+	// CredentialUUID is the credential used to upload the snapshot
+	CredentialUUID string `json:"credId,omitempty"`
+	// Labels are set on the volume restored from the cloud backup
+	Labels map[string]string `json:"labels,omitempty"`
+	// Ownership of the volume that was snapshotted
+	Ownership *api.Ownership `json:"ownership,omitempty"`
+}
+
+// encode returns the ID in the format returned to Velero
+func (id *hybridSnapshotID) encode() (string, error) {
+	return encodeSnapshotID(hybridSnapshotIDPrefix, id)
+}
+
+// parseHybridSnapshotID parses a snapshot ID returned by CreateSnapshot of
+// the hybrid plugin
+func parseHybridSnapshotID(snapshotID string) (*hybridSnapshotID, error) {
+	if !strings.HasPrefix(snapshotID, hybridSnapshotIDPrefix) {
+		return nil, fmt.Errorf("invalid hybrid snapshot ID %v", snapshotID)
+	}
+
+	id := &hybridSnapshotID{}
+	if err := decodeSnapshotID(hybridSnapshotIDPrefix, snapshotID, id); err != nil {
+		return nil, err
+	}
+	if id.Version < 1 || id.Version > hybridSnapshotIDVersion {
+		return nil, fmt.Errorf("unsupported hybrid snapshot ID version %v in %v", id.Version, snapshotID)
+	}
+	if id.LocalSnapshotID == "" {
+		return nil, fmt.Errorf("local snapshot ID missing from hybrid snapshot ID %v", snapshotID)
+	}
+	return id, nil
+}
+
+func encodeSnapshotID(prefix string, id interface{}) (string, error) {
+	data, err := json.Marshal(id)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode snapshot ID: %v", err)
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeSnapshotID(prefix, snapshotID string, id interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(snapshotID, prefix))
+	if err != nil {
+		return fmt.Errorf("invalid snapshot ID %v: %v", snapshotID, err)
+	}
+	if err := json.Unmarshal(data, id); err != nil {
+		return fmt.Errorf("invalid snapshot ID %v: %v", snapshotID, err)
+	}
+	return nil
+}
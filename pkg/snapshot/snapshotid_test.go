@@ -0,0 +1,173 @@
+package snapshot
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+)
+
+func TestCloudSnapshotIDRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		id   *cloudSnapshotID
+	}{
+		{
+			name: "minimal",
+			id:   newCloudSnapshotID("bucket/vol-1-backup", "", "", nil),
+		},
+		{
+			name: "all fields",
+			id: &cloudSnapshotID{
+				Version:        cloudSnapshotIDVersion,
+				CloudBackupID:  "bucket/vol-1-backup",
+				SrcVolumeName:  "pvc-1234",
+				CredentialUUID: "cred-uuid",
+				Labels:         map[string]string{pvcNameLabel: "data", pvcNamespaceLabel: "app"},
+				Ownership:      &api.Ownership{Owner: "tenant"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := test.id.encode()
+			if err != nil {
+				t.Fatalf("encode failed: %v", err)
+			}
+			if !strings.HasPrefix(encoded, cloudSnapshotIDPrefix) {
+				t.Fatalf("encoded ID %q doesn't start with %q", encoded, cloudSnapshotIDPrefix)
+			}
+			parsed, err := parseCloudSnapshotID(encoded)
+			if err != nil {
+				t.Fatalf("parse of %q failed: %v", encoded, err)
+			}
+			if !reflect.DeepEqual(parsed, test.id) {
+				t.Errorf("parsed ID is %+v, want %+v", parsed, test.id)
+			}
+		})
+	}
+}
+
+func TestParseLegacyCloudSnapshotID(t *testing.T) {
+	tests := []string{
+		"bucket/vol-1-backup",
+		"8a2c4f0e-6b9d-4c1e-9f3a-7d5e2b1c0a94/1041758245698281342-1234567890",
+		"",
+	}
+
+	for _, snapshotID := range tests {
+		t.Run(snapshotID, func(t *testing.T) {
+			id, err := parseCloudSnapshotID(snapshotID)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if !id.isLegacy() {
+				t.Errorf("ID %q is not parsed as legacy", snapshotID)
+			}
+			if id.CloudBackupID != snapshotID {
+				t.Errorf("cloud backup ID is %q, want %q", id.CloudBackupID, snapshotID)
+			}
+			encoded, err := id.encode()
+			if err != nil {
+				t.Fatalf("encode failed: %v", err)
+			}
+			if encoded != snapshotID {
+				t.Errorf("legacy ID is encoded as %q, want %q", encoded, snapshotID)
+			}
+		})
+	}
+}
+
+func TestParseInvalidCloudSnapshotID(t *testing.T) {
+	unsupported, _ := encodeSnapshotID(cloudSnapshotIDPrefix, &cloudSnapshotID{
+		Version:       cloudSnapshotIDVersion + 1,
+		CloudBackupID: "bucket/backup",
+	})
+	missingBackup, _ := encodeSnapshotID(cloudSnapshotIDPrefix, &cloudSnapshotID{
+		Version: cloudSnapshotIDVersion,
+	})
+
+	tests := []struct {
+		name       string
+		snapshotID string
+	}{
+		{name: "not base64", snapshotID: cloudSnapshotIDPrefix + "!!!"},
+		{name: "not json", snapshotID: cloudSnapshotIDPrefix + "bm90IGpzb24"},
+		{name: "unsupported version", snapshotID: unsupported},
+		{name: "missing cloud backup ID", snapshotID: missingBackup},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if id, err := parseCloudSnapshotID(test.snapshotID); err == nil {
+				t.Errorf("parse of %q returned %+v, want an error", test.snapshotID, id)
+			}
+		})
+	}
+}
+
+func TestHybridSnapshotIDRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		id   *hybridSnapshotID
+	}{
+		{
+			name: "minimal",
+			id:   &hybridSnapshotID{Version: hybridSnapshotIDVersion, LocalSnapshotID: "1234"},
+		},
+		{
+			name: "all fields",
+			id: &hybridSnapshotID{
+				Version:         hybridSnapshotIDVersion,
+				LocalSnapshotID: "1234",
+				SrcVolumeName:   "pvc-1234",
+				CredentialUUID:  "cred-uuid",
+				Labels:          map[string]string{pvcNameLabel: "data"},
+				Ownership:       &api.Ownership{Owner: "tenant"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := test.id.encode()
+			if err != nil {
+				t.Fatalf("encode failed: %v", err)
+			}
+			parsed, err := parseHybridSnapshotID(encoded)
+			if err != nil {
+				t.Fatalf("parse of %q failed: %v", encoded, err)
+			}
+			if !reflect.DeepEqual(parsed, test.id) {
+				t.Errorf("parsed ID is %+v, want %+v", parsed, test.id)
+			}
+		})
+	}
+}
+
+func TestParseInvalidHybridSnapshotID(t *testing.T) {
+	cloudID, _ := newCloudSnapshotID("bucket/backup", "", "", nil).encode()
+	missingLocal, _ := encodeSnapshotID(hybridSnapshotIDPrefix, &hybridSnapshotID{
+		Version: hybridSnapshotIDVersion,
+	})
+
+	tests := []struct {
+		name       string
+		snapshotID string
+	}{
+		{name: "local snapshot ID", snapshotID: "1234"},
+		{name: "cloud snapshot ID", snapshotID: cloudID},
+		{name: "not base64", snapshotID: hybridSnapshotIDPrefix + "!!!"},
+		{name: "missing local snapshot ID", snapshotID: missingLocal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if id, err := parseHybridSnapshotID(test.snapshotID); err == nil {
+				t.Errorf("parse of %q returned %+v, want an error", test.snapshotID, id)
+			}
+		})
+	}
+}
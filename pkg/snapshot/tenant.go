@@ -0,0 +1,286 @@
+package snapshot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	volumeclient "github.com/libopenstorage/openstorage/api/client/volume"
+	"github.com/libopenstorage/openstorage/volume"
+	"github.com/portworx/sched-ops/k8s/core"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// configTenantTokens makes Portworx calls for a volume with the token of
+	// the tenant owning it, the namespace of its PVC. Calls fail if the token
+	// of the tenant can't be found.
+	configTenantTokens = "tenantTokens"
+	// configTenantTokenSecret is the name of the Secret with the token of
+	// the tenant in each namespace, used when the StorageClass of the PVC
+	// doesn't reference one
+	configTenantTokenSecret = "tenantTokenSecret"
+	// configTenantTokenSecretKey is the key of the token in tenant Secrets
+	configTenantTokenSecretKey = "tenantTokenSecretKey"
+
+	defaultTenantTokenSecret = "px-user-token"
+	// maxTenantRestDrivers is the number of tenant REST drivers kept
+	maxTenantRestDrivers = 100
+
+	// StorageClass parameters referencing the Secret with the token used to
+	// provision volumes, by the CSI driver and the in-tree driver
+	csiProvisionerSecretNameParam      = "csi.storage.k8s.io/provisioner-secret-name"
+	csiProvisionerSecretNamespaceParam = "csi.storage.k8s.io/provisioner-secret-namespace"
+	pxAuthSecretNameParam              = "openstorage.io/auth-secret-name"
+	pxAuthSecretNamespaceParam         = "openstorage.io/auth-secret-namespace"
+)
+
+// tenantTokenKey is the context key of the tenant token of SDK calls
+type tenantTokenKey struct{}
+
+// tenantConfig resolves the tokens of the tenants owning volumes
+type tenantConfig struct {
+	enabled    bool
+	secretName string
+	secretKey  string
+}
+
+// parseTenantConfig parses the tenant token settings from the plugin config
+func parseTenantConfig(config map[string]string) (*tenantConfig, error) {
+	t := &tenantConfig{
+		secretName: defaultTenantTokenSecret,
+		secretKey:  defaultTokenSecretKey,
+	}
+	if value := config[configTenantTokens]; value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v %q, must be true or false", configTenantTokens, value)
+		}
+		t.enabled = enabled
+	}
+	if name := config[configTenantTokenSecret]; name != "" {
+		t.secretName = name
+	}
+	if key := config[configTenantTokenSecretKey]; key != "" {
+		t.secretKey = key
+	}
+	return t, nil
+}
+
+// tokenForPV returns the token of the tenant owning the PV, or an empty
+// string if tenant tokens are disabled or the PV isn't bound to a PVC. An
+// error is returned if the token of the tenant can't be found.
+func (t *tenantConfig) tokenForPV(kubeOps core.Ops, pvName string, log logrus.FieldLogger) (string, error) {
+	if t == nil || !t.enabled || pvName == "" {
+		return "", nil
+	}
+	pv, err := kubeOps.GetPersistentVolume(pvName)
+	if err != nil {
+		return "", fmt.Errorf("failed to get PV %v to find its tenant: %v", pvName, err)
+	}
+	if pv.Spec.ClaimRef == nil {
+		log.Debugf("PV %v is not bound to a PVC, using the plugin token", pvName)
+		return "", nil
+	}
+	return t.tokenForPVC(kubeOps, pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name, pv.Spec.StorageClassName)
+}
+
+// tokenForLabels returns the token of the tenant owning the PVC recorded in
+// the labels of a snapshot or cloud backup, or an empty string if tenant
+// tokens are disabled or no PVC is recorded. An error is returned if the
+// token of the tenant can't be found.
+func (t *tenantConfig) tokenForLabels(kubeOps core.Ops, labels map[string]string, log logrus.FieldLogger) (string, error) {
+	if t == nil || !t.enabled {
+		return "", nil
+	}
+	if labels[pvcNamespaceLabel] == "" {
+		log.Debugf("No PVC recorded in labels %v, using the plugin token", labels)
+		return "", nil
+	}
+	namespace, name := labels[pvcNamespaceLabel], labels[pvcNameLabel]
+	storageClass := ""
+	if name != "" {
+		// The PVC may be gone when restoring, the token of the namespace is
+		// used then
+		pvc, err := kubeOps.GetPersistentVolumeClaim(name, namespace)
+		if err != nil && !k8s_errors.IsNotFound(err) {
+			return "", fmt.Errorf("failed to get PVC %v/%v to find its tenant: %v", namespace, name, err)
+		}
+		if err == nil && pvc.Spec.StorageClassName != nil {
+			storageClass = *pvc.Spec.StorageClassName
+		}
+	}
+	return t.tokenForPVC(kubeOps, namespace, name, storageClass)
+}
+
+// tokenForPVC returns the token of the tenant owning the PVC. The token is
+// read from the Secret referenced by the StorageClass of the PVC if it has
+// one, and from the tenant Secret of the namespace otherwise.
+func (t *tenantConfig) tokenForPVC(kubeOps core.Ops, namespace, name, storageClass string) (string, error) {
+	secretName, secretNamespace := t.secretName, namespace
+	if storageClass != "" {
+		sc, err := kubeOps.GetStorageClassForPVC(&v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec:       v1.PersistentVolumeClaimSpec{StorageClassName: &storageClass},
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to get storage class %v of PVC %v/%v: %v", storageClass, namespace, name, err)
+		}
+		if scName, scNamespace := storageClassTokenSecret(sc.Parameters, namespace, name); scName != "" {
+			secretName, secretNamespace = scName, scNamespace
+		}
+	}
+
+	token, err := secretToken(kubeOps, secretName, secretNamespace, t.secretKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to get tenant token of PVC %v/%v from secret %v/%v: %v",
+			namespace, name, secretNamespace, secretName, err)
+	}
+	if token == "" {
+		return "", fmt.Errorf("tenant token secret %v/%v of PVC %v/%v has no %v key",
+			secretNamespace, secretName, namespace, name, t.secretKey)
+	}
+	return token, nil
+}
+
+// storageClassTokenSecret returns the name and namespace of the Secret with
+// the token referenced by the StorageClass parameters, with the PVC
+// templates resolved. An empty name is returned if there is none.
+func storageClassTokenSecret(params map[string]string, namespace, name string) (string, string) {
+	secretName, secretNamespace := params[csiProvisionerSecretNameParam], params[csiProvisionerSecretNamespaceParam]
+	if secretName == "" {
+		secretName, secretNamespace = params[pxAuthSecretNameParam], params[pxAuthSecretNamespaceParam]
+	}
+	if secretName == "" {
+		return "", ""
+	}
+	replacer := strings.NewReplacer("${pvc.namespace}", namespace, "${pvc.name}", name)
+	secretName, secretNamespace = replacer.Replace(secretName), replacer.Replace(secretNamespace)
+	if secretNamespace == "" {
+		secretNamespace = namespace
+	}
+	return secretName, secretNamespace
+}
+
+// getVolumeDriverForPV returns the volume driver making calls as the tenant
+// owning the PV
+func (p *portworxClient) getVolumeDriverForPV(pvName string, log logrus.FieldLogger) (volume.VolumeDriver, error) {
+	token, err := p.tenants.tokenForPV(p.kubeOps, pvName, log)
+	if err != nil {
+		return nil, err
+	}
+	return p.getTenantVolumeDriver(token)
+}
+
+// getVolumeDriverForLabels returns the volume driver making calls as the
+// tenant owning the PVC recorded in the labels of a snapshot or cloud backup
+func (p *portworxClient) getVolumeDriverForLabels(labels map[string]string, log logrus.FieldLogger) (volume.VolumeDriver, error) {
+	token, err := p.tenants.tokenForLabels(p.kubeOps, labels, log)
+	if err != nil {
+		return nil, err
+	}
+	return p.getTenantVolumeDriver(token)
+}
+
+// getVolumeDriverForVolume returns the volume driver making calls as the
+// tenant owning the PVC recorded in the labels of the volume or snapshot. The
+// plugin volume driver is returned if tenant tokens are disabled.
+func (p *portworxClient) getVolumeDriverForVolume(volumeID string, log logrus.FieldLogger) (volume.VolumeDriver, error) {
+	volDriver, err := p.getVolumeDriver()
+	if err != nil || !p.tenants.enabled {
+		return volDriver, err
+	}
+
+	vols, err := volDriver.Inspect([]string{volumeID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect volume %v to find its tenant: %v", volumeID, err)
+	}
+	if len(vols) == 0 {
+		return nil, fmt.Errorf("Volume %v not found", volumeID)
+	}
+	return p.getVolumeDriverForLabels(vols[0].GetLocator().GetVolumeLabels(), log)
+}
+
+// getTenantVolumeDriver returns a volume driver making calls with the tenant
+// token, or the plugin volume driver if the token is empty. Tenant drivers
+// share the SDK connection and the retry policy of the plugin and pass their
+// token with each call.
+func (p *portworxClient) getTenantVolumeDriver(token string) (volume.VolumeDriver, error) {
+	if token == "" {
+		return p.getVolumeDriver()
+	}
+
+	rest, err := p.getTenantRestDriver(token)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := p.getSdkConnection()
+	if err != nil {
+		return &retryVolumeDriver{VolumeDriver: rest, retries: p.retries}, nil
+	}
+	driver := newSdkVolumeDriver(conn, rest)
+	driver.token = token
+	return &retryVolumeDriver{VolumeDriver: driver, retries: p.retries}, nil
+}
+
+// getTenantRestDriver returns the REST driver authenticating with the tenant
+// token, created on first use
+func (p *portworxClient) getTenantRestDriver(token string) (volume.VolumeDriver, error) {
+	p.restLock.Lock()
+	defer p.restLock.Unlock()
+	if driver, ok := p.tenantRestDrivers[token]; ok {
+		return driver, nil
+	}
+
+	clnt, err := p.getRestClientWithAuth(token)
+	if err != nil {
+		return nil, err
+	}
+	// Tokens are rotated, so drivers of old tokens are dropped once there
+	// are too many
+	if p.tenantRestDrivers == nil || len(p.tenantRestDrivers) >= maxTenantRestDrivers {
+		p.tenantRestDrivers = make(map[string]volume.VolumeDriver)
+	}
+	driver := volumeclient.VolumeDriver(clnt)
+	p.tenantRestDrivers[token] = driver
+	return driver, nil
+}
+
+// withTenantToken returns a context making SDK calls with the tenant token,
+// if any
+func withTenantToken(ctx context.Context, token string) context.Context {
+	if token == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, tenantTokenKey{}, token)
+}
+
+// tokenCredentials authenticates SDK calls with the tenant token of the call
+// context, or the plugin token
+type tokenCredentials struct {
+	tokens *tokenManager
+	secure bool
+}
+
+func (t *tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, _ := ctx.Value(tenantTokenKey{}).(string)
+	if token == "" {
+		var err error
+		if token, err = t.tokens.getToken(); err != nil {
+			return nil, err
+		}
+	}
+	if token == "" {
+		return nil, nil
+	}
+	return map[string]string{"authorization": "Bearer " + token}, nil
+}
+
+func (t *tokenCredentials) RequireTransportSecurity() bool {
+	return t.secure
+}
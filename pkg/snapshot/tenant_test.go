@@ -0,0 +1,100 @@
+package snapshot
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/libopenstorage/openstorage/volume"
+)
+
+func TestStorageClassTokenSecret(t *testing.T) {
+	tests := []struct {
+		name          string
+		params        map[string]string
+		wantName      string
+		wantNamespace string
+	}{
+		{
+			name:   "no secret",
+			params: map[string]string{"repl": "3"},
+		},
+		{
+			name: "csi secret",
+			params: map[string]string{
+				csiProvisionerSecretNameParam:      "px-user-token",
+				csiProvisionerSecretNamespaceParam: "portworx",
+			},
+			wantName:      "px-user-token",
+			wantNamespace: "portworx",
+		},
+		{
+			name:          "csi secret in the PVC namespace",
+			params:        map[string]string{csiProvisionerSecretNameParam: "px-user-token"},
+			wantName:      "px-user-token",
+			wantNamespace: "app",
+		},
+		{
+			name: "csi templates",
+			params: map[string]string{
+				csiProvisionerSecretNameParam:      "${pvc.name}-token",
+				csiProvisionerSecretNamespaceParam: "${pvc.namespace}",
+			},
+			wantName:      "data-token",
+			wantNamespace: "app",
+		},
+		{
+			name: "in-tree secret",
+			params: map[string]string{
+				pxAuthSecretNameParam:      "px-user-token",
+				pxAuthSecretNamespaceParam: "portworx",
+			},
+			wantName:      "px-user-token",
+			wantNamespace: "portworx",
+		},
+		{
+			name: "csi secret takes precedence",
+			params: map[string]string{
+				csiProvisionerSecretNameParam: "csi-token",
+				pxAuthSecretNameParam:         "in-tree-token",
+				pxAuthSecretNamespaceParam:    "portworx",
+			},
+			wantName:      "csi-token",
+			wantNamespace: "app",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, namespace := storageClassTokenSecret(test.params, "app", "data")
+			if name != test.wantName || namespace != test.wantNamespace {
+				t.Errorf("secret is %v/%v, want %v/%v", namespace, name, test.wantNamespace, test.wantName)
+			}
+		})
+	}
+}
+
+func TestGetTenantVolumeDriverCache(t *testing.T) {
+	pxClient := testClient(newFakeVolumeDriver(), nil)
+	pxClient.pxEndpoint = "http://portworx-service.kube-system:9001"
+	restDriver := func(token string) volume.VolumeDriver {
+		driver, err := pxClient.getTenantVolumeDriver(token)
+		if err != nil {
+			t.Fatalf("failed to get driver of token %v: %v", token, err)
+		}
+		return driver.(*retryVolumeDriver).VolumeDriver
+	}
+
+	tenantA := restDriver("token-a")
+	if restDriver("token-a") != tenantA {
+		t.Errorf("driver of token-a was created again")
+	}
+	if restDriver("token-b") == tenantA {
+		t.Errorf("driver of token-a was used for token-b")
+	}
+	for i := 0; i < maxTenantRestDrivers; i++ {
+		restDriver(fmt.Sprintf("token-%d", i))
+	}
+	if len(pxClient.tenantRestDrivers) > maxTenantRestDrivers {
+		t.Errorf("%v drivers are kept, want at most %v", len(pxClient.tenantRestDrivers), maxTenantRestDrivers)
+	}
+}
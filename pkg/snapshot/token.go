@@ -0,0 +1,271 @@
+package snapshot
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libopenstorage/openstorage/pkg/auth"
+	"github.com/portworx/sched-ops/k8s/core"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// configTokenLifetime is the lifetime of the tokens generated from the
+	// shared secret, as a duration string
+	configTokenLifetime = "tokenLifetime"
+	// configTokenRole is the role of the generated tokens, system.user by
+	// default. system.admin must be set explicitly.
+	configTokenRole = "tokenRole"
+	// configTokenName is the name in the generated tokens
+	configTokenName = "tokenName"
+	// configTokenSubject is the subject of the generated tokens, which must
+	// be unique across all accounts accessing Portworx
+	configTokenSubject = "tokenSubject"
+
+	roleSystemUser  = "system.user"
+	roleSystemAdmin = "system.admin"
+
+	defaultTokenLifetime = time.Hour
+	defaultTokenName     = "Stork"
+	minTokenLifetime     = time.Minute
+	// tokenIATSubtract is subtracted from the issue time of tokens to allow
+	// for clock skew with Portworx
+	tokenIATSubtract = time.Minute
+
+	// Config parameters of a Secret holding a pre-issued token, used
+	// instead of generating tokens from the shared secret
+	pxTokenSecretNameKey      = "PX_TOKEN_SECRET_NAME"
+	pxTokenSecretNamespaceKey = "PX_TOKEN_SECRET_NAMESPACE"
+	pxTokenSecretKeyKey       = "PX_TOKEN_SECRET_KEY"
+
+	// defaultTokenSecretKey is the key of the token in the Secret
+	defaultTokenSecretKey = "auth-token"
+)
+
+var (
+	// tokenSecrets holds the tokens read from Secrets
+	tokenSecrets = make(map[tokenSecretKey]string)
+	// tokenSecretWatches holds the Secrets being watched
+	tokenSecretWatches = make(map[tokenSecretKey]bool)
+	tokenSecretLock    sync.Mutex
+)
+
+// tokenSecretKey identifies the token in a key of a Secret of a cluster.
+// Clients are reused per cluster by clusterKubeOps, so the client identifies
+// the cluster.
+type tokenSecretKey struct {
+	kubeOps   core.Ops
+	namespace string
+	name      string
+	key       string
+}
+
+func (k tokenSecretKey) String() string {
+	return k.namespace + "/" + k.name
+}
+
+// tokenManager generates the tokens used to authenticate to Portworx from
+// the shared secret, and reuses each token until it is about to expire.
+// Alternatively it returns a pre-issued token read from a Secret.
+type tokenManager struct {
+	sharedSecret string
+	claims       auth.Claims
+	lifetime     time.Duration
+
+	// secretKey is the Secret with the token, if any
+	secretKey *tokenSecretKey
+
+	lock    sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newTokenManager returns a token manager for the shared secret and issuer
+// configured from the plugin config
+func newTokenManager(config map[string]string, sharedSecret, issuer string) (*tokenManager, error) {
+	t := &tokenManager{
+		sharedSecret: sharedSecret,
+		lifetime:     defaultTokenLifetime,
+		claims: auth.Claims{
+			Issuer:  issuer,
+			Name:    defaultTokenName,
+			Subject: issuer + "." + uniqueID,
+			Roles:   []string{roleSystemUser},
+			// Be in all groups to have access to all resources
+			Groups: []string{"*"},
+		},
+	}
+
+	if value := config[configTokenLifetime]; value != "" {
+		lifetime, err := time.ParseDuration(value)
+		if err != nil || lifetime < minTokenLifetime {
+			return nil, fmt.Errorf("invalid %v %q, must be a duration of at least %v",
+				configTokenLifetime, value, minTokenLifetime)
+		}
+		t.lifetime = lifetime
+	}
+
+	switch role := config[configTokenRole]; role {
+	case "":
+	case roleSystemUser, roleSystemAdmin:
+		t.claims.Roles = []string{role}
+	default:
+		return nil, fmt.Errorf("invalid %v %q, must be %v or %v",
+			configTokenRole, role, roleSystemUser, roleSystemAdmin)
+	}
+
+	if name := config[configTokenName]; name != "" {
+		t.claims.Name = name
+	}
+	if subject := config[configTokenSubject]; subject != "" {
+		t.claims.Subject = subject
+	}
+
+	if secretName := config[pxTokenSecretNameKey]; secretName != "" {
+		if sharedSecret != "" {
+			return nil, fmt.Errorf("only one of %v and %v can be specified", pxSharedSecretKey, pxTokenSecretNameKey)
+		}
+		namespace := config[pxTokenSecretNamespaceKey]
+		if namespace == "" {
+			namespace = veleroNamespace()
+		}
+		key := config[pxTokenSecretKeyKey]
+		if key == "" {
+			key = defaultTokenSecretKey
+		}
+		secretKey := tokenSecretKey{kubeOps: core.Instance(), namespace: namespace, name: secretName, key: key}
+		if err := loadTokenSecret(secretKey); err != nil {
+			return nil, err
+		}
+		t.secretKey = &secretKey
+	}
+	return t, nil
+}
+
+// enabled returns true if calls are authenticated with a token
+func (t *tokenManager) enabled() bool {
+	return t != nil && (t.sharedSecret != "" || t.secretKey != nil)
+}
+
+// getToken returns a valid token, or an empty string if no token is
+// configured. Tokens from Secrets are returned as they are. Otherwise a new
+// token is generated once a fifth of the lifetime of the current one is left.
+func (t *tokenManager) getToken() (string, error) {
+	if !t.enabled() {
+		return "", nil
+	}
+	if t.secretKey != nil {
+		tokenSecretLock.Lock()
+		defer tokenSecretLock.Unlock()
+		return tokenSecrets[*t.secretKey], nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.token != "" && time.Until(t.expires) > t.lifetime/5 {
+		return t.token, nil
+	}
+
+	signature, err := auth.NewSignatureSharedSecret(t.sharedSecret)
+	if err != nil {
+		return "", err
+	}
+
+	expires := time.Now().Add(t.lifetime)
+	claims := t.claims
+	token, err := auth.Token(&claims, signature, &auth.Options{
+		Expiration:  expires.Unix(),
+		IATSubtract: tokenIATSubtract,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	t.token = token
+	t.expires = expires
+	return token, nil
+}
+
+// loadTokenSecret reads the token from the Secret and watches the Secret for
+// changes, once per process
+func loadTokenSecret(secretKey tokenSecretKey) error {
+	secret, err := secretKey.kubeOps.GetSecret(secretKey.name, secretKey.namespace)
+	if err != nil {
+		return fmt.Errorf("failed to get token secret %v: %v", secretKey, err)
+	}
+	if err := storeTokenSecret(secretKey, secret); err != nil {
+		return err
+	}
+	watchTokenSecret(secretKey, secret)
+	return nil
+}
+
+// secretToken returns the token in the Secret of the cluster of the client.
+// The Secret is read until it can be watched for changes. Errors getting the
+// Secret are returned as they are.
+func secretToken(kubeOps core.Ops, name, namespace, key string) (string, error) {
+	secretKey := tokenSecretKey{kubeOps: kubeOps, namespace: namespace, name: name, key: key}
+	tokenSecretLock.Lock()
+	token, watched := tokenSecrets[secretKey], tokenSecretWatches[secretKey]
+	tokenSecretLock.Unlock()
+	if watched {
+		return token, nil
+	}
+
+	secret, err := kubeOps.GetSecret(name, namespace)
+	if err != nil {
+		return "", err
+	}
+	if err := storeTokenSecret(secretKey, secret); err != nil {
+		return "", err
+	}
+	watchTokenSecret(secretKey, secret)
+
+	tokenSecretLock.Lock()
+	defer tokenSecretLock.Unlock()
+	return tokenSecrets[secretKey], nil
+}
+
+// watchTokenSecret reloads the token when the Secret changes, once per
+// process
+func watchTokenSecret(secretKey tokenSecretKey, secret *v1.Secret) {
+	tokenSecretLock.Lock()
+	defer tokenSecretLock.Unlock()
+	if tokenSecretWatches[secretKey] {
+		return
+	}
+	err := secretKey.kubeOps.WatchSecret(secret, func(object runtime.Object) error {
+		updated, ok := object.(*v1.Secret)
+		if !ok || updated.DeletionTimestamp != nil {
+			return nil
+		}
+		if err := storeTokenSecret(secretKey, updated); err != nil {
+			logrus.Errorf("Failed to reload token: %v", err)
+			return err
+		}
+		logrus.Infof("Reloaded token from secret %v", secretKey)
+		return nil
+	})
+	if err != nil {
+		logrus.Warnf("Failed to watch token secret %v, changes will be applied on the next Init: %v", secretKey, err)
+		return
+	}
+	tokenSecretWatches[secretKey] = true
+}
+
+func storeTokenSecret(secretKey tokenSecretKey, secret *v1.Secret) error {
+	token := strings.TrimSpace(string(secret.Data[secretKey.key]))
+	if token == "" {
+		return fmt.Errorf("token secret %v has no %v key", secretKey, secretKey.key)
+	}
+
+	tokenSecretLock.Lock()
+	defer tokenSecretLock.Unlock()
+	tokenSecrets[secretKey] = token
+	return nil
+}
@@ -0,0 +1,286 @@
+package snapshot
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// tokenClaims returns the claims of the token, without checking its
+// signature
+func tokenClaims(t *testing.T, token string) map[string]interface{} {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token %q is not a JWT", token)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("invalid token payload: %v", err)
+	}
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("invalid token claims: %v", err)
+	}
+	return claims
+}
+
+func TestNewTokenManager(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       map[string]string
+		wantLifetime time.Duration
+		wantRole     string
+		wantName     string
+		wantSubject  string
+		wantErr      bool
+	}{
+		{
+			name:         "default",
+			config:       map[string]string{},
+			wantLifetime: defaultTokenLifetime,
+			wantRole:     roleSystemUser,
+			wantName:     defaultTokenName,
+			wantSubject:  "stork.openstorage.io." + uniqueID,
+		},
+		{
+			name: "configured",
+			config: map[string]string{
+				configTokenLifetime: "2h",
+				configTokenRole:     roleSystemAdmin,
+				configTokenName:     "Velero",
+				configTokenSubject:  "velero@example.com",
+			},
+			wantLifetime: 2 * time.Hour,
+			wantRole:     roleSystemAdmin,
+			wantName:     "Velero",
+			wantSubject:  "velero@example.com",
+		},
+		{name: "invalid lifetime", config: map[string]string{configTokenLifetime: "forever"}, wantErr: true},
+		{name: "lifetime too short", config: map[string]string{configTokenLifetime: "30s"}, wantErr: true},
+		{name: "invalid role", config: map[string]string{configTokenRole: "system.guest"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tm, err := newTokenManager(test.config, "secret", "stork.openstorage.io")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("new token manager with %v returned error %v, want error %v", test.config, err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tm.lifetime != test.wantLifetime {
+				t.Errorf("token lifetime is %v, want %v", tm.lifetime, test.wantLifetime)
+			}
+
+			token, err := tm.getToken()
+			if err != nil {
+				t.Fatalf("failed to get token: %v", err)
+			}
+			claims := tokenClaims(t, token)
+			roles, _ := claims["roles"].([]interface{})
+			if len(roles) != 1 || roles[0] != test.wantRole {
+				t.Errorf("token roles are %v, want %v", claims["roles"], test.wantRole)
+			}
+			if claims["name"] != test.wantName || claims["sub"] != test.wantSubject {
+				t.Errorf("token is of %v (%v), want %v (%v)", claims["name"], claims["sub"], test.wantName, test.wantSubject)
+			}
+			if claims["iss"] != "stork.openstorage.io" {
+				t.Errorf("token issuer is %v, want stork.openstorage.io", claims["iss"])
+			}
+		})
+	}
+}
+
+func TestGetToken(t *testing.T) {
+	var disabled *tokenManager
+	if token, err := disabled.getToken(); token != "" || err != nil {
+		t.Errorf("token without config is %q with error %v, want none", token, err)
+	}
+
+	tm, err := newTokenManager(map[string]string{}, "secret", "stork.openstorage.io")
+	if err != nil {
+		t.Fatalf("failed to create token manager: %v", err)
+	}
+	token, err := tm.getToken()
+	if err != nil {
+		t.Fatalf("failed to get token: %v", err)
+	}
+	if exp, ok := tokenClaims(t, token)["exp"].(float64); !ok || time.Until(time.Unix(int64(exp), 0)) > tm.lifetime {
+		t.Errorf("token expires at %v, want within %v", tokenClaims(t, token)["exp"], tm.lifetime)
+	}
+
+	// The token is reused until a fifth of its lifetime is left
+	if again, _ := tm.getToken(); again != token {
+		t.Errorf("token was regenerated while still valid")
+	}
+	tm.expires = time.Now().Add(tm.lifetime / 10)
+	tm.claims.Name = "Renewed"
+	renewed, err := tm.getToken()
+	if err != nil {
+		t.Fatalf("failed to renew token: %v", err)
+	}
+	if tokenClaims(t, renewed)["name"] != "Renewed" {
+		t.Errorf("token about to expire was not renewed")
+	}
+	if time.Until(tm.expires) < tm.lifetime-time.Minute {
+		t.Errorf("renewed token expires at %v, want in %v", tm.expires, tm.lifetime)
+	}
+}
+
+// resetTokenSecrets clears the tokens read from Secrets for the duration of
+// the test
+func resetTokenSecrets(t *testing.T) {
+	tokenSecretLock.Lock()
+	secrets, watches := tokenSecrets, tokenSecretWatches
+	tokenSecrets, tokenSecretWatches = make(map[tokenSecretKey]string), make(map[tokenSecretKey]bool)
+	tokenSecretLock.Unlock()
+	t.Cleanup(func() {
+		tokenSecretLock.Lock()
+		tokenSecrets, tokenSecretWatches = secrets, watches
+		tokenSecretLock.Unlock()
+	})
+}
+
+func tokenSecret(namespace, key, token string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "px-token", Namespace: namespace},
+		Data:       map[string][]byte{key: []byte(token)},
+	}
+}
+
+func TestTokenSecret(t *testing.T) {
+	setEnv(t, veleroNamespaceEnv, "velero")
+	resetTokenSecrets(t)
+	kubeOps := newFakeKubeOps()
+	kubeOps.secrets["velero/px-token"] = tokenSecret("velero", defaultTokenSecretKey, "token-1\n")
+	useKubeOps(t, kubeOps)
+
+	tm, err := newTokenManager(map[string]string{pxTokenSecretNameKey: "px-token"}, "", "")
+	if err != nil {
+		t.Fatalf("failed to create token manager: %v", err)
+	}
+	if token, err := tm.getToken(); token != "token-1" || err != nil {
+		t.Errorf("token is %q with error %v, want token-1", token, err)
+	}
+
+	// Changes to the Secret are picked up without reading it again
+	if err := kubeOps.updateSecret(tokenSecret("velero", defaultTokenSecretKey, "token-2")); err != nil {
+		t.Fatalf("failed to reload the token: %v", err)
+	}
+	if token, _ := tm.getToken(); token != "token-2" {
+		t.Errorf("token is %q after the update, want token-2", token)
+	}
+	if _, err := newTokenManager(map[string]string{pxTokenSecretNameKey: "px-token"}, "", ""); err != nil {
+		t.Fatalf("failed to create second token manager: %v", err)
+	}
+	if watches := kubeOps.callCount("WatchSecret"); watches != 1 {
+		t.Errorf("secret was watched %v times, want 1", watches)
+	}
+}
+
+func TestTokenSecretErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]string
+		secret *v1.Secret
+		shared string
+	}{
+		{
+			name:   "shared secret and token secret",
+			config: map[string]string{pxTokenSecretNameKey: "px-token"},
+			secret: tokenSecret("velero", defaultTokenSecretKey, "token-1"),
+			shared: "secret",
+		},
+		{
+			name:   "missing secret",
+			config: map[string]string{pxTokenSecretNameKey: "px-token", pxTokenSecretNamespaceKey: "kube-system"},
+			secret: tokenSecret("velero", defaultTokenSecretKey, "token-1"),
+		},
+		{
+			name:   "missing key",
+			config: map[string]string{pxTokenSecretNameKey: "px-token", pxTokenSecretKeyKey: "token"},
+			secret: tokenSecret("velero", defaultTokenSecretKey, "token-1"),
+		},
+		{
+			name:   "empty token",
+			config: map[string]string{pxTokenSecretNameKey: "px-token"},
+			secret: tokenSecret("velero", defaultTokenSecretKey, " \n"),
+		},
+	}
+
+	setEnv(t, veleroNamespaceEnv, "velero")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetTokenSecrets(t)
+			kubeOps := newFakeKubeOps()
+			kubeOps.secrets["velero/px-token"] = test.secret
+			useKubeOps(t, kubeOps)
+
+			if _, err := newTokenManager(test.config, test.shared, ""); err == nil {
+				t.Errorf("new token manager with %v succeeded, want an error", test.config)
+			}
+		})
+	}
+}
+
+func TestSecretToken(t *testing.T) {
+	resetTokenSecrets(t)
+	kubeOps := newFakeKubeOps()
+	kubeOps.secrets["app/px-token"] = tokenSecret("app", "token", "tenant-token")
+
+	for i := 0; i < 2; i++ {
+		token, err := secretToken(kubeOps, "px-token", "app", "token")
+		if token != "tenant-token" || err != nil {
+			t.Errorf("token is %q with error %v, want tenant-token", token, err)
+		}
+	}
+	if gets := kubeOps.callCount("GetSecret"); gets != 1 {
+		t.Errorf("secret was read %v times, want once while watched", gets)
+	}
+	if _, err := secretToken(kubeOps, "px-token", "other", "token"); err == nil {
+		t.Errorf("token of a missing secret was found")
+	}
+}
+
+func TestSecretTokenClusters(t *testing.T) {
+	resetTokenSecrets(t)
+	secret := tokenSecret("app", "token", "token-1")
+	secret.Data["admin-token"] = []byte("admin-token-1")
+	kubeOps := newFakeKubeOps()
+	kubeOps.secrets["app/px-token"] = secret
+	remoteKubeOps := newFakeKubeOps()
+	remoteKubeOps.secrets["app/px-token"] = tokenSecret("app", "token", "remote-token-1")
+
+	tests := []struct {
+		kubeOps *fakeKubeOps
+		key     string
+		want    string
+	}{
+		{kubeOps: kubeOps, key: "token", want: "token-1"},
+		{kubeOps: kubeOps, key: "admin-token", want: "admin-token-1"},
+		{kubeOps: remoteKubeOps, key: "token", want: "remote-token-1"},
+	}
+	for _, test := range tests {
+		token, err := secretToken(test.kubeOps, "px-token", "app", test.key)
+		if token != test.want || err != nil {
+			t.Errorf("token in key %v is %q with error %v, want %v", test.key, token, err, test.want)
+		}
+	}
+
+	// Updates only apply to the Secret of their cluster
+	if err := remoteKubeOps.updateSecret(tokenSecret("app", "token", "remote-token-2")); err != nil {
+		t.Fatalf("failed to reload the token: %v", err)
+	}
+	if token, _ := secretToken(remoteKubeOps, "px-token", "app", "token"); token != "remote-token-2" {
+		t.Errorf("remote token is %q after the update, want remote-token-2", token)
+	}
+	if token, _ := secretToken(kubeOps, "px-token", "app", "token"); token != "token-1" {
+		t.Errorf("token is %q after the remote update, want token-1", token)
+	}
+}
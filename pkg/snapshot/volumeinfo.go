@@ -0,0 +1,143 @@
+package snapshot
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Keys of the volume type returned by GetVolumeInfo. The volume type is
+	// the snapshot type followed by the spec of the volume as a query
+	// string, e.g. portworx-snapshot?cos=high&io_profile=db&repl=3
+	volumeTypeCos       = "cos"
+	volumeTypeIoProfile = "io_profile"
+	volumeTypeRepl      = "repl"
+	volumeTypeReadIops  = "read_iops"
+	volumeTypeWriteIops = "write_iops"
+	volumeTypeZones     = "zones"
+	volumeTypeRacks     = "racks"
+)
+
+// volumeInfo returns the volume type and IOPS of the volume for Velero to
+// record in the backup, inspecting the volume as the tenant owning it
+func volumeInfo(pxClient *portworxClient, volumeID, snapshotType string, log logrus.FieldLogger) (string, *int64, error) {
+	volDriver, err := pxClient.getVolumeDriverForVolume(volumeID, log)
+	if err != nil {
+		return "", nil, err
+	}
+
+	vols, err := volDriver.Inspect([]string{volumeID})
+	if err != nil {
+		return "", nil, err
+	}
+	if len(vols) == 0 {
+		return "", nil, fmt.Errorf("Volume %v not found", volumeID)
+	}
+	spec := vols[0].Spec
+	if spec == nil {
+		return snapshotType, nil, nil
+	}
+
+	zones, racks := replicaTopology(pxClient, vols[0], log)
+	volumeType, iops := encodeVolumeType(snapshotType, spec, zones, racks)
+	return volumeType, iops, nil
+}
+
+// encodeVolumeType returns the volume type with the spec and replica topology
+// of the volume, and the IOPS of the volume if it is throttled
+func encodeVolumeType(snapshotType string, spec *api.VolumeSpec, zones, racks []string) (string, *int64) {
+	values := url.Values{}
+	if spec.Cos != api.CosType_NONE {
+		values.Set(volumeTypeCos, spec.Cos.SimpleString())
+	}
+	values.Set(volumeTypeIoProfile, spec.IoProfile.SimpleString())
+	if spec.HaLevel > 0 {
+		values.Set(volumeTypeRepl, strconv.FormatInt(spec.HaLevel, 10))
+	}
+	if len(zones) > 0 {
+		values.Set(volumeTypeZones, strings.Join(zones, ","))
+	}
+	if len(racks) > 0 {
+		values.Set(volumeTypeRacks, strings.Join(racks, ","))
+	}
+
+	var iops *int64
+	if throttle := spec.IoThrottle; throttle != nil && (throttle.ReadIops > 0 || throttle.WriteIops > 0) {
+		values.Set(volumeTypeReadIops, strconv.FormatUint(uint64(throttle.ReadIops), 10))
+		values.Set(volumeTypeWriteIops, strconv.FormatUint(uint64(throttle.WriteIops), 10))
+		max := int64(throttle.ReadIops)
+		if int64(throttle.WriteIops) > max {
+			max = int64(throttle.WriteIops)
+		}
+		iops = &max
+	}
+	return snapshotType + "?" + values.Encode(), iops
+}
+
+// parseVolumeInfo returns restore overrides with the spec recorded by
+// volumeInfo. Volume types without a spec, like the ones recorded by older
+// versions of the plugin, and invalid values are ignored. Replicas are placed
+// in volumeAZ if set, or else preferably in the zones recorded in the volume
+// type, unless they are mapped by the zone map.
+func parseVolumeInfo(
+	volumeType, volumeAZ string,
+	iops *int64,
+	zoneMap map[string]string,
+	log logrus.FieldLogger,
+) *restoreOverrides {
+	r := &restoreOverrides{}
+	var zones, racks []string
+
+	if i := strings.Index(volumeType, "?"); i >= 0 {
+		values, err := url.ParseQuery(volumeType[i+1:])
+		if err != nil {
+			log.Warnf("Ignoring invalid volume type %q: %v", volumeType, err)
+			values = url.Values{}
+		}
+
+		if value := values.Get(volumeTypeCos); value != "" {
+			if cos, err := api.CosTypeSimpleValueOf(value); err == nil {
+				r.cos = cos
+			}
+		}
+		if value := values.Get(volumeTypeIoProfile); value != "" {
+			if ioProfile, err := api.IoProfileSimpleValueOf(value); err == nil {
+				r.ioProfile = &ioProfile
+			}
+		}
+		if value := values.Get(volumeTypeRepl); value != "" {
+			if haLevel, err := strconv.ParseInt(value, 10, 64); err == nil && haLevel >= minHaLevel && haLevel <= maxHaLevel {
+				r.haLevel = haLevel
+			}
+		}
+
+		readIops, rerr := strconv.ParseUint(values.Get(volumeTypeReadIops), 10, 32)
+		writeIops, werr := strconv.ParseUint(values.Get(volumeTypeWriteIops), 10, 32)
+		if rerr == nil && werr == nil && (readIops > 0 || writeIops > 0) {
+			r.ioThrottle = &api.IoThrottle{ReadIops: uint32(readIops), WriteIops: uint32(writeIops)}
+		}
+
+		if value := values.Get(volumeTypeZones); value != "" {
+			zones = strings.Split(value, ",")
+		}
+		if value := values.Get(volumeTypeRacks); value != "" {
+			racks = strings.Split(value, ",")
+		}
+	}
+
+	// Velero may only have kept the IOPS, apply them to reads and writes
+	if r.ioThrottle == nil && iops != nil && *iops > 0 && *iops <= int64(^uint32(0)) {
+		r.ioThrottle = &api.IoThrottle{ReadIops: uint32(*iops), WriteIops: uint32(*iops)}
+	}
+
+	if volumeAZ != "" {
+		zones = []string{volumeAZ}
+	}
+	r.placement = restorePlacement(zones, racks, zoneMap, volumeAZ != "")
+	return r
+}
@@ -0,0 +1,167 @@
+package snapshot
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/libopenstorage/openstorage/api"
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() logrus.FieldLogger {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	return log
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+func TestEncodeVolumeType(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  *api.VolumeSpec
+		zones []string
+		racks []string
+		want  string
+		iops  *int64
+	}{
+		{
+			name: "defaults",
+			spec: &api.VolumeSpec{},
+			want: "portworx-snapshot?io_profile=sequential",
+		},
+		{
+			name:  "full spec",
+			spec:  &api.VolumeSpec{Cos: api.CosType_HIGH, IoProfile: api.IoProfile_IO_PROFILE_DB, HaLevel: 3},
+			zones: []string{"zone-a", "zone-b"},
+			racks: []string{"rack-1"},
+			want:  "portworx-snapshot?cos=high&io_profile=db&racks=rack-1&repl=3&zones=zone-a%2Czone-b",
+		},
+		{
+			name: "throttled",
+			spec: &api.VolumeSpec{IoThrottle: &api.IoThrottle{ReadIops: 100, WriteIops: 200}},
+			want: "portworx-snapshot?io_profile=sequential&read_iops=100&write_iops=200",
+			iops: int64Ptr(200),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			volumeType, iops := encodeVolumeType("portworx-snapshot", test.spec, test.zones, test.racks)
+			if volumeType != test.want {
+				t.Errorf("volume type is %q, want %q", volumeType, test.want)
+			}
+			if !reflect.DeepEqual(iops, test.iops) {
+				t.Errorf("IOPS are %v, want %v", iops, test.iops)
+			}
+		})
+	}
+}
+
+func TestParseVolumeInfo(t *testing.T) {
+	db := api.IoProfile_IO_PROFILE_DB
+
+	tests := []struct {
+		name       string
+		volumeType string
+		volumeAZ   string
+		iops       *int64
+		zoneMap    map[string]string
+		want       *restoreOverrides
+	}{
+		{
+			name:       "legacy volume type",
+			volumeType: "portworx-snapshot",
+			want:       &restoreOverrides{},
+		},
+		{
+			name:       "spec",
+			volumeType: "portworx-snapshot?cos=high&io_profile=db&repl=2&read_iops=100&write_iops=200",
+			want: &restoreOverrides{
+				cos:        api.CosType_HIGH,
+				ioProfile:  &db,
+				haLevel:    2,
+				ioThrottle: &api.IoThrottle{ReadIops: 100, WriteIops: 200},
+			},
+		},
+		{
+			name:       "invalid values are ignored",
+			volumeType: "portworx-snapshot?cos=fast&io_profile=unknown&repl=5&read_iops=x",
+			want:       &restoreOverrides{},
+		},
+		{
+			name:       "invalid query is ignored",
+			volumeType: "portworx-snapshot?cos=%zz",
+			want:       &restoreOverrides{},
+		},
+		{
+			name:       "iops kept by Velero",
+			volumeType: "portworx-snapshot",
+			iops:       int64Ptr(300),
+			want:       &restoreOverrides{ioThrottle: &api.IoThrottle{ReadIops: 300, WriteIops: 300}},
+		},
+		{
+			name:       "recorded zones are preferred",
+			volumeType: "portworx-snapshot?zones=zone-a&racks=rack-1",
+			want: &restoreOverrides{
+				placement: restorePlacement([]string{"zone-a"}, []string{"rack-1"}, nil, false),
+			},
+		},
+		{
+			name:       "volume AZ is required",
+			volumeType: "portworx-snapshot?zones=zone-a",
+			volumeAZ:   "zone-b",
+			want: &restoreOverrides{
+				placement: restorePlacement([]string{"zone-b"}, nil, nil, true),
+			},
+		},
+		{
+			name:       "mapped zones",
+			volumeType: "portworx-snapshot?zones=zone-a&racks=rack-1",
+			zoneMap:    map[string]string{"zone-a": "zone-c"},
+			want: &restoreOverrides{
+				placement: restorePlacement([]string{"zone-c"}, nil, nil, true),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseVolumeInfo(test.volumeType, test.volumeAZ, test.iops, test.zoneMap, testLogger())
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("overrides are %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVolumeInfoRoundTrip(t *testing.T) {
+	spec := &api.VolumeSpec{
+		Cos:        api.CosType_MEDIUM,
+		IoProfile:  api.IoProfile_IO_PROFILE_CMS,
+		HaLevel:    3,
+		IoThrottle: &api.IoThrottle{ReadIops: 500, WriteIops: 50},
+	}
+	volumeType, iops := encodeVolumeType("portworx-cloudsnapshot", spec, []string{"zone-a"}, []string{"rack-1", "rack-2"})
+	got := parseVolumeInfo(volumeType, "", iops, nil, testLogger())
+
+	if got.cos != spec.Cos {
+		t.Errorf("cos is %v, want %v", got.cos, spec.Cos)
+	}
+	if got.ioProfile == nil || *got.ioProfile != spec.IoProfile {
+		t.Errorf("io profile is %v, want %v", got.ioProfile, spec.IoProfile)
+	}
+	if got.haLevel != spec.HaLevel {
+		t.Errorf("ha level is %v, want %v", got.haLevel, spec.HaLevel)
+	}
+	if !reflect.DeepEqual(got.ioThrottle, spec.IoThrottle) {
+		t.Errorf("io throttle is %v, want %v", got.ioThrottle, spec.IoThrottle)
+	}
+	want := restorePlacement([]string{"zone-a"}, []string{"rack-1", "rack-2"}, nil, false)
+	if !reflect.DeepEqual(got.placement, want) {
+		t.Errorf("placement is %v, want %v", got.placement, want)
+	}
+}